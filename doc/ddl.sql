@@ -1,3 +1,5 @@
+# 最新版本的表结构，仅供参考，建表与升级使用 `seeflow migrate up`，见 pkg/tracer/migrations.go
+
 # Apache Doris
 
 CREATE TABLE IF NOT EXISTS `t_L34`
@@ -9,21 +11,54 @@ CREATE TABLE IF NOT EXISTS `t_L34`
     is_reply            BOOLEAN,
     traffic_direction   VARCHAR(15),
     traffic_observation VARCHAR(15),
-    verdict             VARCHAR(15)
-) DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32
-    PROPERTIES ("replication_num" = "1");
+    verdict             VARCHAR(15),
+    tcp_flags           VARCHAR(63),
+    drop_reason         VARCHAR(63)
+) DUPLICATE KEY(time)
+    PARTITION BY RANGE(time) ()
+    DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32
+    PROPERTIES (
+        "replication_num" = "1",
+        "dynamic_partition.enable" = "true",
+        "dynamic_partition.time_unit" = "DAY",
+        "dynamic_partition.end" = "3",
+        "dynamic_partition.prefix" = "p",
+        "dynamic_partition.buckets" = "32"
+    );
 
 
 CREATE TABLE IF NOT EXISTS `t_L7`
 (
-    id            CHAR(36),
-    trace_id      CHAR(16),
-    src_identity  BIGINT,
-    dest_identity BIGINT,
-    start_time    DATETIME(6),
-    end_time      DATETIME(6)
-) DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32
-    PROPERTIES ("replication_num" = "1");
+    start_time       DATETIME(6),
+    id               CHAR(36),
+    trace_id         CHAR(32),
+    parent_span_id   CHAR(16),
+    namespace        VARCHAR(127),
+    src_identity     BIGINT,
+    src_pod          VARCHAR(127),
+    src_svc          VARCHAR(127),
+    dest_identity    BIGINT,
+    dest_pod         VARCHAR(127),
+    dest_svc         VARCHAR(127),
+    end_time         DATETIME(6),
+    protocol         VARCHAR(15),
+    http_method      VARCHAR(15),
+    http_url         VARCHAR(2048),
+    http_status_code INT,
+    latency_ns       BIGINT,
+    http_headers     VARCHAR(2048),
+    no_response      BOOLEAN
+) DUPLICATE KEY(start_time)
+    PARTITION BY RANGE(start_time) ()
+    DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32
+    PROPERTIES (
+        "replication_num" = "1",
+        "dynamic_partition.enable" = "true",
+        "dynamic_partition.time_unit" = "DAY",
+        "dynamic_partition.end" = "3",
+        "dynamic_partition.prefix" = "p",
+        "dynamic_partition.buckets" = "32"
+    );
 
 CREATE TABLE IF NOT EXISTS `t_Sock`
 (
@@ -34,8 +69,17 @@ CREATE TABLE IF NOT EXISTS `t_Sock`
     event_type    TINYINT,
     sub_type      TINYINT,
     cgroup_id     INT
-) DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32
-    PROPERTIES ("replication_num" = "1");
+) DUPLICATE KEY(time)
+    PARTITION BY RANGE(time) ()
+    DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32
+    PROPERTIES (
+        "replication_num" = "1",
+        "dynamic_partition.enable" = "true",
+        "dynamic_partition.time_unit" = "DAY",
+        "dynamic_partition.end" = "3",
+        "dynamic_partition.prefix" = "p",
+        "dynamic_partition.buckets" = "32"
+    );
 
 CREATE TABLE IF NOT EXISTS `t_Ep`
 (
@@ -48,3 +92,33 @@ CREATE TABLE IF NOT EXISTS `t_Ep`
     ip        VARCHAR(15)
 ) DISTRIBUTED BY HASH(endpoint) BUCKETS 32
     PROPERTIES ("replication_num" = "1");
+
+CREATE TABLE IF NOT EXISTS `t_Ckpt`
+(
+    node_name VARCHAR(127),
+    time_ns   BIGINT,
+    uuids     VARCHAR(4096)
+) UNIQUE KEY(node_name)
+    DISTRIBUTED BY HASH(node_name) BUCKETS 1
+    PROPERTIES ("replication_num" = "1");
+
+CREATE TABLE IF NOT EXISTS `t_SpanAssign`
+(
+    trace_id      CHAR(32),
+    id            CHAR(36),
+    start_time    DATETIME(6),
+    span_id       CHAR(16),
+    dest_identity BIGINT,
+    dest_pod      VARCHAR(127),
+    end_time      DATETIME(6)
+) UNIQUE KEY(trace_id, id, start_time)
+    PARTITION BY RANGE(start_time) ()
+    DISTRIBUTED BY HASH(trace_id) BUCKETS 32
+    PROPERTIES (
+        "replication_num" = "1",
+        "dynamic_partition.enable" = "true",
+        "dynamic_partition.time_unit" = "DAY",
+        "dynamic_partition.end" = "3",
+        "dynamic_partition.prefix" = "p",
+        "dynamic_partition.buckets" = "32"
+    );
@@ -0,0 +1,50 @@
+package tracer
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stleox/seeflow/pkg/config"
+	"sync"
+)
+
+// AssembleTask 周期性聚合静默的 Trace 并导出
+type AssembleTask struct {
+	m     *BgTaskManager
+	muRun sync.Mutex
+	c     *cron.Cron
+}
+
+func (m *BgTaskManager) addAssembleTask() {
+	m.bgTasks = append(m.bgTasks, &AssembleTask{
+		m: m,
+	})
+}
+
+func (t *AssembleTask) Run() {
+	// 上一轮还没结束则跳过，避免同一 Trace 被并发聚合
+	if !t.muRun.TryLock() {
+		return
+	}
+	defer t.muRun.Unlock()
+
+	numTrace := t.m.tm.AssembleQuiescent(config.AssembleQuiescence)
+	if numTrace != 0 {
+		logrus.Debugf("SeeFlow assembled %d traces", numTrace)
+	}
+}
+
+func (t *AssembleTask) Start() {
+	c := cron.New()
+	_, err := c.AddJob(fmt.Sprintf("@every %s", config.AssembleInterval), t)
+	if err != nil {
+		logrus.Warn("SeeFlow couldn't add assemble task")
+		return
+	}
+	c.Start()
+	t.c = c
+}
+
+func (t *AssembleTask) Stop() {
+	stopCron(t.c)
+}
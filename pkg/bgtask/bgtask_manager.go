@@ -2,6 +2,7 @@ package tracer
 
 import (
 	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/robfig/cron/v3"
 	"github.com/stleox/seeflow/pkg/tracer"
 )
 
@@ -10,23 +11,32 @@ import (
 // - Sync t_Ep table
 // - Sync namespace list
 // - Run Assemble algorithm
+// - Expire unmatched flows
+// - Drop expired partitions
 type BgTaskManager struct {
 	bgTasks []BgTask
 	hubble  observerpb.ObserverClient
-	olap    *tracer.Olap
+	tm      *tracer.TracerManager
+	store   tracer.Store
 }
 
 type BgTask interface {
 	Start()
+	// Stop 停止调度，并等待正在运行的一轮结束
+	Stop()
 }
 
-func NewBgTaskManager(hubble observerpb.ObserverClient, olap *tracer.Olap) *BgTaskManager {
+func NewBgTaskManager(hubble observerpb.ObserverClient, tm *tracer.TracerManager) *BgTaskManager {
 	m := &BgTaskManager{
 		bgTasks: make([]BgTask, 0),
 		hubble:  hubble,
-		olap:    olap,
+		tm:      tm,
+		store:   tm.Store(),
 	}
 	m.addNamespaceTask()
+	m.addAssembleTask()
+	m.addSweepTask()
+	m.addRetentionTask()
 	return m
 }
 
@@ -35,3 +45,16 @@ func (m *BgTaskManager) StartAll() {
 		task.Start()
 	}
 }
+
+func (m *BgTaskManager) StopAll() {
+	for _, task := range m.bgTasks {
+		task.Stop()
+	}
+}
+
+// 停止 cron，并等待正在运行的任务结束；未启动则忽略
+func stopCron(c *cron.Cron) {
+	if c != nil {
+		<-c.Stop().Done()
+	}
+}
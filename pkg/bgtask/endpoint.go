@@ -2,49 +2,19 @@ package tracer
 
 import (
 	"context"
+	"fmt"
 	"github.com/cilium/cilium/pkg/hive"
 	"github.com/cilium/cilium/pkg/hive/cell"
 	"github.com/cilium/cilium/pkg/k8s/client"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
-	"github.com/zeromicro/go-zero/core/stores/sqlx"
+	"github.com/stleox/seeflow/pkg/tracer"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// 通过数据库 t_Ep 小表，维持 Cilium 中的 endpoint 列表
-type Endpoint struct {
-	Namespace string `db:"namespace"`
-	PodName   string `db:"pod_name"`
-	SvcName   string `db:"svc_name"`
-	Endpoint  uint32 `db:"endpoint"`
-	Identity  string `db:"identity"`
-	State     string `db:"state"`
-	IP        string `db:"ip"` // now supported IPv4
-}
-
-// 全量更新，先清表再插入
-func insertEndpoints(db sqlx.SqlConn, endpoints []*Endpoint) {
-	inserter, err := sqlx.NewBulkInserter(db, "")
-	if err != nil {
-		logrus.Error("SeeFlow couldn't open t_Ep")
-	}
-	defer inserter.Flush()
-
-	_, err = db.Exec("TRUNCATE TABLE `t_Ep`")
-	if err != nil {
-		logrus.Error("SeeFlow couldn't truncate t_Ep")
-	}
-
-	for _, ep := range endpoints {
-		err = inserter.Insert(ep.Namespace, ep.PodName, ep.SvcName, ep.Endpoint, ep.Identity, ep.State, ep.IP)
-		if err != nil {
-			logrus.Error("SeeFlow couldn't insert into t_Ep")
-		}
-	}
-}
-
 type EndpointTask struct {
 	m *BgTaskManager
+	c *cron.Cron
 }
 
 func (m *BgTaskManager) addEndpointTask() {
@@ -53,13 +23,22 @@ func (m *BgTaskManager) addEndpointTask() {
 	})
 }
 
+// 通过 t_Ep 小表，维持 Cilium 中的 endpoint 列表
 func (t *EndpointTask) Run() {
-	endpoints := make([]*Endpoint, 0)
-	fetchEndpoints(endpoints)
-	insertEndpoints(t.m.olap.Conn(), nil)
+	if t.m.store == nil {
+		return
+	}
+	endpoints, err := fetchEndpoints()
+	if err != nil {
+		logrus.WithError(err).Error("SeeFlow couldn't get endpoints")
+		return
+	}
+	if err := t.m.store.SaveEndpoints(endpoints); err != nil {
+		logrus.WithError(err).Error("SeeFlow couldn't save endpoints into t_Ep")
+	}
 }
 
-func fetchEndpoints(endpoints []*Endpoint) {
+func fetchEndpoints() ([]*tracer.Endpoint, error) {
 	// 获取 endpoint CRD 参考 github.com/cilium/cilium@v1.15.2/pkg/k8s/client/client_test.go:268
 	var myClientset client.Clientset
 	myHive := hive.New(
@@ -69,19 +48,23 @@ func fetchEndpoints(endpoints []*Endpoint) {
 	ctx := context.Background()
 	err := myHive.Start(ctx)
 	if err != nil {
-		logrus.Error("SeeFlow couldn't start myHive")
-		return
+		return nil, fmt.Errorf("couldn't start hive: %w", err)
+	}
+	defer func() { _ = myHive.Stop(ctx) }()
+	// 不在集群中（没有 kubeconfig）时 client 未启用，CiliumV2 为空
+	if !myClientset.IsEnabled() {
+		return nil, fmt.Errorf("k8s client is disabled")
 	}
-	// fixme: CiliumV2 is nil
 	_, err = myClientset.CiliumV2().CiliumEndpoints("kube-system").Get(ctx, "cep", metav1.GetOptions{})
 	if err != nil {
-		logrus.Error("SeeFlow couldn't get endpoints")
-		return
+		return nil, err
 	}
+	// todo: 将 CiliumEndpoint 转换为 Endpoint
+	return make([]*tracer.Endpoint, 0), nil
 }
 
 func (t *EndpointTask) Start() {
-	// olap 初始化时已建表
+	// t_Ep 由 `seeflow migrate up` 创建
 
 	c := cron.New()
 	_, err := c.AddJob("@every 1s", t)
@@ -90,4 +73,9 @@ func (t *EndpointTask) Start() {
 		return
 	}
 	c.Start()
+	t.c = c
+}
+
+func (t *EndpointTask) Stop() {
+	stopCron(t.c)
 }
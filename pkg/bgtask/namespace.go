@@ -5,14 +5,12 @@ import (
 	observerpb "github.com/cilium/cilium/api/v1/observer"
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
-
-	"sync"
 )
 
 type NamespaceTask struct {
 	m        *BgTaskManager
-	muUpdate sync.Mutex
 	kRequest *observerpb.GetNamespacesRequest
+	c        *cron.Cron
 }
 
 func (m *BgTaskManager) addNamespaceTask() {
@@ -31,12 +29,11 @@ func (t *NamespaceTask) Run() {
 		return
 	}
 
-	t.muUpdate.Lock()
-	t.m.olap.ActiveNamespaces = make([]string, 0) // 重置
+	namespaces := make([]string, 0, len(resp.Namespaces))
 	for _, namespace := range resp.Namespaces {
-		t.m.olap.ActiveNamespaces = append(t.m.olap.ActiveNamespaces, namespace.String())
+		namespaces = append(namespaces, namespace.String())
 	}
-	t.muUpdate.Unlock()
+	t.m.tm.SetActiveNamespaces(namespaces)
 
 }
 
@@ -48,6 +45,11 @@ func (t *NamespaceTask) Start() {
 		return
 	}
 	c.Start()
+	t.c = c
+}
+
+func (t *NamespaceTask) Stop() {
+	stopCron(t.c)
 }
 
 // 级联删除
@@ -0,0 +1,69 @@
+package tracer
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stleox/seeflow/pkg/config"
+	"github.com/stleox/seeflow/pkg/tracer"
+	"time"
+)
+
+// RetentionTask 周期性删除各表中超过保留时长的分区，并记录回收的时间范围
+type RetentionTask struct {
+	p tracer.Partitioner
+	c *cron.Cron
+}
+
+func (m *BgTaskManager) addRetentionTask() {
+	// 内存存储没有分区
+	p, ok := m.store.(tracer.Partitioner)
+	if !ok {
+		return
+	}
+	m.bgTasks = append(m.bgTasks, &RetentionTask{
+		p: p,
+	})
+}
+
+// 各表的保留时长，0 表示不删除
+func retentions() map[string]time.Duration {
+	return map[string]time.Duration{
+		"t_L34":        config.RetentionL34,
+		"t_Sock":       config.RetentionSock,
+		"t_L7":         config.RetentionL7,
+		"t_SpanAssign": config.RetentionSpanAssign,
+	}
+}
+
+func (t *RetentionTask) Run() {
+	now := time.Now()
+	for table, retention := range retentions() {
+		if retention <= 0 {
+			continue
+		}
+		dropped, err := t.p.DropPartitions(table, now.Add(-retention))
+		for _, p := range dropped {
+			logrus.Infof("SeeFlow dropped partition %s of %s, reclaimed [%s, %s)",
+				p.Name, table, p.From.Format(time.DateTime), p.To.Format(time.DateTime))
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("SeeFlow couldn't drop expired partitions of %s", table)
+		}
+	}
+}
+
+func (t *RetentionTask) Start() {
+	c := cron.New()
+	_, err := c.AddJob(fmt.Sprintf("@every %s", config.RetentionInterval), t)
+	if err != nil {
+		logrus.Warn("SeeFlow couldn't add retention task")
+		return
+	}
+	c.Start()
+	t.c = c
+}
+
+func (t *RetentionTask) Stop() {
+	stopCron(t.c)
+}
@@ -0,0 +1,55 @@
+package tracer
+
+import (
+	"github.com/stleox/seeflow/pkg/config"
+	"github.com/stleox/seeflow/pkg/tracer"
+	"testing"
+	"time"
+)
+
+// fakePartitioner 记录各表的删除截止时间
+type fakePartitioner struct {
+	befores map[string]time.Time
+}
+
+func (p *fakePartitioner) DropPartitions(table string, before time.Time) ([]tracer.Partition, error) {
+	p.befores[table] = before
+	return []tracer.Partition{{Table: table, Name: "p20240101", From: before.Add(-48 * time.Hour), To: before.Add(-24 * time.Hour)}}, nil
+}
+
+func TestRetentionTask_Run(t *testing.T) {
+	defer func(l34, sock time.Duration) {
+		config.RetentionL34, config.RetentionSock = l34, sock
+	}(config.RetentionL34, config.RetentionSock)
+	config.RetentionL34 = 24 * time.Hour
+	config.RetentionSock = 0
+
+	p := &fakePartitioner{befores: make(map[string]time.Time)}
+	task := &RetentionTask{p: p}
+	task.Run()
+
+	// 保留时长为 0 的表不删除
+	if _, hit := p.befores["t_Sock"]; hit {
+		t.Fatal("t_Sock should be kept forever")
+	}
+	before, hit := p.befores["t_L34"]
+	if !hit {
+		t.Fatal("t_L34 should be checked")
+	}
+	if d := time.Since(before) - 24*time.Hour; d < 0 || d > time.Minute {
+		t.Fatalf("unexpected cutoff %s", before)
+	}
+	if len(p.befores) != 3 {
+		t.Fatalf("unexpected tables %v", p.befores)
+	}
+}
+
+func TestBgTaskManager_RetentionTask(t *testing.T) {
+	// 内存存储没有分区，不添加任务
+	m := NewBgTaskManager(nil, tracer.NewTracerManager(nil))
+	for _, task := range m.bgTasks {
+		if _, ok := task.(*RetentionTask); ok {
+			t.Fatal("memory store shouldn't have a retention task")
+		}
+	}
+}
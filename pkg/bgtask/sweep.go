@@ -0,0 +1,46 @@
+package tracer
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stleox/seeflow/pkg/config"
+	"time"
+)
+
+// SweepTask 周期性淘汰等待配对超时的流量。
+// 流量稀疏时缓存中的请求不会被后续流量淘汰，所以节点静默超过 RequestTimeout 后以墙上时间超时。
+type SweepTask struct {
+	m *BgTaskManager
+	c *cron.Cron
+}
+
+func (m *BgTaskManager) addSweepTask() {
+	m.bgTasks = append(m.bgTasks, &SweepTask{
+		m: m,
+	})
+}
+
+func (t *SweepTask) Run() {
+	numExpired := t.m.tm.ExpireFlows(time.Now())
+	if numExpired != 0 {
+		stats := t.m.tm.PendingStats()
+		logrus.Debugf("SeeFlow expired %d unmatched flows, pending: %d, matched: %d, expired: %d, evicted: %d",
+			numExpired, stats.Pending, stats.Matched, stats.Expired, stats.Evicted)
+	}
+}
+
+func (t *SweepTask) Start() {
+	c := cron.New()
+	_, err := c.AddJob(fmt.Sprintf("@every %s", config.SweepInterval), t)
+	if err != nil {
+		logrus.Warn("SeeFlow couldn't add sweep task")
+		return
+	}
+	c.Start()
+	t.c = c
+}
+
+func (t *SweepTask) Stop() {
+	stopCron(t.c)
+}
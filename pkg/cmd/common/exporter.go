@@ -0,0 +1,74 @@
+package common
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+	"strings"
+)
+
+var (
+	// exporter flags，绑定到 viper 键 SEEFLOW_EXPORTER*
+	exporterFlags = pflag.NewFlagSet("exporter", pflag.ContinueOnError)
+)
+
+func init() {
+	exporterFlags.String("exporter", pkgtracer.ExporterNone,
+		fmt.Sprintf("Trace exporter backend, one of: %s", strings.Join(pkgtracer.ExporterKinds(), ", ")))
+	exporterFlags.String("exporter-endpoint", "", "Exporter endpoint as host:port, or the output path for the file exporter")
+	exporterFlags.StringToString("exporter-headers", nil, "Extra headers sent to the exporter endpoint, e.g. Authorization=xxx")
+	exporterFlags.Bool("exporter-insecure", false, "Disable TLS towards the exporter endpoint")
+	exporterFlags.String("exporter-ca-file", "", "CA certificate used to verify the exporter endpoint")
+	exporterFlags.String("exporter-compression", pkgtracer.CompressionNone,
+		fmt.Sprintf("Exporter compression, one of: %s, %s", pkgtracer.CompressionNone, pkgtracer.CompressionGzip))
+	exporterFlags.String("exporter-encoding", pkgtracer.EncodingProtobuf,
+		fmt.Sprintf("OTLP/HTTP exporter encoding, one of: %s, %s", pkgtracer.EncodingProtobuf, pkgtracer.EncodingJSON))
+}
+
+// AddExporterFlags 为子命令注册 exporter 参数
+func AddExporterFlags(cmd *cobra.Command, vp *viper.Viper) {
+	cmd.Flags().AddFlagSet(exporterFlags)
+	BindFlags(vp, exporterFlags)
+}
+
+// GetExporterOptions 从 viper 读取 exporter 配置，优先级：参数 > 环境变量 > 配置文件
+func GetExporterOptions(vp *viper.Viper) pkgtracer.ExporterOptions {
+	return pkgtracer.ExporterOptions{
+		Kind:        vp.GetString("SEEFLOW_EXPORTER"),
+		Endpoint:    vp.GetString("SEEFLOW_EXPORTER_ENDPOINT"),
+		Headers:     getStringMap(vp, "SEEFLOW_EXPORTER_HEADERS"),
+		Insecure:    vp.GetBool("SEEFLOW_EXPORTER_INSECURE"),
+		CAFile:      vp.GetString("SEEFLOW_EXPORTER_CA_FILE"),
+		Compression: vp.GetString("SEEFLOW_EXPORTER_COMPRESSION"),
+		Encoding:    vp.GetString("SEEFLOW_EXPORTER_ENCODING"),
+	}
+}
+
+// BindFlags 将参数绑定到同名的 viper 键，比如 `--exporter-endpoint` 绑定到 SEEFLOW_EXPORTER_ENDPOINT。
+// 显式绑定环境变量，避免 AutomaticEnv 再次拼接 SEEFLOW_ 前缀。
+func BindFlags(vp *viper.Viper, flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		key := "SEEFLOW_" + strings.ToUpper(strings.ReplaceAll(flag.Name, "-", "_"))
+		_ = vp.BindPFlag(key, flag)
+		_ = vp.BindEnv(key, key)
+	})
+}
+
+// 兼容 map（参数、配置文件）与 "k1=v1,k2=v2" 字符串（环境变量）两种形式
+func getStringMap(vp *viper.Viper, key string) map[string]string {
+	raw, ok := vp.Get(key).(string)
+	if !ok {
+		return vp.GetStringMapString(key)
+	}
+	m := make(map[string]string)
+	for _, kv := range strings.Split(raw, ",") {
+		k, v, found := strings.Cut(kv, "=")
+		if !found || strings.TrimSpace(k) == "" {
+			continue
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"fmt"
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/proto"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// FilterRule 一条过滤规则，可来自配置文件或参数。
+// 不同字段之间是“与”，同一字段的多个值是“或”；namespace、label、pod 匹配源或目的任意一侧。
+type FilterRule struct {
+	Namespace  []string `mapstructure:"namespace"`
+	Label      []string `mapstructure:"label"`
+	Pod        []string `mapstructure:"pod"`
+	HTTPStatus []string `mapstructure:"http-status"`
+	Verdict    []string `mapstructure:"verdict"`
+}
+
+// FilterConfig 对应配置文件中的 SEEFLOW_FILTERS 键，例如：
+//
+//	seeflow_filters:
+//	  block:
+//	    - namespace: [kube-system, monitoring]
+type FilterConfig struct {
+	Allow []FilterRule `mapstructure:"allow"`
+	Block []FilterRule `mapstructure:"block"`
+}
+
+// FlowFilters 编译后的过滤器，用于 GetFlowsRequest
+type FlowFilters struct {
+	Allow []*flowpb.FlowFilter
+	Block []*flowpb.FlowFilter
+}
+
+var (
+	// filter flags，与 Hubble 一致，`--not` 对紧随其后的一个过滤参数取反
+	filterFlags = pflag.NewFlagSet("filters", pflag.ContinueOnError)
+	filterOpts  = &filterTracker{}
+)
+
+func init() {
+	filterFlags.Var(&filterValue{filterOpts, "namespace"}, "namespace", "Show all flows related to the given Kubernetes namespace")
+	filterFlags.Var(&filterValue{filterOpts, "label"}, "label", "Show only flows related to an endpoint with the given label (e.g. k8s:app=foo)")
+	filterFlags.Var(&filterValue{filterOpts, "pod"}, "pod", "Show all flows related to the given pod name or namespace/pod")
+	filterFlags.Var(&filterValue{filterOpts, "http-status"}, "http-status", "Show only flows which match this HTTP status code prefix (e.g. \"404\", \"5+\")")
+	filterFlags.Var(&filterValue{filterOpts, "verdict"}, "verdict", "Show only flows with this verdict (e.g. FORWARDED, DROPPED)")
+	filterFlags.Var(&notValue{filterOpts}, "not", "Reverses the next filter to be blacklist, e.g. --not --namespace kube-system")
+	filterFlags.Lookup("not").NoOptDefVal = "true"
+}
+
+// AddFilterFlags 为子命令注册过滤参数
+func AddFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().AddFlagSet(filterFlags)
+}
+
+// GetFlowFilters 合并配置文件与参数中的过滤规则，并编译为 FlowFilter
+func GetFlowFilters(vp *viper.Viper) (*FlowFilters, error) {
+	var cfg FilterConfig
+	if err := vp.UnmarshalKey("SEEFLOW_FILTERS", &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse SEEFLOW_FILTERS: %v", err)
+	}
+	if !filterOpts.allow.isEmpty() {
+		cfg.Allow = append(cfg.Allow, filterOpts.allow)
+	}
+	if !filterOpts.block.isEmpty() {
+		cfg.Block = append(cfg.Block, filterOpts.block)
+	}
+
+	allowList, err := ConstructAllowList(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	blockList, err := ConstructBlockList(cfg.Block)
+	if err != nil {
+		return nil, err
+	}
+	return &FlowFilters{Allow: allowList, Block: blockList}, nil
+}
+
+func (r FilterRule) isEmpty() bool {
+	return len(r.Namespace) == 0 && len(r.Label) == 0 && len(r.Pod) == 0 &&
+		len(r.HTTPStatus) == 0 && len(r.Verdict) == 0
+}
+
+// 参考 Hubble 的 HTTP status 过滤格式：完整状态码，或者带 "+" 的前缀
+var httpStatusPattern = regexp.MustCompile(`^([1-5][0-9][0-9]|[1-5][0-9]?\+)$`)
+
+// Compile 将规则编译为 FlowFilter。
+// 涉及端点的规则编译为两个 FlowFilter，分别匹配源与目的一侧，二者是“或”。
+func (r FilterRule) Compile() ([]*flowpb.FlowFilter, error) {
+	base := &flowpb.FlowFilter{}
+	for _, code := range r.HTTPStatus {
+		if !httpStatusPattern.MatchString(code) {
+			return nil, fmt.Errorf("invalid HTTP status code filter: %s", code)
+		}
+		base.HttpStatusCode = append(base.HttpStatusCode, code)
+	}
+	for _, v := range r.Verdict {
+		verdict, ok := flowpb.Verdict_value[strings.ToUpper(v)]
+		if !ok {
+			return nil, fmt.Errorf("invalid verdict filter: %s", v)
+		}
+		base.Verdict = append(base.Verdict, flowpb.Verdict(verdict))
+	}
+
+	pods, err := r.qualifiedPods()
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 && len(r.Label) == 0 {
+		return []*flowpb.FlowFilter{base}, nil
+	}
+
+	src := proto.Clone(base).(*flowpb.FlowFilter)
+	src.SourcePod = pods
+	src.SourceLabel = r.Label
+	dest := proto.Clone(base).(*flowpb.FlowFilter)
+	dest.DestinationPod = pods
+	dest.DestinationLabel = r.Label
+	return []*flowpb.FlowFilter{src, dest}, nil
+}
+
+// qualifiedPods 合并 namespace 与 pod：Hubble 中同一字段的多个值是“或”，
+// 所以同时指定二者时，pod 限定在每个 namespace 下，比如 demo 与 foo 合并为 demo/foo。
+// 已带 namespace 的 pod 必须属于其中一个 namespace，否则规则不会匹配任何流量
+func (r FilterRule) qualifiedPods() ([]string, error) {
+	namespaces := make([]string, 0, len(r.Namespace))
+	for _, ns := range r.Namespace {
+		namespaces = append(namespaces, strings.TrimSuffix(ns, "/"))
+	}
+	pods := make([]string, 0)
+	if len(r.Pod) == 0 {
+		for _, ns := range namespaces {
+			pods = append(pods, ns+"/")
+		}
+		return pods, nil
+	}
+	if len(namespaces) == 0 {
+		return r.Pod, nil
+	}
+	for _, pod := range r.Pod {
+		if ns, _, qualified := strings.Cut(pod, "/"); qualified {
+			if !slices.Contains(namespaces, ns) {
+				return nil, fmt.Errorf("pod filter %s is not in namespace filter %s", pod, strings.Join(namespaces, ","))
+			}
+			pods = append(pods, pod)
+			continue
+		}
+		for _, ns := range namespaces {
+			pods = append(pods, ns+"/"+pod)
+		}
+	}
+	return pods, nil
+}
+
+// filterTracker 记录参数中的过滤规则，`--not` 之后的一个参数进入 block
+type filterTracker struct {
+	allow  FilterRule
+	block  FilterRule
+	negate bool
+}
+
+func (t *filterTracker) set(field string, value string) {
+	rule := &t.allow
+	if t.negate {
+		rule = &t.block
+		t.negate = false
+	}
+	switch field {
+	case "namespace":
+		rule.Namespace = append(rule.Namespace, value)
+	case "label":
+		rule.Label = append(rule.Label, value)
+	case "pod":
+		rule.Pod = append(rule.Pod, value)
+	case "http-status":
+		rule.HTTPStatus = append(rule.HTTPStatus, value)
+	case "verdict":
+		rule.Verdict = append(rule.Verdict, value)
+	}
+}
+
+type filterValue struct {
+	t     *filterTracker
+	field string
+}
+
+func (v *filterValue) Set(s string) error {
+	v.t.set(v.field, s)
+	return nil
+}
+
+func (v *filterValue) String() string {
+	return ""
+}
+
+func (v *filterValue) Type() string {
+	return "filter"
+}
+
+type notValue struct {
+	t *filterTracker
+}
+
+func (v *notValue) Set(_ string) error {
+	v.t.negate = true
+	return nil
+}
+
+func (v *notValue) String() string {
+	return "false"
+}
+
+func (v *notValue) Type() string {
+	return "bool"
+}
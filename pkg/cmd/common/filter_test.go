@@ -0,0 +1,125 @@
+package common
+
+import (
+	"bytes"
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	monitorAPI "github.com/cilium/cilium/pkg/monitor/api"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	r "github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestFilterRule_Compile(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    FilterRule
+		want    []*flowpb.FlowFilter
+		wantErr bool
+	}{
+		{
+			name: "namespaces",
+			rule: FilterRule{Namespace: []string{"kube-system", "monitoring/"}},
+			want: []*flowpb.FlowFilter{
+				{SourcePod: []string{"kube-system/", "monitoring/"}},
+				{DestinationPod: []string{"kube-system/", "monitoring/"}},
+			},
+		},
+		{
+			// 不同字段之间是“与”：pod 限定在 namespace 下
+			name: "namespace and pod",
+			rule: FilterRule{Namespace: []string{"demo", "prod"}, Pod: []string{"foo", "demo/web"}},
+			want: []*flowpb.FlowFilter{
+				{SourcePod: []string{"demo/foo", "prod/foo", "demo/web"}},
+				{DestinationPod: []string{"demo/foo", "prod/foo", "demo/web"}},
+			},
+		},
+		{
+			name:    "pod outside namespace",
+			rule:    FilterRule{Namespace: []string{"kube-system"}, Pod: []string{"demo/web"}},
+			wantErr: true,
+		},
+		{
+			name: "http status and verdict",
+			rule: FilterRule{HTTPStatus: []string{"5+", "404"}, Verdict: []string{"dropped"}},
+			want: []*flowpb.FlowFilter{
+				{HttpStatusCode: []string{"5+", "404"}, Verdict: []flowpb.Verdict{flowpb.Verdict_DROPPED}},
+			},
+		},
+		{
+			name: "label with verdict",
+			rule: FilterRule{Label: []string{"k8s:app=web"}, Verdict: []string{"FORWARDED"}},
+			want: []*flowpb.FlowFilter{
+				{SourceLabel: []string{"k8s:app=web"}, Verdict: []flowpb.Verdict{flowpb.Verdict_FORWARDED}},
+				{DestinationLabel: []string{"k8s:app=web"}, Verdict: []flowpb.Verdict{flowpb.Verdict_FORWARDED}},
+			},
+		},
+		{
+			name:    "invalid http status",
+			rule:    FilterRule{HTTPStatus: []string{"600"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid verdict",
+			rule:    FilterRule{Verdict: []string{"ALLOWED"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rule.Compile()
+			if tt.wantErr {
+				r.Error(t, err)
+				return
+			}
+			r.NoError(t, err)
+			r.Len(t, got, len(tt.want))
+			for i := range tt.want {
+				r.True(t, proto.Equal(tt.want[i], got[i]), "got %v", got[i])
+			}
+		})
+	}
+}
+
+func TestConstructAllowList(t *testing.T) {
+	// 无规则时只按事件类型放行
+	allowList, err := ConstructAllowList(nil)
+	r.NoError(t, err)
+	r.Len(t, allowList, 3)
+
+	// 每条规则与三类事件组合
+	allowList, err = ConstructAllowList([]FilterRule{{Namespace: []string{"demo"}}})
+	r.NoError(t, err)
+	r.Len(t, allowList, 6)
+	r.Equal(t, []string{"demo/"}, allowList[0].SourcePod)
+	r.Equal(t, monitorAPI.MessageTypeAccessLog, int(allowList[0].EventType[0].Type))
+	r.Equal(t, []string{"demo/"}, allowList[1].DestinationPod)
+	r.Equal(t, monitorAPI.MessageTypeTraceSock, int(allowList[5].EventType[0].Type))
+}
+
+func TestGetFlowFilters(t *testing.T) {
+	defer func() { *filterOpts = filterTracker{} }()
+
+	vp := viper.New()
+	vp.SetConfigType("yaml")
+	r.NoError(t, vp.ReadConfig(bytes.NewBufferString(`
+seeflow_filters:
+  block:
+    - namespace: [monitoring]
+`)))
+
+	// 参数：放行 demo，屏蔽 kube-system
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.AddFlagSet(filterFlags)
+	r.NoError(t, flags.Parse([]string{"--namespace", "demo", "--not", "--namespace", "kube-system"}))
+
+	filters, err := GetFlowFilters(vp)
+	r.NoError(t, err)
+	r.Len(t, filters.Allow, 6)
+	r.Equal(t, []string{"demo/"}, filters.Allow[0].SourcePod)
+	// kube-dns + monitoring + kube-system
+	r.Len(t, filters.Block, 5)
+	r.Equal(t, []string{"monitoring/"}, filters.Block[1].SourcePod)
+	r.Equal(t, []string{"kube-system/"}, filters.Block[3].SourcePod)
+}
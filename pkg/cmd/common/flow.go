@@ -9,6 +9,7 @@ import (
 	hubdefaults "github.com/cilium/hubble/pkg/defaults"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"google.golang.org/protobuf/proto"
 )
 
 func GetHubbleClient(ctx context.Context, vp *viper.Viper) (observerpb.ObserverClient, func() error, error) {
@@ -27,36 +28,43 @@ func GetHubbleClient(ctx context.Context, vp *viper.Viper) (observerpb.ObserverC
 	return client, cleanup, nil
 }
 
-func ConstructAllowList() []*flowpb.FlowFilter {
+// ConstructAllowList 默认放行 L7、L34 Trace 和 Sock 三类事件。
+// 配置了 allow 规则时，每条规则分别与三类事件组合，满足任意一个即放行。
+func ConstructAllowList(rules []FilterRule) ([]*flowpb.FlowFilter, error) {
 	// allow all L7 flows, 参考 @github.com/cilium/hubble@v0.12.3/cmd/observe/flows_filter_test.go:73
-	allowList := make([]*flowpb.FlowFilter, 0)
-	allowL7 := &flowpb.FlowFilter{
-		EventType: []*flowpb.EventTypeFilter{
-			{Type: monitorAPI.MessageTypeAccessLog},
-		},
+	eventTypes := []int32{
+		monitorAPI.MessageTypeAccessLog,
+		// allow partial L34 flows
+		monitorAPI.MessageTypeTrace,
+		// allow all Sock flows
+		monitorAPI.MessageTypeTraceSock,
 	}
-	allowList = append(allowList, allowL7)
 
-	// allow partial L34 flows
-	allowL34 := &flowpb.FlowFilter{
-		EventType: []*flowpb.EventTypeFilter{
-			{Type: monitorAPI.MessageTypeTrace},
-		},
+	userFilters := make([]*flowpb.FlowFilter, 0)
+	for _, rule := range rules {
+		filters, err := rule.Compile()
+		if err != nil {
+			return nil, err
+		}
+		userFilters = append(userFilters, filters...)
 	}
-	allowList = append(allowList, allowL34)
-
-	// allow all Sock flows
-	allowSock := &flowpb.FlowFilter{
-		EventType: []*flowpb.EventTypeFilter{
-			{Type: monitorAPI.MessageTypeTraceSock},
-		},
+	if len(userFilters) == 0 {
+		userFilters = append(userFilters, &flowpb.FlowFilter{})
 	}
-	allowList = append(allowList, allowSock)
 
-	return allowList
+	allowList := make([]*flowpb.FlowFilter, 0, len(eventTypes)*len(userFilters))
+	for _, eventType := range eventTypes {
+		for _, f := range userFilters {
+			allow := proto.Clone(f).(*flowpb.FlowFilter)
+			allow.EventType = []*flowpb.EventTypeFilter{{Type: eventType}}
+			allowList = append(allowList, allow)
+		}
+	}
+	return allowList, nil
 }
 
-func ConstructBlockList() []*flowpb.FlowFilter {
+// ConstructBlockList 默认屏蔽 kube-dns 流量，并追加配置的 block 规则
+func ConstructBlockList(rules []FilterRule) ([]*flowpb.FlowFilter, error) {
 	// block DNS flows, because DNS is not related with payload
 	blockList := make([]*flowpb.FlowFilter, 0)
 	// 过滤器是基于 "k8s:k8s-app=kube-dns" label，参考 @github.com/cilium/hubble@v0.12.3/cmd/observe/flows_filter_test.go:260
@@ -65,5 +73,13 @@ func ConstructBlockList() []*flowpb.FlowFilter {
 		DestinationLabel: []string{"k8s:k8s-app=kube-dns"},
 	}
 	blockList = append(blockList, blockDNS)
-	return blockList
+
+	for _, rule := range rules {
+		filters, err := rule.Compile()
+		if err != nil {
+			return nil, err
+		}
+		blockList = append(blockList, filters...)
+	}
+	return blockList, nil
 }
@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stleox/seeflow/pkg/cmd/common"
+	"github.com/stleox/seeflow/pkg/config"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+)
+
+var (
+	// migrate flags，绑定到同名的 viper 键，比如 SEEFLOW_REPLICATION_NUM
+	migrateFlags = pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+)
+
+func init() {
+	migrateFlags.Int("replication-num", config.ReplicationNum, "Number of replicas of tables created in Doris")
+}
+
+func New(vp *viper.Viper) *cobra.Command {
+	migrate := &cobra.Command{
+		Use:   "migrate",
+		Short: "Manage the schema of the t_* tables in SEEFLOW_OLAP_DSN",
+	}
+	migrate.PersistentFlags().AddFlagSet(migrateFlags)
+	common.BindFlags(vp, migrateFlags)
+	migrate.AddCommand(newStatus(vp), newUp(vp))
+	return migrate
+}
+
+func newStatus(vp *viper.Viper) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Print the current schema version and pending migrations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := pkgtracer.NewMigrator(vp)
+			if err != nil {
+				return err
+			}
+			status, err := m.Status()
+			if err != nil {
+				return err
+			}
+
+			w := cmd.OutOrStdout()
+			_, _ = fmt.Fprintf(w, "current version: %d\n", status.Current)
+			_, _ = fmt.Fprintf(w, "latest version:  %d\n", status.Latest)
+			if status.Current > status.Latest {
+				_, _ = fmt.Fprintln(w, "schema is newer than this SeeFlow, upgrade SeeFlow first")
+				return nil
+			}
+			if len(status.Pending) == 0 {
+				_, _ = fmt.Fprintln(w, "schema is up to date")
+				return nil
+			}
+			_, _ = fmt.Fprintln(w, "pending migrations:")
+			for _, migration := range status.Pending {
+				_, _ = fmt.Fprintf(w, "  %d: %s\n", migration.Version, migration.Description)
+			}
+			return nil
+		},
+	}
+}
+
+func newUp(vp *viper.Viper) *cobra.Command {
+	var dryRun bool
+	up := &cobra.Command{
+		Use:   "up",
+		Short: "Apply pending migrations in order",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			m, err := pkgtracer.NewMigrator(vp)
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			n, err := m.Up(w, dryRun)
+			if err != nil {
+				return err
+			}
+			if !dryRun {
+				_, _ = fmt.Fprintf(w, "applied %d migrations\n", n)
+			}
+			return nil
+		},
+	}
+	up.Flags().BoolVar(&dryRun, "dry-run", false, "Print the statements of pending migrations without applying them")
+	return up
+}
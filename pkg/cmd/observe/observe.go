@@ -93,7 +93,7 @@ func init() {
 }
 
 // 在 observe 下，保留 selectorFlags 便于单次调试
-func getFlowsRequest() (*observerpb.GetFlowsRequest, error) {
+func getFlowsRequest(filters *common.FlowFilters) (*observerpb.GetFlowsRequest, error) {
 	first := selectorOpts.first > 0
 	last := selectorOpts.last > 0
 	if first && last {
@@ -156,8 +156,8 @@ func getFlowsRequest() (*observerpb.GetFlowsRequest, error) {
 	req := &observerpb.GetFlowsRequest{
 		Number:    number,
 		Follow:    selectorOpts.follow,
-		Whitelist: common.ConstructAllowList(),
-		Blacklist: common.ConstructBlockList(),
+		Whitelist: filters.Allow,
+		Blacklist: filters.Block,
 		Since:     since,
 		Until:     until,
 		First:     first,
@@ -174,8 +174,7 @@ func handleFlows(ctx context.Context, hubble observerpb.ObserverClient, req *obs
 
 	// mark: defer-point of observe cmd
 	defer func() {
-		tm.Flush()
-		tm.AssembleAll()
+		tm.Drain()
 		tm.Summary()
 	}()
 
@@ -213,12 +212,15 @@ func New(vp *viper.Viper) *cobra.Command {
 			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 			defer cancel()
 
-			// init tracerManager
+			// init tracerManager，schema 落后或超前时拒绝运行
+			if err := pkgtracer.CheckSchema(vp); err != nil {
+				return err
+			}
 			tracerManager := pkgtracer.NewTracerManager(vp)
-			shutdown, _ := tracerManager.InitDummyExporter()
-			//shutdown, _ := tracerManager.InitGRPCExporter(tracerManager.ShutdownCtx)
-			//shutdown, _ := tracerManager.InitStdoutExporter()
-
+			shutdown, err := tracerManager.InitExporter(common.GetExporterOptions(vp))
+			if err != nil {
+				return err
+			}
 			defer func() {
 				if err := shutdown(tracerManager.ShutdownCtx); err != nil {
 					logrus.Error(err)
@@ -237,7 +239,11 @@ func New(vp *viper.Viper) *cobra.Command {
 			}()
 
 			// construct request
-			req, err := getFlowsRequest()
+			filters, err := common.GetFlowFilters(vp)
+			if err != nil {
+				return err
+			}
+			req, err := getFlowsRequest(filters)
 			if err != nil {
 				return err
 			}
@@ -257,5 +263,7 @@ func New(vp *viper.Viper) *cobra.Command {
 		},
 	}
 	observe.Flags().AddFlagSet(selectorFlags)
+	common.AddFilterFlags(observe)
+	common.AddExporterFlags(observe, vp)
 	return observe
 }
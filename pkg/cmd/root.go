@@ -7,6 +7,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/stleox/seeflow/pkg/cmd/migrate"
 	"github.com/stleox/seeflow/pkg/cmd/observe"
 	"github.com/stleox/seeflow/pkg/cmd/serve"
 	"github.com/stleox/seeflow/pkg/config"
@@ -77,6 +78,7 @@ func Execute() {
 	root := New(vp)
 	root.AddCommand(observe.New(vp))
 	root.AddCommand(serve.New(vp))
+	root.AddCommand(migrate.New(vp))
 
 	err := root.Execute()
 	if err != nil {
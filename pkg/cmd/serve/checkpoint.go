@@ -0,0 +1,148 @@
+package serve
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 从检查点恢复 cursor，没有检查点则从当前开始
+func loadCursor(store pkgtracer.Store) *flowCursor {
+	cursor := newFlowCursor()
+	if store == nil {
+		return cursor
+	}
+	ckpts, err := store.SelectCheckpoints()
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't load checkpoints, starting from now")
+		return cursor
+	}
+	cursor.Restore(ckpts)
+	if since := cursor.Since(); since != nil {
+		logrus.WithField("since", since.AsTime()).Infof("SeeFlow resumed from checkpoints of %d nodes", len(ckpts))
+	}
+	return cursor
+}
+
+// runCheckpoint 周期性地保存检查点，直到 ctx 结束；最后一次由 gracefulShutdown 在排空之后保存
+func runCheckpoint(ctx context.Context, tm *pkgtracer.TracerManager, cursor *flowCursor, interval time.Duration) {
+	store := tm.Store()
+	if store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveCheckpoint(tm, store, cursor)
+		}
+	}
+}
+
+// 先取快照，记录其中尚未提交的 flow，再刷入数据库，保证检查点之前的其它 flow 都已提交。
+// follower 先消费再推进 cursor，所以快照中的 flow 此时都已登记在 TracerManager 中
+func saveCheckpoint(tm *pkgtracer.TracerManager, store pkgtracer.Store, cursor *flowCursor) {
+	snap := cursor.Snapshot()
+	snap.Replay(tm.Uncommitted())
+	tm.Flush()
+	if err := store.SaveCheckpoints(snap.Checkpoints()); err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't save checkpoints")
+	}
+}
+
+// Checkpoints 将 cursor 转换为检查点
+func (c *flowCursor) Checkpoints() []*pkgtracer.Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ckpts := make([]*pkgtracer.Checkpoint, 0, len(c.nodes))
+	for node, n := range c.nodes {
+		ckpts = append(ckpts, &pkgtracer.Checkpoint{
+			NodeName: node,
+			TimeNs:   unixNanoOrZero(n.time),
+			Uuids:    joinSet(n.uuids),
+			ReplayNs: unixNanoOrZero(n.replayFrom),
+			Replay:   joinSet(n.replay),
+		})
+	}
+	sort.Slice(ckpts, func(i, j int) bool { return ckpts[i].NodeName < ckpts[j].NodeName })
+	return ckpts
+}
+
+// Replay 记录各节点上尚未提交的 flow，替换此前的记录：重启后从其中最早的开始接收，只重新消费这些 flow
+func (c *flowCursor) Replay(uncommitted map[string]*pkgtracer.UncommittedFlows) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, n := range c.nodes {
+		n.replay, n.replayFrom = nil, time.Time{}
+	}
+	for node, u := range uncommitted {
+		n, hit := c.nodes[node]
+		if !hit {
+			// 快照之后才接收的节点
+			n = &nodeCursor{uuids: make(map[string]struct{}, 0)}
+			c.nodes[node] = n
+		}
+		n.replay, n.replayFrom = copySet(u.Uuids), u.Oldest.UTC()
+	}
+}
+
+// Restore 从检查点恢复 cursor
+func (c *flowCursor) Restore(ckpts []*pkgtracer.Checkpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ckpt := range ckpts {
+		n := &nodeCursor{
+			time:  timeOrZero(ckpt.TimeNs),
+			uuids: splitSet(ckpt.Uuids),
+		}
+		if replay := splitSet(ckpt.Replay); len(replay) != 0 {
+			n.replay, n.replayFrom = replay, timeOrZero(ckpt.ReplayNs)
+		}
+		c.nodes[ckpt.NodeName] = n
+	}
+}
+
+// 检查点中以 0 表示没有时间
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func timeOrZero(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// 逗号分隔，排序后输出
+func joinSet(set map[string]struct{}) string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func splitSet(s string) map[string]struct{} {
+	set := make(map[string]struct{}, 0)
+	for _, k := range strings.Split(s, ",") {
+		if k != "" {
+			set[k] = struct{}{}
+		}
+	}
+	return set
+}
@@ -0,0 +1,140 @@
+package serve
+
+import (
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/stleox/seeflow/pkg/config"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+	r "github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+	"time"
+)
+
+func TestFlowCursor_Checkpoints(t *testing.T) {
+	c := newFlowCursor()
+	c.Advance(mockFlow("a", "node1", 1))
+	c.Advance(mockFlow("c", "node1", 2))
+	c.Advance(mockFlow("b", "node1", 2))
+	c.Advance(mockFlow("d", "node2", 3))
+
+	ckpts := c.Checkpoints()
+	r.Len(t, ckpts, 2)
+	r.Equal(t, "node1", ckpts[0].NodeName)
+	r.Equal(t, time.Unix(2, 0).UnixNano(), ckpts[0].TimeNs)
+	r.Equal(t, "b,c", ckpts[0].Uuids)
+
+	// 重启后恢复：检查点之前的 flow 被跳过，之后的正常消费
+	restored := newFlowCursor()
+	restored.Restore(ckpts)
+	r.Equal(t, c.Since().AsTime(), restored.Since().AsTime())
+	r.True(t, restored.Covers(mockFlow("a", "node1", 1)))
+	r.True(t, restored.Covers(mockFlow("b", "node1", 2)))
+	r.False(t, restored.Covers(mockFlow("e", "node1", 2)))
+	r.True(t, restored.Covers(mockFlow("d", "node2", 3)))
+	r.False(t, restored.Covers(mockFlow("f", "node2", 4)))
+}
+
+func TestSaveCheckpoint_Uncommitted(t *testing.T) {
+	// 没有 worker 消费 L34、Sock 流量，它们一直排队
+	defer func(n int) { config.ConsumeWorkers = n }(config.ConsumeWorkers)
+	config.ConsumeWorkers = 0
+	tm := pkgtracer.NewTracerManager(nil)
+	store := tm.Store()
+
+	cursor := newFlowCursor()
+	consume := func(flow *observerpb.Flow) *observerpb.Flow {
+		tm.ConsumeFlow(flow)
+		cursor.Advance(flow)
+		return flow
+	}
+	// node1 上的请求等待响应；node2 上的请求、响应已配对写入，之后的 sock 流量还在排队
+	pending := consume(mockL7Flow("a", "node1", 1, "xreq-1", false))
+	later := consume(mockL7Flow("b", "node1", 5, "xreq-3", false))
+	consume(mockL7Flow("c", "node1", 6, "xreq-3", true))
+	committed := consume(mockL7Flow("d", "node2", 2, "xreq-2", false))
+	consume(mockL7Flow("e", "node2", 3, "xreq-2", true))
+	queued := mockFlow("f", "node2", 4)
+	queued.Type = observerpb.FlowType_SOCK
+	queued.Source, queued.Destination = &flowpb.Endpoint{}, &flowpb.Endpoint{}
+	consume(queued)
+
+	// 等待 L7 流量消费完成，然后保存检查点
+	tm.StopConsume()
+	saveCheckpoint(tm, store, cursor)
+
+	// 进程被杀死，没有排空；重启后从检查点恢复，尚未提交的流量都会重放，其间已写入的不会
+	restored := loadCursor(store)
+	r.False(t, restored.Covers(pending))
+	r.True(t, restored.Covers(later))
+	r.False(t, restored.Covers(queued))
+	r.True(t, restored.Covers(committed))
+	r.Equal(t, time.Unix(1, 0).UTC(), restored.Since().AsTime())
+
+	// 重放后不再重复消费
+	restored.Advance(pending)
+	r.True(t, restored.Covers(pending))
+}
+
+func TestSaveCheckpoint_Restart(t *testing.T) {
+	tm := pkgtracer.NewTracerManager(nil)
+	store := tm.Store()
+	cursor := newFlowCursor()
+
+	// xreq-1 等待响应，之后的 xreq-2 已配对写入
+	stream := []*observerpb.Flow{
+		mockL7Flow("a", "node1", 1, "xreq-1", false),
+		mockL7Flow("b", "node1", 2, "xreq-2", false),
+		mockL7Flow("c", "node1", 3, "xreq-2", true),
+	}
+	for _, flow := range stream {
+		tm.ConsumeFlow(flow)
+		cursor.Advance(flow)
+	}
+	tm.StopConsume()
+	saveCheckpoint(tm, store, cursor)
+
+	// 进程被杀死后重启，Hubble 从最早的尚未提交的流量开始重新发送，之后 xreq-1 的响应到达
+	restarted := pkgtracer.NewTracerManager(nil)
+	restored := loadCursor(store)
+	r.Equal(t, time.Unix(1, 0).UTC(), restored.Since().AsTime())
+	stream = append(stream, mockL7Flow("d", "node1", 4, "xreq-1", true))
+	for _, flow := range stream {
+		if restored.Covers(flow) {
+			continue
+		}
+		restarted.ConsumeFlow(flow)
+		restored.Advance(flow)
+	}
+	restarted.StopConsume()
+
+	// 两次运行合计写入 xreq-1、xreq-2 各一条 span，没有重复
+	count := func(s pkgtracer.Store) int {
+		n, err := s.CountL7Spans("0af7651916cd43dd8448eb211c80319c")
+		r.NoError(t, err)
+		return n
+	}
+	r.Equal(t, 1, count(store))
+	r.Equal(t, 1, count(restarted.Store()))
+}
+
+// 携带 x-request-id 与 traceparent 的 HTTP 流量
+func mockL7Flow(uuid string, node string, sec int64, xreqID string, isReply bool) *observerpb.Flow {
+	flow := mockFlow(uuid, node, sec)
+	flow.Type = observerpb.FlowType_L7
+	flow.Source = &flowpb.Endpoint{Namespace: "demo", PodName: "foo-0"}
+	flow.Destination = &flowpb.Endpoint{Namespace: "demo", PodName: "bar-0"}
+	l7Type := flowpb.L7FlowType_REQUEST
+	if isReply {
+		l7Type = flowpb.L7FlowType_RESPONSE
+	}
+	flow.L7 = &flowpb.Layer7{
+		Type: l7Type,
+		Record: &flowpb.Layer7_Http{Http: &flowpb.HTTP{Headers: []*flowpb.HTTPHeader{
+			{Key: "X-Request-Id", Value: xreqID},
+			{Key: "traceparent", Value: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		}}},
+	}
+	flow.IsReply = &wrapperspb.BoolValue{Value: isReply}
+	return flow
+}
@@ -0,0 +1,247 @@
+package serve
+
+import (
+	"context"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stleox/seeflow/pkg/cmd/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"sync"
+	"time"
+)
+
+// follower 以 Follow 模式持续消费 Hubble 流量。
+// 流中断后按指数退避重连，并从 cursor 记录的位置恢复，保证不丢失也不重复。
+type follower struct {
+	hubble  observerpb.ObserverClient
+	consume func(flow *observerpb.Flow)
+	filters *common.FlowFilters
+	cursor  *flowCursor
+	backoff *backoff
+}
+
+func newFollower(hubble observerpb.ObserverClient, consume func(flow *observerpb.Flow), filters *common.FlowFilters, cursor *flowCursor, bo *backoff) *follower {
+	return &follower{
+		hubble:  hubble,
+		consume: consume,
+		filters: filters,
+		cursor:  cursor,
+		backoff: bo,
+	}
+}
+
+// Run 阻塞直到 ctx 结束，或者遇到不可重试的错误
+func (f *follower) Run(ctx context.Context) error {
+	for {
+		// 重连时从每个节点最后处理的 flow 恢复
+		resume := f.cursor.Snapshot()
+		req := getFlowsRequest(resume.Since(), f.filters)
+		logrus.WithField("request", req).Debug("SeeFlow sent GetFlows request")
+
+		err := f.handleFlows(ctx, req, resume)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			// Follow 模式下服务端不应主动结束流
+			err = io.ErrUnexpectedEOF
+		}
+		if !isRetryable(err) {
+			return err
+		}
+
+		wait := f.backoff.Next()
+		logrus.WithError(err).Warnf("SeeFlow lost Hubble stream, reconnecting in %s", wait)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 在 serve 下，跳过 resume 之前已处理过的 flow
+func (f *follower) handleFlows(ctx context.Context, req *observerpb.GetFlowsRequest, resume *flowCursor) error {
+	c, err := f.hubble.GetFlows(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := c.Recv()
+
+		switch err {
+		case io.EOF, context.Canceled:
+			return nil
+		case nil:
+		default:
+			if status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		}
+
+		switch resp.GetResponseTypes().(type) {
+		case *observerpb.GetFlowsResponse_Flow:
+			flow := resp.GetFlow()
+			if resume.Covers(flow) {
+				continue
+			}
+			// 先消费再推进 cursor：检查点取快照时，快照中的 flow 都已登记为尚未提交
+			f.consume(flow)
+			f.cursor.Advance(flow)
+			f.backoff.Reset()
+		case *observerpb.GetFlowsResponse_NodeStatus:
+			logrus.Infof("SeeFlow got Hubble status: %s", resp.GetNodeStatus().Message)
+		default:
+		}
+	}
+}
+
+// 参数错误等不会因为重连而恢复
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unimplemented, codes.PermissionDenied, codes.Unauthenticated:
+		return false
+	default:
+		return true
+	}
+}
+
+// flowCursor 记录每个 Hubble 节点上最后处理的 flow 时间。
+// Relay 会合并多个节点的流，各节点之间时间不同步，所以按节点记录。
+// 被 follower 写、被检查点任务读，所以加锁。
+type flowCursor struct {
+	nodes map[string]*nodeCursor
+	mu    sync.Mutex
+}
+
+type nodeCursor struct {
+	time time.Time
+	// 与 time 同一时刻的 flow，用于去重
+	uuids map[string]struct{}
+	// 从检查点恢复时，此前尚未提交、需要重新消费的 flow，及其中最早的时间
+	replay     map[string]struct{}
+	replayFrom time.Time
+}
+
+// 重连时需要从这里开始接收
+func (n *nodeCursor) start() time.Time {
+	if len(n.replay) != 0 && (n.time.IsZero() || n.replayFrom.Before(n.time)) {
+		return n.replayFrom
+	}
+	return n.time
+}
+
+func newFlowCursor() *flowCursor {
+	return &flowCursor{nodes: make(map[string]*nodeCursor, 0)}
+}
+
+// Advance 记录已处理的 flow
+func (c *flowCursor) Advance(flow *observerpb.Flow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := flow.GetTime().AsTime()
+	n, hit := c.nodes[flow.GetNodeName()]
+	if !hit {
+		n = &nodeCursor{}
+		c.nodes[flow.GetNodeName()] = n
+	}
+	if _, hit := n.replay[flow.GetUuid()]; hit {
+		delete(n.replay, flow.GetUuid())
+		if len(n.replay) == 0 {
+			n.replay, n.replayFrom = nil, time.Time{}
+		}
+	}
+	switch {
+	case t.After(n.time):
+		n.time = t
+		n.uuids = map[string]struct{}{flow.GetUuid(): {}}
+	case t.Equal(n.time):
+		n.uuids[flow.GetUuid()] = struct{}{}
+	}
+}
+
+// Covers 判断 flow 是否已被处理过，需要重放的不算
+func (c *flowCursor) Covers(flow *observerpb.Flow) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, hit := c.nodes[flow.GetNodeName()]
+	if !hit {
+		return false
+	}
+	if _, replay := n.replay[flow.GetUuid()]; replay {
+		return false
+	}
+	t := flow.GetTime().AsTime()
+	if t.Before(n.time) {
+		return true
+	}
+	if t.Equal(n.time) {
+		_, seen := n.uuids[flow.GetUuid()]
+		return seen
+	}
+	return false
+}
+
+// Since 返回各节点中最早的位置，作为 GetFlowsRequest.Since；没有记录则为 nil。
+func (c *flowCursor) Since() *timestamppb.Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var since time.Time
+	for _, n := range c.nodes {
+		if start := n.start(); !start.IsZero() && (since.IsZero() || start.Before(since)) {
+			since = start
+		}
+	}
+	if since.IsZero() {
+		return nil
+	}
+	return timestamppb.New(since)
+}
+
+// Snapshot 深拷贝，用于重连后的去重
+func (c *flowCursor) Snapshot() *flowCursor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snap := newFlowCursor()
+	for node, n := range c.nodes {
+		snap.nodes[node] = &nodeCursor{time: n.time, uuids: copySet(n.uuids), replay: copySet(n.replay), replayFrom: n.replayFrom}
+	}
+	return snap
+}
+
+func copySet(set map[string]struct{}) map[string]struct{} {
+	copied := make(map[string]struct{}, len(set))
+	for k := range set {
+		copied[k] = struct{}{}
+	}
+	return copied
+}
+
+// backoff 指数退避：min, 2*min, 4*min, ... 直到 max
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func (b *backoff) Next() time.Duration {
+	wait := b.min << b.attempt
+	if wait > b.max || wait <= 0 {
+		return b.max
+	}
+	b.attempt++
+	return wait
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
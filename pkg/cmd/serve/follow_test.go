@@ -0,0 +1,132 @@
+package serve
+
+import (
+	"context"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/stleox/seeflow/pkg/cmd/common"
+	r "github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+func TestFlowCursor(t *testing.T) {
+	c := newFlowCursor()
+	r.Nil(t, c.Since())
+
+	c.Advance(mockFlow("a", "node1", 1))
+	c.Advance(mockFlow("b", "node1", 2))
+	c.Advance(mockFlow("c", "node1", 2))
+	c.Advance(mockFlow("d", "node2", 3))
+
+	// 各节点中最早的位置
+	r.Equal(t, time.Unix(2, 0).UTC(), c.Since().AsTime())
+
+	snap := c.Snapshot()
+	r.True(t, snap.Covers(mockFlow("a", "node1", 1)))
+	r.True(t, snap.Covers(mockFlow("c", "node1", 2)))
+	r.False(t, snap.Covers(mockFlow("e", "node1", 2)))
+	r.False(t, snap.Covers(mockFlow("f", "node1", 3)))
+	r.True(t, snap.Covers(mockFlow("x", "node2", 2)))
+	r.False(t, snap.Covers(mockFlow("y", "node3", 0)))
+
+	// 快照不随原 cursor 变化
+	c.Advance(mockFlow("f", "node1", 3))
+	r.False(t, snap.Covers(mockFlow("f", "node1", 3)))
+}
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 5 * time.Second}
+	r.Equal(t, time.Second, b.Next())
+	r.Equal(t, 2*time.Second, b.Next())
+	r.Equal(t, 4*time.Second, b.Next())
+	r.Equal(t, 5*time.Second, b.Next())
+	r.Equal(t, 5*time.Second, b.Next())
+	b.Reset()
+	r.Equal(t, time.Second, b.Next())
+}
+
+func TestFollower_Run(t *testing.T) {
+	// 第一次连接收到 a、b 后中断；重连后 Hubble 从 b 的时间重放 b，然后是 c
+	hubble := &mockObserverClient{sessions: [][]*observerpb.Flow{
+		{mockFlow("a", "node1", 1), mockFlow("b", "node1", 2)},
+		{mockFlow("b", "node1", 2), mockFlow("c", "node1", 3)},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	consumed := make([]string, 0)
+	f := newFollower(hubble, func(flow *observerpb.Flow) {
+		consumed = append(consumed, flow.Uuid)
+		if len(consumed) == 3 {
+			cancel()
+		}
+	}, &common.FlowFilters{}, newFlowCursor(), &backoff{min: time.Millisecond, max: time.Millisecond})
+
+	r.NoError(t, f.Run(ctx))
+	r.Equal(t, []string{"a", "b", "c"}, consumed)
+	r.Len(t, hubble.requests, 2)
+	r.True(t, hubble.requests[0].Follow)
+	r.Nil(t, hubble.requests[0].Since)
+	r.Equal(t, time.Unix(2, 0).UTC(), hubble.requests[1].Since.AsTime())
+}
+
+func TestFollower_Run_NotRetryable(t *testing.T) {
+	hubble := &mockObserverClient{err: status.Error(codes.InvalidArgument, "bad filter")}
+	f := newFollower(hubble, func(*observerpb.Flow) {}, &common.FlowFilters{}, newFlowCursor(), &backoff{min: time.Millisecond, max: time.Millisecond})
+	r.Error(t, f.Run(context.Background()))
+}
+
+//mockers
+
+func mockFlow(uuid string, node string, sec int64) *observerpb.Flow {
+	return &observerpb.Flow{
+		Uuid:     uuid,
+		NodeName: node,
+		Time:     &timestamppb.Timestamp{Seconds: sec},
+	}
+}
+
+// mockObserverClient 每次 GetFlows 依次返回 sessions 中的一组 flow，然后以 Unavailable 中断
+type mockObserverClient struct {
+	observerpb.ObserverClient
+	sessions [][]*observerpb.Flow
+	requests []*observerpb.GetFlowsRequest
+	err      error
+}
+
+func (m *mockObserverClient) GetFlows(ctx context.Context, in *observerpb.GetFlowsRequest, _ ...grpc.CallOption) (observerpb.Observer_GetFlowsClient, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.requests = append(m.requests, in)
+	flows := make([]*observerpb.Flow, 0)
+	if len(m.requests) <= len(m.sessions) {
+		flows = m.sessions[len(m.requests)-1]
+	}
+	return &mockGetFlowsClient{ctx: ctx, flows: flows}, nil
+}
+
+type mockGetFlowsClient struct {
+	grpc.ClientStream
+	ctx   context.Context
+	flows []*observerpb.Flow
+}
+
+func (m *mockGetFlowsClient) Recv() (*observerpb.GetFlowsResponse, error) {
+	if m.ctx.Err() != nil {
+		return nil, status.Error(codes.Canceled, m.ctx.Err().Error())
+	}
+	if len(m.flows) == 0 {
+		return nil, status.Error(codes.Unavailable, "connection reset")
+	}
+	flow := m.flows[0]
+	m.flows = m.flows[1:]
+	return &observerpb.GetFlowsResponse{
+		ResponseTypes: &observerpb.GetFlowsResponse_Flow{Flow: flow},
+	}, nil
+}
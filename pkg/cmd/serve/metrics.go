@@ -0,0 +1,42 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+	"net/http"
+	"time"
+)
+
+// newMetricsHandler 注册流水线与进程的指标，返回 /metrics 的 handler
+func newMetricsHandler(tm *pkgtracer.TracerManager) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if err := tm.RegisterMetrics(reg); err != nil {
+		return nil, err
+	}
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), nil
+}
+
+// runMetricsServer 在 addr 上暴露 /metrics，ctx 结束时关闭
+func runMetricsServer(ctx context.Context, addr string, handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logrus.Infof("SeeFlow serves metrics on %s/metrics", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).Error("SeeFlow couldn't serve metrics")
+	}
+}
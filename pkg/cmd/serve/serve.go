@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	observerpb "github.com/cilium/cilium/api/v1/observer"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	pkgbgtask "github.com/stleox/seeflow/pkg/bgtask"
 	"github.com/stleox/seeflow/pkg/cmd/common"
@@ -14,67 +14,80 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	"io"
 	"os"
 	"os/signal"
-	"time"
+	"syscall"
 )
 
-// 在 observe 下，直接构造请求
-func getFlowsRequest() *observerpb.GetFlowsRequest {
-	now := time.Now()
-	since := timestamppb.New(now.Add(-common2.GetFlowsInterval))
-	until := timestamppb.New(now)
+var (
+	// serve flags，绑定到同名的 viper 键，比如 SEEFLOW_ASSEMBLE_INTERVAL
+	serveFlags = pflag.NewFlagSet("serve", pflag.ContinueOnError)
+)
+
+func init() {
+	serveFlags.Duration("assemble-interval", common2.AssembleInterval, "Interval between two rounds of trace assembling")
+	serveFlags.Duration("assemble-quiescence", common2.AssembleQuiescence, "A trace is considered complete after no span arrives for this long")
+	serveFlags.String("assemble-strategy", "basic", "Strategy to find the parent of a span: basic (by the caller's identity) or causal (by the caller's pod and time window)")
+	serveFlags.Duration("clock-skew", common2.ClockSkew, "Clock skew between Hubble nodes tolerated by the causal assemble strategy")
+	serveFlags.Bool("online-assemble", common2.OnlineAssemble, "Assemble spans in memory as they complete, instead of pulling them from OLAP periodically")
+	serveFlags.Duration("request-timeout", common2.RequestTimeout, "A request without response for this long is considered dropped by the network")
+	serveFlags.Int("max-pending-flows", common2.MaxNumFlow, "Maximum number of unmatched flows kept per namespace")
+	serveFlags.Duration("sweep-interval", common2.SweepInterval, "Interval between two sweeps of timed-out unmatched flows")
+	serveFlags.Int("consume-workers", common2.ConsumeWorkers, "Number of workers consuming each type of flow (L3/L4, sock, L7)")
+	serveFlags.Int("consume-queue-size", common2.ConsumeQueueSize, "Maximum number of flows queued per type; receiving blocks when the queue is full")
+	serveFlags.Duration("enqueue-timeout", common2.EnqueueTimeout, "Drop a flow after its queue stays full for this long, 0 to block receiving until the queue has room")
+	serveFlags.String("metrics-addr", common2.MetricsAddr, "Address to expose Prometheus metrics on, empty to disable")
+	serveFlags.Duration("shutdown-timeout", common2.ShutdownTimeout, "Maximum time to drain, flush, assemble and export on shutdown")
+	serveFlags.Duration("l34-retention", common2.RetentionL34, "Drop daily partitions of t_L34 older than this, 0 to keep forever")
+	serveFlags.Duration("sock-retention", common2.RetentionSock, "Drop daily partitions of t_Sock older than this, 0 to keep forever")
+	serveFlags.Duration("l7-retention", common2.RetentionL7, "Drop daily partitions of t_L7 older than this, 0 to keep forever")
+	serveFlags.Duration("span-assign-retention", common2.RetentionSpanAssign, "Drop daily partitions of t_SpanAssign older than this, 0 to keep forever; should be no shorter than --l7-retention")
+	serveFlags.Duration("checkpoint-interval", common2.CheckpointInterval, "Interval between two checkpoints of the last committed flow per Hubble node")
+}
+
+// 在 serve 下，以 Follow 模式构造请求，since 为空则从当前开始
+func getFlowsRequest(since *timestamppb.Timestamp, filters *common.FlowFilters) *observerpb.GetFlowsRequest {
 	req := &observerpb.GetFlowsRequest{
-		Blacklist: common.ConstructBlockList(),
-		Whitelist: common.ConstructAllowList(),
+		Follow:    true,
+		Blacklist: filters.Block,
+		Whitelist: filters.Allow,
 		Since:     since,
-		Until:     until,
 	}
 	return req
 }
 
-// 在 observe 下，分发处理
-func handleFlows(ctx context.Context, hubble observerpb.ObserverClient, req *observerpb.GetFlowsRequest, tm *pkgtracer.TracerManager) error {
-	c, err := hubble.GetFlows(ctx, req)
-	if err != nil {
-		return err
-	}
-
-	for {
-		resp, err := c.Recv()
-
-		switch err {
-		case io.EOF, context.Canceled:
-			return nil
-		case nil:
-		default:
-			if status.Code(err) == codes.Canceled {
-				return nil
-			}
-			return err
-		}
-
-		switch resp.GetResponseTypes().(type) {
-		case *observerpb.GetFlowsResponse_Flow:
-			tm.ConsumeFlow(resp.GetFlow())
-		case *observerpb.GetFlowsResponse_NodeStatus:
-			logrus.Infof("SeeFlow got Hubble status: %s", resp.GetNodeStatus().Message)
-		default:
-			return nil
-		}
-	}
-}
-
 func New(vp *viper.Viper) *cobra.Command {
 	serve := &cobra.Command{
 		Use:   "serve",
 		Short: "Observe flows and assemble traces periodically",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			common2.AssembleInterval = vp.GetDuration("SEEFLOW_ASSEMBLE_INTERVAL")
+			common2.AssembleQuiescence = vp.GetDuration("SEEFLOW_ASSEMBLE_QUIESCENCE")
+			common2.CheckpointInterval = vp.GetDuration("SEEFLOW_CHECKPOINT_INTERVAL")
+			common2.ShutdownTimeout = vp.GetDuration("SEEFLOW_SHUTDOWN_TIMEOUT")
+			common2.OnlineAssemble = vp.GetBool("SEEFLOW_ONLINE_ASSEMBLE")
+			common2.ClockSkew = vp.GetDuration("SEEFLOW_CLOCK_SKEW")
+			common2.RequestTimeout = vp.GetDuration("SEEFLOW_REQUEST_TIMEOUT")
+			common2.MaxNumFlow = vp.GetInt("SEEFLOW_MAX_PENDING_FLOWS")
+			common2.SweepInterval = vp.GetDuration("SEEFLOW_SWEEP_INTERVAL")
+			common2.ConsumeWorkers = vp.GetInt("SEEFLOW_CONSUME_WORKERS")
+			common2.ConsumeQueueSize = vp.GetInt("SEEFLOW_CONSUME_QUEUE_SIZE")
+			common2.EnqueueTimeout = vp.GetDuration("SEEFLOW_ENQUEUE_TIMEOUT")
+			common2.RetentionL34 = vp.GetDuration("SEEFLOW_L34_RETENTION")
+			common2.RetentionSock = vp.GetDuration("SEEFLOW_SOCK_RETENTION")
+			common2.RetentionL7 = vp.GetDuration("SEEFLOW_L7_RETENTION")
+			common2.RetentionSpanAssign = vp.GetDuration("SEEFLOW_SPAN_ASSIGN_RETENTION")
+
 			// init main context of `serve`
-			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+			// SIGKILL 无法捕获，Kubernetes 终止 pod 时先发送 SIGTERM
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer cancel()
 
+			filters, err := common.GetFlowFilters(vp)
+			if err != nil {
+				return err
+			}
+
 			// init gRPC
 			hubble, cleanup, err := common.GetHubbleClient(ctx, vp)
 			if err != nil {
@@ -86,25 +99,41 @@ func New(vp *viper.Viper) *cobra.Command {
 				}
 			}()
 
-			// init tracerManager
+			// init tracerManager，schema 落后或超前时拒绝运行
+			if err := pkgtracer.CheckSchema(vp); err != nil {
+				return err
+			}
 			tracerManager := pkgtracer.NewTracerManager(vp)
-			//shutdown, _ := tracerManager.InitGRPCExporter(tracerManager.ShutdownCtx)
-			//shutdown, _ := tracerManager.InitStdoutExporter()
-			shutdown, _ := tracerManager.InitDummyExporter()
-			defer func() {
-				if err := shutdown(tracerManager.ShutdownCtx); err != nil {
-					logrus.Error(err)
+			shutdown, err := tracerManager.InitExporter(common.GetExporterOptions(vp))
+			if err != nil {
+				return err
+			}
+
+			// expose metrics
+			common2.MetricsAddr = vp.GetString("SEEFLOW_METRICS_ADDR")
+			if addr := common2.MetricsAddr; addr != "" {
+				handler, err := newMetricsHandler(tracerManager)
+				if err != nil {
+					return err
 				}
-			}()
+				go runMetricsServer(ctx, addr, handler)
+			}
 
 			// init bgTaskManager
-			bgTaskManager := pkgbgtask.NewBgTaskManager(hubble, tracerManager.Olap())
+			bgTaskManager := pkgbgtask.NewBgTaskManager(hubble, tracerManager)
 			bgTaskManager.StartAll()
 
+			// resume from checkpoints
+			cursor := loadCursor(tracerManager.Store())
+			go runCheckpoint(ctx, tracerManager, cursor, common2.CheckpointInterval)
+
+			// 停止接收流量（f.Run 返回）之后执行
+			defer gracefulShutdown(tracerManager, bgTaskManager.StopAll, cursor, shutdown, common2.ShutdownTimeout)
+
 			// handle flows
-			req := getFlowsRequest()
-			logrus.WithField("request", req).Debug("SeeFlow sent GetFlows request")
-			if err := handleFlows(ctx, hubble, req, tracerManager); err != nil {
+			bo := &backoff{min: common2.ReconnectMinBackoff, max: common2.ReconnectMaxBackoff}
+			f := newFollower(hubble, tracerManager.ConsumeFlow, filters, cursor, bo)
+			if err := f.Run(ctx); err != nil {
 				msg := err.Error()
 				// extract custom error message from failed grpc call
 				if s, ok := status.FromError(err); ok && s.Code() == codes.Unknown {
@@ -116,5 +145,9 @@ func New(vp *viper.Viper) *cobra.Command {
 
 		},
 	}
+	serve.Flags().AddFlagSet(serveFlags)
+	common.BindFlags(vp, serveFlags)
+	common.AddExporterFlags(serve, vp)
+	common.AddFilterFlags(serve)
 	return serve
 }
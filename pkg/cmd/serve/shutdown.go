@@ -0,0 +1,42 @@
+package serve
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+	"time"
+)
+
+// gracefulShutdown 在停止接收流量之后按顺序关闭：
+// 停止后台任务，排空 worker 并刷入数据库，聚合剩余的 Trace，保存检查点，关闭 TracerProvider，最后报告丢弃的流量。
+// 超过 timeout 则放弃剩余步骤。
+func gracefulShutdown(tm *pkgtracer.TracerManager, stopBgTasks func(), cursor *flowCursor,
+	shutdownProvider func(context.Context) error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		logrus.Info("SeeFlow is shutting down")
+		// 后台任务与下面的聚合互斥，先停止
+		stopBgTasks()
+		tm.Drain()
+		// 流量都已写入，此时的检查点才是可靠的
+		if store := tm.Store(); store != nil {
+			saveCheckpoint(tm, store, cursor)
+		}
+		if err := shutdownProvider(ctx); err != nil {
+			logrus.WithError(err).Error("SeeFlow couldn't shut down tracer providers")
+		}
+		tm.Summary()
+	}()
+
+	select {
+	case <-done:
+		logrus.Info("SeeFlow shut down")
+	case <-ctx.Done():
+		logrus.Errorf("SeeFlow didn't finish shutting down in %s, remaining flows and spans are lost", timeout)
+	}
+}
@@ -0,0 +1,48 @@
+package serve
+
+import (
+	"context"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	pkgtracer "github.com/stleox/seeflow/pkg/tracer"
+	r "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	tm := pkgtracer.NewTracerManager(nil)
+	_, err := tm.InitDummyExporter()
+	r.NoError(t, err)
+
+	// 后台任务先停止，TracerProvider 最后关闭
+	steps := make([]string, 0)
+	stopBgTasks := func() { steps = append(steps, "bgtask") }
+	shutdownProvider := func(ctx context.Context) error {
+		_, hasDeadline := ctx.Deadline()
+		r.True(t, hasDeadline)
+		steps = append(steps, "provider")
+		return nil
+	}
+	gracefulShutdown(tm, stopBgTasks, newFlowCursor(), shutdownProvider, time.Second)
+	r.Equal(t, []string{"bgtask", "provider"}, steps)
+
+	// 排空之后不再接受流量
+	flow := mockFlow("a", "node1", 1)
+	flow.Type = observerpb.FlowType_SOCK
+	tm.ConsumeFlow(flow)
+	r.Equal(t, int64(1), tm.ConsumeStats()[observerpb.FlowType_SOCK.String()].Dropped)
+}
+
+func TestGracefulShutdown_Timeout(t *testing.T) {
+	tm := pkgtracer.NewTracerManager(nil)
+	block := make(chan struct{})
+	defer close(block)
+	shutdownProvider := func(ctx context.Context) error {
+		<-block
+		return nil
+	}
+
+	start := time.Now()
+	gracefulShutdown(tm, func() {}, newFlowCursor(), shutdownProvider, 100*time.Millisecond)
+	r.Less(t, time.Since(start), time.Second)
+}
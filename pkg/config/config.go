@@ -13,6 +13,9 @@ const (
 // for root
 var (
 	Debug = false
+
+	// Version 由构建时 -ldflags 注入
+	Version = "dev"
 )
 
 // for cmd observe
@@ -26,27 +29,71 @@ var (
 
 // for cmd serve
 var (
-	// 请求 Hubble Flow 的时间间隔
-	GetFlowsInterval = time.Second
+	// Hubble 流中断后，重连的最小、最大退避时间
+	ReconnectMinBackoff = time.Second
+	ReconnectMaxBackoff = time.Minute
 	// 触发 Assemble 算法的时间间隔。
-	// 与上个时间间隔最好保持一致。
 	AssembleInterval = time.Second
+	// Trace 静默超过该时长才认为是完整的，然后聚合。
+	// 应大于 BulkInserter 的刷新间隔（1s）。
+	AssembleQuiescence = 5 * time.Second
+	// 保存检查点（每个 Hubble 节点最后提交的 flow）的时间间隔
+	CheckpointInterval = 5 * time.Second
+	// 在线聚合：span 构建后立即在内存中聚合并导出，不经过 OLAP
+	OnlineAssemble = false
+	// 暴露 Prometheus 指标的地址，为空则关闭
+	MetricsAddr = ":9091"
+	// 收到 SIGTERM 等信号后，排空、刷入、聚合并导出的最长时间
+	ShutdownTimeout = 30 * time.Second
+	// 各表的保留时长，按天分区，整个分区超期后删除；0 表示不删除。
+	// t_SpanAssign 应不短于 t_L7，否则晚到的 span 会重复导出
+	RetentionL34        = 7 * 24 * time.Hour
+	RetentionSock       = 7 * 24 * time.Hour
+	RetentionL7         = 7 * 24 * time.Hour
+	RetentionSpanAssign = 7 * 24 * time.Hour
+	// 检查并删除过期分区的时间间隔
+	RetentionInterval = time.Hour
 )
 
 // for pkg tracer
 var (
-	// MaxNumFlow tm.l7FlowLRU 溢出阈值
+	// ConsumeWorkers 每种流量（L34、Sock、L7）消费的 worker 数量
+	ConsumeWorkers = 8
+	// ConsumeQueueSize 每种流量待消费队列的长度，队列满时反压到接收流量的循环
+	ConsumeQueueSize = 4096
+	// EnqueueTimeout 队列持续满超过该时长，丢弃该流量；0 表示一直阻塞，不丢弃
+	EnqueueTimeout = time.Duration(0)
+	// MaxNumFlow 每个 namespace 待配对流量的上限，超出时淘汰最旧的
 	MaxNumFlow = 1024
-	// MaxNumTracer tm.tracerLRU 溢出阈值
-	MaxNumTracer     = 16
+	// RequestTimeout 请求等待响应超过该时长，视为被网络丢弃，构造结束于超时时刻的 broken span
+	RequestTimeout = 30 * time.Second
+	// SweepInterval 后台淘汰超时流量的时间间隔
+	SweepInterval = time.Second
+	// MaxSpanTimestamp 旧版本中 broken span 的结束时间，仅用于识别历史数据
 	MaxSpanTimestamp = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
 	MinSpanTimestamp = time.Unix(0, 0).UTC()
+	// HeaderAllowList 记录到 span 上的请求头，可由 SEEFLOW_HEADER_ALLOWLIST 覆盖
+	HeaderAllowList = []string{"user-agent", "content-type", "x-forwarded-for"}
+	// EvidenceSlack 关联 L34/Sock 流量时，span 时间窗口向前放宽的时长，用于覆盖请求之前的建连
+	EvidenceSlack = 100 * time.Millisecond
+	// ClockSkew CausalAssemble 比较 parent、child 的时间窗口时容忍的时钟偏差，span 来自不同节点的 Hubble
+	ClockSkew = 10 * time.Millisecond
+	// MaxNumProvider 缓存的 TracerProvider（每个 namespace/svc/pod 一个）的上限
+	MaxNumProvider = 1024
+	// ProviderTTL TracerProvider 超过该时长未使用则从缓存中淘汰
+	ProviderTTL = 10 * time.Minute
+	// MaxSpanEvents 每个 span 上 L34/Sock 事件的上限
+	MaxSpanEvents = 64
+	// Propagators 析取链路上下文的请求头格式，按顺序选用首个存在的，可由 SEEFLOW_PROPAGATORS 覆盖
+	Propagators = []string{"tracecontext", "b3", "jaeger", "x-client-trace-id", "b3multi"}
 )
 
 // for DB
 var (
 	// 测试账号
 	SEEFLOW_DEFAULT_DSN = "root:@tcp(127.0.0.1:9030)/seeflow"
+	// Doris 建表时的副本数，可由 SEEFLOW_REPLICATION_NUM 覆盖
+	ReplicationNum = 1
 
 	// DATE6 = "2006-01-02 15:04:05.000000" 的长度
 	L_DATE6 = 26
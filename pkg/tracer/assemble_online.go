@@ -0,0 +1,340 @@
+package tracer
+
+import (
+	"context"
+	"crypto/rand"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/stleox/seeflow/pkg/config"
+	tr "go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// 在线聚合，不经过 OLAP：
+// 请求到达时在 Trace 的部分树上登记一个未关闭的节点，并预先分配 SpanID；
+// L7Flow.Build 构建出 span 后关闭对应节点，节点及其 parent 都关闭后立即导出整棵子树。
+// SpanID 是预先分配的，所以 child 总能拿到 parent 的 SpanID，即使 parent 还没有导出。
+// 不同节点的流量可能乱序到达，child 的请求先于 parent 登记时，child 作为孤儿等待：
+// parent 登记时挂到其下；Trace 被回收时仍没有 parent 的，作为根导出。
+// 仍有节点等待响应的 Trace 保留到请求超时，超时构造的 broken span 沿用节点预先分配的 SpanID。
+
+// onlineNode 部分树上的节点，对应一次请求
+type onlineNode struct {
+	xreqID       string
+	srcPod       string
+	srcIdentity  uint32
+	destPod      string
+	destIdentity uint32
+	start        time.Time
+	// 登记时的墙上时间
+	openedAt time.Time
+
+	// 预先分配的 SpanID
+	spanID tr.SpanID
+	// 请求头携带上游 SpanID，挂在应用自己的 span 之下，不在树上找 parent
+	upstream bool
+	// 树上的 parent，请求头携带上游 SpanID 或者是根时为空
+	parent   *onlineNode
+	children []*onlineNode
+
+	// 关闭后有效
+	preSpan *PreSpan
+	flushed bool
+}
+
+func (n *onlineNode) closed() bool {
+	return n.preSpan != nil
+}
+
+// orphan 没有找到 parent 的节点。调用方是已知的 pod 时，它的请求也应被观测到，所以等待 parent 登记
+func (n *onlineNode) orphan() bool {
+	return n.parent == nil && !n.upstream && !n.flushed && isKnownPod(n.srcPod)
+}
+
+// 与 CausalAssemble 的规则一致：被调方是 child 的调用方，时间窗口包含 child。
+// 未关闭的节点时间窗口没有结束。
+func (n *onlineNode) contains(child *onlineNode) bool {
+	if !sameEndpoint(n.destPod, n.destIdentity, child.srcPod, child.srcIdentity) {
+		return false
+	}
+	if n.start.After(child.start) {
+		return false
+	}
+	return !n.closed() || !n.preSpan.EndTime.Before(child.start)
+}
+
+// ancestor 是否是 n 自身或者其祖先
+func (n *onlineNode) descendantOf(ancestor *onlineNode) bool {
+	for ; n != nil; n = n.parent {
+		if n == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// onlineTrace 单个 Trace 的部分树
+type onlineTrace struct {
+	tracer *Tracer
+	// xreqID -> node
+	nodes    map[string]*onlineNode
+	lastSeen time.Time
+}
+
+type onlineAssembler struct {
+	tm *TracerManager
+	// TraceID -> 部分树
+	traces map[string]*onlineTrace
+	mu     sync.Mutex
+}
+
+func newOnlineAssembler(tm *TracerManager) *onlineAssembler {
+	return &onlineAssembler{
+		tm:     tm,
+		traces: make(map[string]*onlineTrace, 0),
+	}
+}
+
+func (o *onlineAssembler) traceOf(traceID string) *onlineTrace {
+	t, hit := o.traces[traceID]
+	if !hit {
+		t = &onlineTrace{
+			tracer: o.tm.makeTracer(traceID),
+			nodes:  make(map[string]*onlineNode, 0),
+		}
+		o.traces[traceID] = t
+	}
+	t.lastSeen = time.Now()
+	return t
+}
+
+// Open 登记请求，在 L7Flow.Consume 中同步调用，同一节点上 parent 先于 child 登记
+func (o *onlineAssembler) Open(flow *observerpb.Flow) {
+	xreqID, err := extractXreqID(flow)
+	if err != nil {
+		return
+	}
+	tc, err := extractTraceContext(flow, o.tm.propagator)
+	if err != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t := o.traceOf(tc.TraceID.String())
+	if _, hit := t.nodes[xreqID]; hit {
+		return
+	}
+	node := &onlineNode{
+		xreqID:       xreqID,
+		srcPod:       extractPodName(flow.Source),
+		srcIdentity:  flow.Source.Identity,
+		destPod:      extractPodName(flow.Destination),
+		destIdentity: flow.Destination.Identity,
+		start:        flow.Time.AsTime(),
+		openedAt:     time.Now(),
+		spanID:       newSpanID(),
+		upstream:     tc.ParentSpanID.IsValid(),
+	}
+	t.attach(node)
+}
+
+// Close 关闭 span 对应的节点，在 L7Flow.Build 构建出 span 后调用
+func (o *onlineAssembler) Close(span *PreSpan) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t := o.traceOf(span.TraceID)
+	node, hit := t.nodes[span.ID]
+	if !hit {
+		// 请求没有登记过，比如在 serve 启动之前发出，补登记
+		node = &onlineNode{
+			xreqID:       span.ID,
+			srcPod:       span.SrcPod,
+			srcIdentity:  span.SrcIdentity,
+			destPod:      span.DestPod,
+			destIdentity: span.DestIdentity,
+			start:        span.StartTime,
+			openedAt:     time.Now(),
+			spanID:       newSpanID(),
+			upstream:     extractUpstreamSpanID(span).IsValid(),
+			preSpan:      span,
+		}
+		t.attach(node)
+	}
+	node.preSpan = span
+
+	switch {
+	case node.parent != nil:
+		if node.parent.flushed {
+			o.flushSubtree(t, node)
+		}
+	case node.orphan():
+		// 等待 parent 登记，或者在 Sweep 时作为根导出
+	default:
+		o.flushSubtree(t, node)
+	}
+}
+
+// Sweep 导出并回收静默超过 quiescence 的 Trace，quiescence 为 0 则全部回收，返回回收的 Trace 数量。
+// 有节点等待响应、且登记后还没有超过 RequestTimeout 的 Trace 继续保留，等待响应或者超时构造的 broken span。
+// 孤儿、parent 一直没有关闭的节点，在这时作为根导出，不引用未导出的 SpanID。
+// 已导出 span 的 SpanID 在这时写入 t_SpanAssign。
+func (o *onlineAssembler) Sweep(quiescence time.Duration) int {
+	o.mu.Lock()
+	now := time.Now()
+	deadline := now.Add(-quiescence)
+	// broken span 在后台任务淘汰请求时构造，多等一个 quiescence
+	openDeadline := deadline.Add(-config.RequestTimeout)
+	numTrace := 0
+	assigns := make([]*SpanAssign, 0)
+	for traceID, t := range o.traces {
+		if quiescence == 0 || (t.lastSeen.Before(deadline) && !t.waiting(openDeadline)) {
+			for _, node := range t.nodes {
+				if node.closed() && (node.parent == nil || !node.parent.closed()) {
+					o.reroot(node)
+					o.flushSubtree(t, node)
+				}
+			}
+			delete(o.traces, traceID)
+			numTrace++
+		}
+		assigns = append(assigns, t.tracer.assigns...)
+		t.tracer.assigns = nil
+	}
+	o.mu.Unlock()
+
+	metricTracesAssembled.Add(float64(numTrace))
+	if o.tm.store != nil {
+		if err := o.tm.store.SaveSpanAssigns(assigns); err != nil {
+			logrus.WithError(err).Warn("SeeFlow couldn't insert into t_SpanAssign")
+		}
+	}
+	return numTrace
+}
+
+// 把 node 从未关闭的 parent 下摘除，作为根
+func (o *onlineAssembler) reroot(node *onlineNode) {
+	if node.parent == nil {
+		return
+	}
+	siblings := node.parent.children
+	for i, sibling := range siblings {
+		if sibling == node {
+			node.parent.children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	node.parent = nil
+}
+
+// 导出已关闭的节点，并递归导出已关闭的 child
+func (o *onlineAssembler) flushSubtree(t *onlineTrace, node *onlineNode) {
+	if !node.closed() {
+		return
+	}
+	if !node.flushed {
+		o.export(t, node)
+		node.flushed = true
+	}
+	for _, child := range node.children {
+		o.flushSubtree(t, child)
+	}
+}
+
+func (o *onlineAssembler) export(t *onlineTrace, node *onlineNode) {
+	var parentSpanID tr.SpanID
+	var parentID string
+	if upstreamSpanID := extractUpstreamSpanID(node.preSpan); upstreamSpanID.IsValid() {
+		parentSpanID = upstreamSpanID
+	} else if node.parent != nil {
+		parentSpanID = node.parent.spanID
+		parentID = node.parent.xreqID
+	}
+
+	ctx := withPresetSpanID(o.tm.ShutdownCtx, node.spanID)
+	t.tracer.buildTrSpan(ctx, node.preSpan, parentSpanID)
+	if config.Debug {
+		t.tracer.debMapParentID[node.xreqID] = parentID
+	}
+}
+
+// attach 登记 node：在树上为其查找 parent，并收养以它为 parent 的孤儿
+func (t *onlineTrace) attach(node *onlineNode) {
+	if !node.upstream {
+		if node.parent = t.findParent(node); node.parent != nil {
+			node.parent.children = append(node.parent.children, node)
+		}
+	}
+	for _, orphan := range t.nodes {
+		if orphan.orphan() && node.contains(orphan) && !node.descendantOf(orphan) {
+			orphan.parent = node
+			node.children = append(node.children, orphan)
+		}
+	}
+	t.nodes[node.xreqID] = node
+}
+
+// waiting 是否有在 deadline 之后登记、仍在等待响应的节点
+func (t *onlineTrace) waiting(deadline time.Time) bool {
+	for _, node := range t.nodes {
+		if !node.closed() && node.openedAt.After(deadline) {
+			return true
+		}
+	}
+	return false
+}
+
+// 在树上查找 child 的 parent，选最内层（开始最晚）的一个，缺失返回 nil
+func (t *onlineTrace) findParent(child *onlineNode) *onlineNode {
+	var parent *onlineNode
+	for _, c := range t.nodes {
+		if !c.contains(child) {
+			continue
+		}
+		if parent == nil || c.start.After(parent.start) {
+			parent = c
+		}
+	}
+	return parent
+}
+
+// 预先分配 SpanID：通过 ctx 传给 presetIDGenerator
+
+type presetSpanIDKey struct{}
+
+func withPresetSpanID(ctx context.Context, spanID tr.SpanID) context.Context {
+	return context.WithValue(ctx, presetSpanIDKey{}, spanID)
+}
+
+// presetIDGenerator 优先使用 ctx 中预先分配的 SpanID，否则随机生成
+type presetIDGenerator struct{}
+
+func (g presetIDGenerator) NewIDs(ctx context.Context) (tr.TraceID, tr.SpanID) {
+	var traceID tr.TraceID
+	for !traceID.IsValid() {
+		if _, err := rand.Read(traceID[:]); err != nil {
+			logrus.WithError(err).Warn("SeeFlow couldn't generate TraceID")
+		}
+	}
+	return traceID, g.NewSpanID(ctx, traceID)
+}
+
+func (g presetIDGenerator) NewSpanID(ctx context.Context, _ tr.TraceID) tr.SpanID {
+	if spanID, ok := ctx.Value(presetSpanIDKey{}).(tr.SpanID); ok && spanID.IsValid() {
+		return spanID
+	}
+	return newSpanID()
+}
+
+func newSpanID() tr.SpanID {
+	var spanID tr.SpanID
+	for !spanID.IsValid() {
+		if _, err := rand.Read(spanID[:]); err != nil {
+			logrus.WithError(err).Warn("SeeFlow couldn't generate SpanID")
+		}
+	}
+	return spanID
+}
@@ -0,0 +1,166 @@
+package tracer
+
+import (
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/stleox/seeflow/pkg/config"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func TestOnlineAssembler(t *testing.T) {
+	config.Debug = true
+	config.MaxNumFlow = 1024
+	defer resetMockIdentities()
+
+	tm := mockNewTracerManager()
+	tm.online = newOnlineAssembler(tm)
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+	consume := mockOnlineConsume(t, tm)
+
+	// 集群外 -> bar -> loo，bar 先后两次调用 loo
+	consume(uuid1, 1, false, config.NameWorld, "bar")
+	consume(uuid2, 2, false, "bar", "loo")
+	consume(uuid2, 3, true, "loo", "bar")
+	consume(uuid3, 4, false, "bar", "loo")
+	consume(uuid3, 5, true, "loo", "bar")
+	// parent 未关闭，child 暂不导出
+	r.Empty(t, exporter.GetSpans())
+
+	consume(uuid1, 6, true, "bar", config.NameWorld)
+	// parent 关闭，整棵子树导出
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 3)
+
+	a := tm.online.traces[mockTraceID()].tracer
+	r.Equal(t, map[string]string{uuid1: "", uuid2: uuid1, uuid3: uuid1}, a.debMapParentID)
+
+	spanIDs := make(map[string]string)
+	for _, span := range spans {
+		r.Equal(t, mockTraceID(), span.SpanContext.TraceID().String())
+		spanIDs[span.StartTime.String()] = span.SpanContext.SpanID().String()
+		if span.StartTime.Equal(time.Unix(1, 0)) {
+			r.False(t, span.Parent.SpanID().IsValid())
+		} else {
+			r.Equal(t, spanIDs[time.Unix(1, 0).String()], span.Parent.SpanID().String())
+		}
+	}
+
+	// 静默的 Trace 被回收
+	r.Equal(t, 1, tm.online.Sweep(0))
+	r.Empty(t, tm.online.traces)
+}
+
+func TestOnlineAssembler_Reorder(t *testing.T) {
+	config.Debug = true
+	config.MaxNumFlow = 1024
+	defer resetMockIdentities()
+
+	tm := mockNewTracerManager()
+	tm.online = newOnlineAssembler(tm)
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+	consume := mockOnlineConsume(t, tm)
+
+	// <bar, loo> 所在节点的流量先到达，此时 <foo, bar> 还没有登记
+	consume(uuid2, 2, false, "bar", "loo")
+	consume(uuid2, 3, true, "loo", "bar")
+	// 调用方 bar 是已知的 pod，作为孤儿等待 parent
+	r.Empty(t, exporter.GetSpans())
+
+	consume(uuid1, 1, false, "foo", "bar")
+	consume(uuid1, 6, true, "bar", "foo")
+	// <foo, bar> 的调用方 foo 也是已知的 pod，同样等待
+	r.Empty(t, exporter.GetSpans())
+
+	// <bar, baz> 的 parent <qux, bar> 一直没有关闭
+	consume(uuid4, 8, false, "qux", "bar")
+	consume(uuid3, 9, false, "bar", "baz")
+	consume(uuid3, 10, true, "baz", "bar")
+	r.Empty(t, exporter.GetSpans())
+
+	// 回收时孤儿作为根导出，<bar, loo> 已挂到 <foo, bar> 下；
+	// <bar, baz> 不引用未导出的 <qux, bar>
+	r.Equal(t, 1, tm.online.Sweep(0))
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 3)
+	spanIDs := make(map[int64]string)
+	parentIDs := make(map[int64]string)
+	for _, span := range spans {
+		spanIDs[span.StartTime.Unix()] = span.SpanContext.SpanID().String()
+		if span.Parent.SpanID().IsValid() {
+			parentIDs[span.StartTime.Unix()] = span.Parent.SpanID().String()
+		}
+	}
+	r.Equal(t, map[int64]string{2: spanIDs[1]}, parentIDs)
+
+	// 已导出的 span 写入 t_SpanAssign
+	n, err := tm.store.CountSpanAssigns(mockTraceID())
+	r.NoError(t, err)
+	r.Equal(t, 3, n)
+}
+
+func TestOnlineAssembler_NoResponse(t *testing.T) {
+	config.Debug = true
+	config.MaxNumFlow = 1024
+	defer resetMockIdentities()
+
+	tm := mockNewTracerManager()
+	tm.online = newOnlineAssembler(tm)
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+	consume := mockOnlineConsume(t, tm)
+
+	// bar 一直没有响应，<bar, loo> 等待 parent 关闭
+	consume(uuid1, 1, false, config.NameWorld, "bar")
+	consume(uuid2, 2, false, "bar", "loo")
+	consume(uuid2, 3, true, "loo", "bar")
+
+	// 静默超过 quiescence，但请求还没有超时，Trace 保留
+	time.Sleep(time.Millisecond)
+	r.Equal(t, 0, tm.online.Sweep(time.Nanosecond))
+	r.Empty(t, exporter.GetSpans())
+
+	// 请求超时，broken span 沿用预先分配的 SpanID，child 挂在其下
+	spanID := tm.online.traces[mockTraceID()].nodes[uuid1].spanID
+	r.Equal(t, 1, tm.ExpireFlows(time.Now().Add(2*config.RequestTimeout)))
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 2)
+	for _, span := range spans {
+		if span.StartTime.Equal(time.Unix(1, 0)) {
+			r.Equal(t, spanID, span.SpanContext.SpanID())
+			r.False(t, span.Parent.SpanID().IsValid())
+		} else {
+			r.Equal(t, spanID, span.Parent.SpanID())
+		}
+	}
+
+	r.Equal(t, 1, tm.online.Sweep(0))
+	r.Len(t, exporter.GetSpans(), 2)
+}
+
+// 模拟 L7Flow.Consume：请求同步登记，然后构建。集群外的一端没有 pod
+func mockOnlineConsume(t *testing.T, tm *TracerManager) func(xreqID string, sec int64, isReply bool, src string, dest string) {
+	return func(xreqID string, sec int64, isReply bool, src string, dest string) {
+		flow := mockFlow(xreqID, time.Unix(sec, 0), isReply, src, dest)
+		for _, endpoint := range []*observerpb.Endpoint{flow.Source, flow.Destination} {
+			if endpoint.PodName == config.NameWorld+"-0000000000-00000" {
+				endpoint.PodName = ""
+			}
+		}
+		if !isReply {
+			tm.online.Open(flow)
+		}
+		r.NoError(t, (&L7Flow{tm: tm}).Build(flow))
+	}
+}
+
+func mockTraceID() string {
+	traceID, _ := parseTraceID(uuid1)
+	return traceID.String()
+}
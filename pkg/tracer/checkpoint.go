@@ -0,0 +1,125 @@
+package tracer
+
+import (
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"sync"
+	"time"
+)
+
+// Checkpoint 记录每个 Hubble 节点上最后接收的 flow，以及其中尚未提交的 flow，serve 重启时从此处恢复：
+// 从最早的尚未提交的 flow 开始重放，但只消费尚未提交的，已写入的不会重复写入。
+type Checkpoint struct {
+	NodeName string `db:"node_name"`
+	TimeNs   int64  `db:"time_ns"`   // flow 时间，纳秒精度，DATETIME(6) 只到微秒
+	Uuids    string `db:"uuids"`     // 与 TimeNs 同一时刻的 flow，逗号分隔，用于去重
+	ReplayNs int64  `db:"replay_ns"` // 最早的尚未提交的 flow 时间，没有则为 0
+	Replay   string `db:"replay"`    // 尚未提交的 flow，逗号分隔，重启后重新消费
+}
+
+// UncommittedFlows 一个 Hubble 节点上尚未提交的 flow
+type UncommittedFlows struct {
+	Oldest time.Time
+	Uuids  map[string]struct{}
+}
+
+// NodeName -> 尚未提交的 flow
+type uncommittedSet map[string]*UncommittedFlows
+
+func (s uncommittedSet) add(flow *observerpb.Flow) {
+	u, hit := s[flow.GetNodeName()]
+	if !hit {
+		u = &UncommittedFlows{Oldest: flow.GetTime().AsTime(), Uuids: make(map[string]struct{}, 0)}
+		s[flow.GetNodeName()] = u
+	}
+	if t := flow.GetTime().AsTime(); t.Before(u.Oldest) {
+		u.Oldest = t
+	}
+	u.Uuids[flow.GetUuid()] = struct{}{}
+}
+
+// flowTracker 记录每个 Hubble 节点上已接收、尚未提交的 flow。
+// flow 由 worker pool 异步消费，接收到的 flow 不一定已经写入，所以检查点不能越过其中最早的一个。
+type flowTracker struct {
+	// NodeName -> 尚未提交的 flow
+	nodes map[string]map[*observerpb.Flow]struct{}
+	mu    sync.Mutex
+}
+
+func newFlowTracker() *flowTracker {
+	return &flowTracker{nodes: make(map[string]map[*observerpb.Flow]struct{}, 0)}
+}
+
+// begin 登记已接收的 flow，返回的 commit 标记其已提交
+func (ft *flowTracker) begin(flow *observerpb.Flow) (commit func()) {
+	node := flow.GetNodeName()
+	ft.mu.Lock()
+	flows, hit := ft.nodes[node]
+	if !hit {
+		flows = make(map[*observerpb.Flow]struct{}, 0)
+		ft.nodes[node] = flows
+	}
+	flows[flow] = struct{}{}
+	ft.mu.Unlock()
+
+	return func() {
+		ft.mu.Lock()
+		delete(flows, flow)
+		if len(flows) == 0 {
+			delete(ft.nodes, node)
+		}
+		ft.mu.Unlock()
+	}
+}
+
+// collect 将尚未提交的 flow 加入 s
+func (ft *flowTracker) collect(s uncommittedSet) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	for _, flows := range ft.nodes {
+		for flow := range flows {
+			s.add(flow)
+		}
+	}
+}
+
+// Uncommitted 返回每个 Hubble 节点上尚未提交的 flow：排队、消费中的，以及缓存中等待配对的。
+// flow 先放入缓存再标记提交，所以先查消费中的、再查缓存，转移中的 flow 不会被遗漏
+func (tm *TracerManager) Uncommitted() map[string]*UncommittedFlows {
+	s := make(uncommittedSet, 0)
+	tm.uncommitted.collect(s)
+	tm.bufFlow.collect(s)
+	return s
+}
+
+// DB
+
+// SelectCheckpoints 选择全部节点的检查点
+func (o *Olap) SelectCheckpoints() ([]*Checkpoint, error) {
+	ckpts := make([]*Checkpoint, 0)
+	err := o.conn.QueryRows(&ckpts, "SELECT "+
+		"node_name, "+
+		"time_ns, "+
+		"uuids, "+
+		"replay_ns, "+
+		"COALESCE(replay, '') AS replay "+
+		"FROM `t_Ckpt`")
+	return ckpts, err
+}
+
+// SaveCheckpoints 更新检查点，调用前应确保对应的 flow 已经刷入数据库
+func (o *Olap) SaveCheckpoints(ckpts []*Checkpoint) error {
+	for _, ckpt := range ckpts {
+		_, err := o.conn.Exec("INSERT INTO `t_Ckpt` "+
+			"(node_name, "+
+			"time_ns, "+
+			"uuids, "+
+			"replay_ns, "+
+			"replay) "+
+			"VALUES (?,?,?,?,?)", ckpt.NodeName, ckpt.TimeNs, ckpt.Uuids, ckpt.ReplayNs, ckpt.Replay)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
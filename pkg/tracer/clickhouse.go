@@ -0,0 +1,495 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/sirupsen/logrus"
+	"github.com/zeromicro/go-zero/core/executors"
+	"strings"
+	"time"
+)
+
+// 使用 ClickHouse 存储的 DSN scheme，比如 clickhouse://default:@127.0.0.1:9000/seeflow
+const kClickHouseDSN = "clickhouse://"
+
+// chConn ClickHouse 原生连接中用到的部分，便于测试时替换
+type chConn interface {
+	Exec(ctx context.Context, query string, args ...any) error
+	Query(ctx context.Context, query string, args ...any) (driver.Rows, error)
+	PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error)
+}
+
+// ClickHouse 存储后端：流量经原生协议批量写入
+type ClickHouse struct {
+	conn        chConn
+	l34Batcher  *chBatcher
+	l7Batcher   *chBatcher
+	sockBatcher *chBatcher
+
+	exFlowLog
+}
+
+func NewClickHouse(dsn string) *ClickHouse {
+	conn, err := openClickHouse(dsn)
+	if err != nil {
+		logrus.WithError(err).Error("SeeFlow couldn't connect to ClickHouse")
+		return nil
+	}
+	return newClickHouse(conn)
+}
+
+func openClickHouse(dsn string) (driver.Conn, error) {
+	opts, err := clickhouse.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return clickhouse.Open(opts)
+}
+
+// 表由迁移创建，见 chMigrations
+func newClickHouse(conn chConn) *ClickHouse {
+	return &ClickHouse{
+		conn: conn,
+		l34Batcher: newChBatcher(conn, "t_L34", []string{
+			"time",
+			"namespace",
+			"src_identity",
+			"dest_identity",
+			"is_reply",
+			"traffic_direction",
+			"traffic_observation",
+			"verdict",
+			"tcp_flags",
+			"drop_reason"}),
+		l7Batcher: newChBatcher(conn, "t_L7", []string{
+			"id",
+			"trace_id",
+			"parent_span_id",
+			"namespace",
+			"src_identity",
+			"src_pod",
+			"src_svc",
+			"dest_identity",
+			"dest_pod",
+			"dest_svc",
+			"start_time",
+			"end_time",
+			"protocol",
+			"http_method",
+			"http_url",
+			"http_status_code",
+			"latency_ns",
+			"http_headers",
+			"no_response"}),
+		sockBatcher: newChBatcher(conn, "t_Sock", []string{
+			"time",
+			"namespace",
+			"src_identity",
+			"dest_identity",
+			"event_type",
+			"sub_type",
+			"cgroup_id"}),
+	}
+}
+
+// chBatcher 与 BulkInserter 相同，攒够 1000 行或每隔 1s 写入一批；一批对应一次原生协议的 INSERT
+type chBatcher struct {
+	conn     chConn
+	table    string
+	insert   string
+	executor *executors.BulkExecutor
+}
+
+func newChBatcher(conn chConn, table string, columns []string) *chBatcher {
+	b := &chBatcher{
+		conn:   conn,
+		table:  table,
+		insert: fmt.Sprintf("INSERT INTO `%s` (%s)", table, strings.Join(columns, ", ")),
+	}
+	b.executor = executors.NewBulkExecutor(b.execute)
+	return b
+}
+
+func (b *chBatcher) Insert(row ...any) error {
+	return b.executor.Add(row)
+}
+
+func (b *chBatcher) Flush() {
+	b.executor.Flush()
+}
+
+func (b *chBatcher) execute(tasks []any) {
+	rows := make([][]any, 0, len(tasks))
+	for _, task := range tasks {
+		rows = append(rows, task.([]any))
+	}
+	start := time.Now()
+	err := sendBatch(b.conn, b.insert, rows)
+	metricInsertDuration.WithLabelValues(b.table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logrus.WithError(err).Warnf("SeeFlow couldn't insert into %s", b.table)
+		return
+	}
+	metricFlowsInserted.WithLabelValues(b.table).Add(float64(len(rows)))
+}
+
+// sendBatch 同步写入一批，失败则整批放弃
+func sendBatch(conn chConn, insert string, rows [][]any) error {
+	batch, err := conn.PrepareBatch(context.Background(), insert)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := batch.Append(row...); err != nil {
+			_ = batch.Abort()
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+func (c *ClickHouse) InsertL34(l *L34FlowEntity) error {
+	return c.l34Batcher.Insert(
+		l.Time,
+		l.Namespace,
+		l.SrcIdentity,
+		l.DestIdentity,
+		l.IsReply,
+		l.TrafficDirection,
+		l.TrafficObservation,
+		l.Verdict,
+		l.TCPFlags,
+		l.DropReason)
+}
+
+func (c *ClickHouse) InsertSock(s *SockFlowEntity) error {
+	return c.sockBatcher.Insert(
+		s.Time,
+		s.Namespace,
+		s.SrcIdentity,
+		s.DestIdentity,
+		s.EventType,
+		s.SubType,
+		int64(s.CgroupId))
+}
+
+func (c *ClickHouse) InsertL7(l *L7FlowEntity) error {
+	return c.l7Batcher.Insert(
+		l.ID,
+		l.TraceID,
+		l.ParentSpanID,
+		l.Namespace,
+		l.SrcIdentity,
+		l.SrcPod,
+		l.SrcSvc,
+		l.DestIdentity,
+		l.DestPod,
+		l.DestSvc,
+		l.StartTime,
+		l.EndTime,
+		l.Protocol,
+		l.Method,
+		l.URL,
+		l.StatusCode,
+		l.LatencyNs,
+		l.Headers,
+		l.NoResponse)
+}
+
+func (c *ClickHouse) Flush() {
+	c.l34Batcher.Flush()
+	c.l7Batcher.Flush()
+	c.sockBatcher.Flush()
+}
+
+// 逐行扫描查询结果
+func (c *ClickHouse) queryRows(scan func(rows driver.Rows) error, query string, args ...any) error {
+	rows, err := c.conn.Query(context.Background(), query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *ClickHouse) queryCount(query string, args ...any) (int, error) {
+	var count uint64
+	err := c.queryRows(func(rows driver.Rows) error {
+		return rows.Scan(&count)
+	}, query, args...)
+	return int(count), err
+}
+
+func (c *ClickHouse) SelectL7Spans(traceID string) ([]*L7FlowEntity, error) {
+	spans := make([]*L7FlowEntity, 0)
+	err := c.queryRows(func(rows driver.Rows) error {
+		var l L7FlowEntity
+		if err := rows.Scan(
+			&l.ID,
+			&l.TraceID,
+			&l.ParentSpanID,
+			&l.Namespace,
+			&l.SrcIdentity,
+			&l.SrcPod,
+			&l.SrcSvc,
+			&l.DestIdentity,
+			&l.DestPod,
+			&l.DestSvc,
+			&l.StartTime,
+			&l.EndTime,
+			&l.Protocol,
+			&l.Method,
+			&l.URL,
+			&l.StatusCode,
+			&l.LatencyNs,
+			&l.Headers,
+			&l.NoResponse); err != nil {
+			return err
+		}
+		spans = append(spans, &l)
+		return nil
+	}, "SELECT "+
+		"id, "+
+		"trace_id, "+
+		"parent_span_id, "+
+		"namespace, "+
+		"src_identity, "+
+		"src_pod, "+
+		"src_svc, "+
+		"dest_identity, "+
+		"dest_pod, "+
+		"dest_svc, "+
+		"start_time, "+
+		"end_time, "+
+		"protocol, "+
+		"http_method, "+
+		"http_url, "+
+		"http_status_code, "+
+		"latency_ns, "+
+		"http_headers, "+
+		"no_response "+
+		"FROM `t_L7` WHERE trace_id = ? "+
+		"ORDER BY start_time", traceID)
+	return spans, err
+}
+
+func (c *ClickHouse) CountL7Spans(traceID string) (int, error) {
+	return c.queryCount("SELECT count() FROM `t_L7` WHERE trace_id = ?", traceID)
+}
+
+func (c *ClickHouse) SelectL34Flows(from time.Time, to time.Time, identities []uint32) ([]*L34FlowEntity, error) {
+	in, ids := inPlaceholders(identities)
+	// 按位置绑定的时间只精确到秒，以微秒时间戳传入
+	args := append([]any{from.UnixMicro(), to.UnixMicro()}, ids...)
+	args = append(args, ids...)
+	flows := make([]*L34FlowEntity, 0)
+	err := c.queryRows(func(rows driver.Rows) error {
+		var l L34FlowEntity
+		if err := rows.Scan(
+			&l.Time,
+			&l.Namespace,
+			&l.SrcIdentity,
+			&l.DestIdentity,
+			&l.IsReply,
+			&l.TrafficDirection,
+			&l.TrafficObservation,
+			&l.Verdict,
+			&l.TCPFlags,
+			&l.DropReason); err != nil {
+			return err
+		}
+		flows = append(flows, &l)
+		return nil
+	}, fmt.Sprintf("SELECT "+
+		"time, "+
+		"namespace, "+
+		"src_identity, "+
+		"dest_identity, "+
+		"is_reply, "+
+		"traffic_direction, "+
+		"traffic_observation, "+
+		"verdict, "+
+		"tcp_flags, "+
+		"drop_reason "+
+		"FROM `t_L34` WHERE time BETWEEN fromUnixTimestamp64Micro(?) AND fromUnixTimestamp64Micro(?) "+
+		"AND src_identity IN (%s) AND dest_identity IN (%s) "+
+		"ORDER BY time", in, in), args...)
+	return flows, err
+}
+
+func (c *ClickHouse) SelectSockFlows(from time.Time, to time.Time, identities []uint32) ([]*SockFlowEntity, error) {
+	in, ids := inPlaceholders(identities)
+	// 按位置绑定的时间只精确到秒，以微秒时间戳传入
+	args := append([]any{from.UnixMicro(), to.UnixMicro()}, ids...)
+	args = append(args, ids...)
+	flows := make([]*SockFlowEntity, 0)
+	err := c.queryRows(func(rows driver.Rows) error {
+		var s SockFlowEntity
+		var cgroupID int64
+		if err := rows.Scan(
+			&s.Time,
+			&s.Namespace,
+			&s.SrcIdentity,
+			&s.DestIdentity,
+			&s.EventType,
+			&s.SubType,
+			&cgroupID); err != nil {
+			return err
+		}
+		s.CgroupId = int(cgroupID)
+		flows = append(flows, &s)
+		return nil
+	}, fmt.Sprintf("SELECT "+
+		"time, "+
+		"namespace, "+
+		"src_identity, "+
+		"dest_identity, "+
+		"event_type, "+
+		"sub_type, "+
+		"cgroup_id "+
+		"FROM `t_Sock` WHERE time BETWEEN fromUnixTimestamp64Micro(?) AND fromUnixTimestamp64Micro(?) "+
+		"AND src_identity IN (%s) AND dest_identity IN (%s) "+
+		"ORDER BY time", in, in), args...)
+	return flows, err
+}
+
+func (c *ClickHouse) SelectSpanAssigns(traceID string) ([]*SpanAssign, error) {
+	assigns := make([]*SpanAssign, 0)
+	err := c.queryRows(func(rows driver.Rows) error {
+		var a SpanAssign
+		if err := rows.Scan(
+			&a.TraceID,
+			&a.ID,
+			&a.SpanID,
+			&a.DestIdentity,
+			&a.DestPod,
+			&a.StartTime,
+			&a.EndTime); err != nil {
+			return err
+		}
+		assigns = append(assigns, &a)
+		return nil
+	}, "SELECT "+
+		"trace_id, "+
+		"id, "+
+		"span_id, "+
+		"dest_identity, "+
+		"dest_pod, "+
+		"start_time, "+
+		"end_time "+
+		"FROM `t_SpanAssign` FINAL WHERE trace_id = ?", traceID)
+	return assigns, err
+}
+
+// SaveSpanAssigns 同步写入，保证同一 Trace 的下一轮聚合能读到
+func (c *ClickHouse) SaveSpanAssigns(assigns []*SpanAssign) error {
+	if len(assigns) == 0 {
+		return nil
+	}
+	rows := make([][]any, 0, len(assigns))
+	for _, a := range assigns {
+		rows = append(rows, []any{a.TraceID, a.ID, a.SpanID, a.DestIdentity, a.DestPod, a.StartTime, a.EndTime})
+	}
+	return sendBatch(c.conn, "INSERT INTO `t_SpanAssign` "+
+		"(trace_id, "+
+		"id, "+
+		"span_id, "+
+		"dest_identity, "+
+		"dest_pod, "+
+		"start_time, "+
+		"end_time)", rows)
+}
+
+func (c *ClickHouse) CountSpanAssigns(traceID string) (int, error) {
+	return c.queryCount("SELECT count() FROM `t_SpanAssign` FINAL WHERE trace_id = ?", traceID)
+}
+
+func (c *ClickHouse) SelectCheckpoints() ([]*Checkpoint, error) {
+	ckpts := make([]*Checkpoint, 0)
+	err := c.queryRows(func(rows driver.Rows) error {
+		var ckpt Checkpoint
+		if err := rows.Scan(&ckpt.NodeName, &ckpt.TimeNs, &ckpt.Uuids, &ckpt.ReplayNs, &ckpt.Replay); err != nil {
+			return err
+		}
+		ckpts = append(ckpts, &ckpt)
+		return nil
+	}, "SELECT "+
+		"node_name, "+
+		"time_ns, "+
+		"uuids, "+
+		"replay_ns, "+
+		"replay "+
+		"FROM `t_Ckpt` FINAL")
+	return ckpts, err
+}
+
+func (c *ClickHouse) SaveCheckpoints(ckpts []*Checkpoint) error {
+	if len(ckpts) == 0 {
+		return nil
+	}
+	rows := make([][]any, 0, len(ckpts))
+	for _, ckpt := range ckpts {
+		rows = append(rows, []any{ckpt.NodeName, ckpt.TimeNs, ckpt.Uuids, ckpt.ReplayNs, ckpt.Replay})
+	}
+	return sendBatch(c.conn, "INSERT INTO `t_Ckpt` "+
+		"(node_name, "+
+		"time_ns, "+
+		"uuids, "+
+		"replay_ns, "+
+		"replay)", rows)
+}
+
+// SaveEndpoints 全量更新，先清表再插入
+func (c *ClickHouse) SaveEndpoints(endpoints []*Endpoint) error {
+	err := c.conn.Exec(context.Background(), "TRUNCATE TABLE `t_Ep`")
+	if err != nil || len(endpoints) == 0 {
+		return err
+	}
+	rows := make([][]any, 0, len(endpoints))
+	for _, ep := range endpoints {
+		rows = append(rows, []any{ep.Namespace, ep.PodName, ep.SvcName, ep.Endpoint, ep.Identity, ep.State, ep.IP})
+	}
+	return sendBatch(c.conn, "INSERT INTO `t_Ep` "+
+		"(namespace, "+
+		"pod_name, "+
+		"svc_name, "+
+		"endpoint, "+
+		"identity, "+
+		"state, "+
+		"ip)", rows)
+}
+
+// toDate 分区的名字，比如 2006-01-02；t_Ep 等未分区的表只有 tuple()，不会删除
+const kClickHousePartitionLayout = time.DateOnly
+
+func (c *ClickHouse) DropPartitions(table string, before time.Time) ([]Partition, error) {
+	names := make([]string, 0)
+	err := c.queryRows(func(rows driver.Rows) error {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	}, "SELECT DISTINCT partition FROM system.parts "+
+		"WHERE database = currentDatabase() AND table = ? AND active", table)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := make([]Partition, 0)
+	for _, p := range expiredPartitions(table, names, kClickHousePartitionLayout, before) {
+		if err := c.conn.Exec(context.Background(), fmt.Sprintf("ALTER TABLE `%s` DROP PARTITION '%s'", table, p.Name)); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, p)
+	}
+	return dropped, nil
+}
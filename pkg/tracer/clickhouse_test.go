@@ -0,0 +1,212 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	r "github.com/stretchr/testify/require"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeChConn 记录执行的语句与写入的批次，查询返回预先录制的结果
+type fakeChConn struct {
+	mu      sync.Mutex
+	execs   []string
+	batches map[string][][]any // INSERT 语句 -> 写入的行
+	// 查询语句的片段 -> 结果，按列顺序
+	fixtures map[string][][]any
+	queries  []string
+	args     [][]any
+}
+
+func newFakeChConn() *fakeChConn {
+	return &fakeChConn{
+		batches:  make(map[string][][]any, 0),
+		fixtures: make(map[string][][]any, 0),
+	}
+}
+
+func (c *fakeChConn) Exec(ctx context.Context, query string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.execs = append(c.execs, query)
+	return nil
+}
+
+func (c *fakeChConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = append(c.queries, query)
+	c.args = append(c.args, args)
+	for fragment, rows := range c.fixtures {
+		if strings.Contains(query, fragment) {
+			return &fakeChRows{rows: rows, i: -1}, nil
+		}
+	}
+	return &fakeChRows{i: -1}, nil
+}
+
+func (c *fakeChConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	return &fakeChBatch{conn: c, query: query}, nil
+}
+
+type fakeChBatch struct {
+	driver.Batch
+	conn  *fakeChConn
+	query string
+	rows  [][]any
+}
+
+func (b *fakeChBatch) Append(v ...any) error {
+	b.rows = append(b.rows, v)
+	return nil
+}
+
+func (b *fakeChBatch) Abort() error { return nil }
+
+func (b *fakeChBatch) Send() error {
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	b.conn.batches[b.query] = append(b.conn.batches[b.query], b.rows...)
+	return nil
+}
+
+type fakeChRows struct {
+	driver.Rows
+	rows [][]any
+	i    int
+}
+
+func (r *fakeChRows) Next() bool {
+	r.i++
+	return r.i < len(r.rows)
+}
+
+// 与原生驱动一样，类型必须与列一致
+func (r *fakeChRows) Scan(dest ...any) error {
+	row := r.rows[r.i]
+	if len(dest) != len(row) {
+		return fmt.Errorf("scan %d columns into %d destinations", len(row), len(dest))
+	}
+	for i := range dest {
+		d := reflect.ValueOf(dest[i]).Elem()
+		v := reflect.ValueOf(row[i])
+		if d.Type() != v.Type() {
+			return fmt.Errorf("column %d: can't scan %s into %s", i, v.Type(), d.Type())
+		}
+		d.Set(v)
+	}
+	return nil
+}
+
+func (r *fakeChRows) Close() error { return nil }
+
+func (r *fakeChRows) Err() error { return nil }
+
+func TestClickHouse_Migrate(t *testing.T) {
+	conn := newFakeChConn()
+	m := newMigrator(chSchema{conn}, chMigrations)
+	// 查看状态是只读的，t_schema_version 不存在视为版本 0
+	status, err := m.Status()
+	r.NoError(t, err)
+	r.Equal(t, 0, status.Current)
+	r.Empty(t, conn.execs)
+
+	n, err := m.Up(io.Discard, false)
+	r.NoError(t, err)
+	r.Equal(t, len(chMigrations), n)
+	r.Contains(t, conn.execs[0], "CREATE TABLE IF NOT EXISTS `t_schema_version`")
+	numStmt := 0
+	for _, migration := range chMigrations {
+		numStmt += len(migration.Statements)
+	}
+	r.Len(t, conn.execs, 1+numStmt)
+	for i, name := range []string{"t_L34", "t_L7", "t_Sock", "t_Ep"} {
+		r.Contains(t, conn.execs[1+i], "CREATE TABLE IF NOT EXISTS `"+name+"`")
+		r.Contains(t, conn.execs[1+i], "ENGINE = MergeTree")
+	}
+	r.Contains(t, conn.execs[1], "PARTITION BY toDate(time)")
+	r.Contains(t, conn.execs[2], "ORDER BY (trace_id, start_time)")
+	// t_SpanAssign 重建为按天分区的表，原表保留为 t_SpanAssign_legacy
+	spanAssign := 1 + len(chMigrations[0].Statements)
+	r.Contains(t, conn.execs[spanAssign], "PARTITION BY toDate(start_time)")
+	r.Contains(t, conn.execs[spanAssign+1], "FROM `t_SpanAssign` FINAL")
+	r.Contains(t, conn.execs[spanAssign+2], "`t_SpanAssign` TO `t_SpanAssign_legacy`")
+	r.Contains(t, conn.execs[numStmt], "ALTER TABLE `t_Ckpt`")
+
+	insert := "INSERT INTO `t_schema_version` (version, description, applied_at)"
+	r.Len(t, conn.batches[insert], len(chMigrations))
+	r.Equal(t, uint32(1), conn.batches[insert][0][0])
+
+	// 已记录的版本不再执行
+	conn.fixtures["FROM system.tables"] = [][]any{{"t_schema_version"}}
+	conn.fixtures["FROM `t_schema_version`"] = [][]any{{uint32(1)}, {uint32(2)}, {uint32(3)}, {uint32(4)}}
+	r.NoError(t, m.Check())
+}
+
+func TestClickHouse_BatchInsert(t *testing.T) {
+	conn := newFakeChConn()
+	c := newClickHouse(conn)
+
+	at := time.Unix(1, 0)
+	r.NoError(t, c.InsertSock(&SockFlowEntity{Time: at, Namespace: "foo", SrcIdentity: 1, DestIdentity: 2, EventType: 3, SubType: 4, CgroupId: 5}))
+	r.NoError(t, c.InsertSock(&SockFlowEntity{Time: at, Namespace: "bar"}))
+	// Flush 之前还在缓冲中
+	r.Empty(t, conn.batches)
+	c.Flush()
+
+	insert := "INSERT INTO `t_Sock` (time, namespace, src_identity, dest_identity, event_type, sub_type, cgroup_id)"
+	r.Len(t, conn.batches, 1)
+	r.Len(t, conn.batches[insert], 2)
+	// 类型与列一一对应，Int64 列不接受 int
+	r.Equal(t, []any{at, "foo", uint32(1), uint32(2), int8(3), int8(4), int64(5)}, conn.batches[insert][0])
+}
+
+func TestClickHouse_Select(t *testing.T) {
+	conn := newFakeChConn()
+	c := newClickHouse(conn)
+
+	start, end := time.Unix(1, 0), time.Unix(2, 0)
+	conn.fixtures["FROM `t_L7`"] = [][]any{
+		{"id1", uuid1, "", "foo", uint32(1), "pod1", "svc1", uint32(2), "pod2", "svc2",
+			start, end, "HTTP/1.1", "GET", "/", uint32(200), uint64(1000), "{}", false},
+	}
+	conn.fixtures["FROM `t_SpanAssign`"] = [][]any{{uint64(3)}}
+
+	spans, err := c.SelectL7Spans(uuid1)
+	r.NoError(t, err)
+	r.Len(t, spans, 1)
+	r.Equal(t, "svc2", spans[0].DestSvc)
+	r.Equal(t, uint32(200), spans[0].StatusCode)
+	r.Equal(t, []any{uuid1}, conn.args[0])
+
+	// 已导出的 span 在 ReplacingMergeTree 中去重
+	count, err := c.CountSpanAssigns(uuid1)
+	r.NoError(t, err)
+	r.Equal(t, 3, count)
+	r.Contains(t, conn.queries[1], "`t_SpanAssign` FINAL")
+
+	// identity 展开为占位符，两端各一份
+	_, err = c.SelectL34Flows(start, end, []uint32{1, 2})
+	r.NoError(t, err)
+	r.Contains(t, conn.queries[2], "src_identity IN (?,?) AND dest_identity IN (?,?)")
+	r.Equal(t, []any{start.UnixMicro(), end.UnixMicro(), uint32(1), uint32(2), uint32(1), uint32(2)}, conn.args[2])
+}
+
+func TestClickHouse_DropPartitions(t *testing.T) {
+	conn := newFakeChConn()
+	c := newClickHouse(conn)
+
+	conn.fixtures["FROM system.parts"] = [][]any{{"2024-01-01"}, {"2024-01-02"}, {"tuple()"}}
+	dropped, err := c.DropPartitions("t_L34", time.Date(2024, 1, 2, 12, 0, 0, 0, time.Local))
+	r.NoError(t, err)
+	r.Len(t, dropped, 1)
+	r.Equal(t, "2024-01-01", dropped[0].Name)
+	r.Equal(t, []any{"t_L34"}, conn.args[0])
+	r.Equal(t, []string{"ALTER TABLE `t_L34` DROP PARTITION '2024-01-01'"}, conn.execs)
+}
@@ -0,0 +1,42 @@
+package tracer
+
+import (
+	"strings"
+)
+
+// Endpoint Cilium 中的 endpoint，由后台任务同步到 t_Ep 小表
+type Endpoint struct {
+	Namespace string `db:"namespace"`
+	PodName   string `db:"pod_name"`
+	SvcName   string `db:"svc_name"`
+	Endpoint  uint32 `db:"endpoint"`
+	Identity  string `db:"identity"`
+	State     string `db:"state"`
+	IP        string `db:"ip"` // now supported IPv4
+}
+
+// DB
+
+// SaveEndpoints 全量更新，先清表再插入
+func (o *Olap) SaveEndpoints(endpoints []*Endpoint) error {
+	_, err := o.conn.Exec("TRUNCATE TABLE `t_Ep`")
+	if err != nil || len(endpoints) == 0 {
+		return err
+	}
+	placeholders := make([]string, 0, len(endpoints))
+	args := make([]any, 0, 7*len(endpoints))
+	for _, ep := range endpoints {
+		placeholders = append(placeholders, "(?,?,?,?,?,?,?)")
+		args = append(args, ep.Namespace, ep.PodName, ep.SvcName, ep.Endpoint, ep.Identity, ep.State, ep.IP)
+	}
+	_, err = o.conn.Exec("INSERT INTO `t_Ep` "+
+		"(namespace, "+
+		"pod_name, "+
+		"svc_name, "+
+		"endpoint, "+
+		"identity, "+
+		"state, "+
+		"ip) "+
+		"VALUES "+strings.Join(placeholders, ","), args...)
+	return err
+}
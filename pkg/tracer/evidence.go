@@ -0,0 +1,303 @@
+package tracer
+
+import (
+	"fmt"
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	"github.com/sirupsen/logrus"
+	"github.com/stleox/seeflow/pkg/config"
+	attr "go.opentelemetry.io/otel/attribute"
+	tr "go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// 用 t_L34 与 t_Sock 中的流量丰富 L7 span：
+// 时间窗口内、两端 identity 相同（任一方向）的 L34/Sock 流量，作为 span 的事件与属性。
+
+const (
+	kAttrNetDrops             = attr.Key("seeflow.net.drops")
+	kAttrNetDropReason        = attr.Key("seeflow.net.drop_reason")
+	kAttrNetObservationPoints = attr.Key("seeflow.net.observation_points")
+	kAttrTCPConnectNs         = attr.Key("seeflow.tcp.connect_ns")
+	kAttrTCPSynRetransmits    = attr.Key("seeflow.tcp.syn_retransmits")
+	kAttrSockEvents           = attr.Key("seeflow.sock.events")
+)
+
+// loadEvidence 拉取 bufPreSpan 时间窗口内的 L34 与 Sock 流量
+func (t *Tracer) loadEvidence(store Store) {
+	from, to, identities := evidenceWindow(t.bufPreSpan)
+	if len(identities) == 0 {
+		return
+	}
+	var err error
+	t.l34Evidence, err = store.SelectL34Flows(from, to, identities)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_L34")
+	}
+	t.sockEvidence, err = store.SelectSockFlows(from, to, identities)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_Sock")
+	}
+}
+
+// 所有完整 span 的时间窗口并集，以及涉及的 identity；broken span 的时间不可信，跳过
+func evidenceWindow(spans []*PreSpan) (time.Time, time.Time, []uint32) {
+	var from, to time.Time
+	seen := make(map[uint32]struct{}, 0)
+	identities := make([]uint32, 0)
+	for _, span := range spans {
+		if isBrokenSpan(span) {
+			continue
+		}
+		start := span.StartTime.Add(-config.EvidenceSlack)
+		if from.IsZero() || start.Before(from) {
+			from = start
+		}
+		if span.EndTime.After(to) {
+			to = span.EndTime
+		}
+		for _, id := range []uint32{span.SrcIdentity, span.DestIdentity} {
+			if _, hit := seen[id]; !hit {
+				seen[id] = struct{}{}
+				identities = append(identities, id)
+			}
+		}
+	}
+	return from, to, identities
+}
+
+func isBrokenSpan(span *PreSpan) bool {
+	return !span.StartTime.After(config.MinSpanTimestamp) || !span.EndTime.Before(config.MaxSpanTimestamp)
+}
+
+// 两端 identity 相同，方向不限
+func sameConnection(span *PreSpan, src uint32, dest uint32) bool {
+	return (span.SrcIdentity == src && span.DestIdentity == dest) ||
+		(span.SrcIdentity == dest && span.DestIdentity == src)
+}
+
+func inWindow(span *PreSpan, t time.Time) bool {
+	return !t.Before(span.StartTime.Add(-config.EvidenceSlack)) && !t.After(span.EndTime)
+}
+
+// evidenceOf 返回 span 时间窗口内的 L34/Sock 流量对应的属性与事件
+func (t *Tracer) evidenceOf(span *PreSpan) ([]attr.KeyValue, []evidenceEvent) {
+	if isBrokenSpan(span) || (len(t.l34Evidence) == 0 && len(t.sockEvidence) == 0) {
+		return nil, nil
+	}
+
+	attrs := make([]attr.KeyValue, 0)
+	events := make([]evidenceEvent, 0)
+
+	drops := 0
+	dropReason := ""
+	points := make([]string, 0)
+	seenPoints := make(map[string]struct{}, 0)
+	var firstSyn, firstSynAck time.Time
+	var synPoint string
+	numSyn := 0
+	for _, l34 := range t.l34Evidence {
+		if !sameConnection(span, l34.SrcIdentity, l34.DestIdentity) || !inWindow(span, l34.Time) {
+			continue
+		}
+		if l34.Verdict == flowpb.Verdict_DROPPED.String() {
+			drops++
+			if dropReason == "" {
+				dropReason = l34.DropReason
+			}
+		}
+		if _, hit := seenPoints[l34.TrafficObservation]; !hit {
+			seenPoints[l34.TrafficObservation] = struct{}{}
+			points = append(points, l34.TrafficObservation)
+		}
+
+		// 默认的 monitor aggregation 下只上报建连、断连报文，所以只能观测到 SYN 重传。
+		// 同一报文会在多个观测点上报，只统计首个看到 SYN 的观测点。
+		flags := strings.Split(l34.TCPFlags, ",")
+		if hasFlag(flags, "SYN") && synPoint == "" {
+			synPoint = l34.TrafficObservation
+		}
+		if hasFlag(flags, "SYN") && l34.TrafficObservation == synPoint {
+			if hasFlag(flags, "ACK") {
+				if firstSynAck.IsZero() {
+					firstSynAck = l34.Time
+				}
+			} else {
+				numSyn++
+				if firstSyn.IsZero() {
+					firstSyn = l34.Time
+				}
+			}
+		}
+
+		events = append(events, evidenceEvent{
+			name: "net.l34",
+			time: l34.Time,
+			attrs: []attr.KeyValue{
+				attr.String("observation_point", l34.TrafficObservation),
+				attr.String("direction", l34.TrafficDirection),
+				attr.String("verdict", l34.Verdict),
+				attr.Bool("is_reply", l34.IsReply),
+				attr.String("tcp_flags", l34.TCPFlags),
+				attr.String("drop_reason", l34.DropReason),
+			},
+		})
+	}
+
+	numSock := 0
+	for _, sock := range t.sockEvidence {
+		if !sameConnection(span, sock.SrcIdentity, sock.DestIdentity) || !inWindow(span, sock.Time) {
+			continue
+		}
+		numSock++
+		events = append(events, evidenceEvent{
+			name: "net.sock",
+			time: sock.Time,
+			attrs: []attr.KeyValue{
+				attr.Int("event_type", int(sock.EventType)),
+				attr.Int("sub_type", int(sock.SubType)),
+			},
+		})
+	}
+
+	if len(events) == 0 {
+		return nil, nil
+	}
+	attrs = append(attrs, kAttrNetDrops.Int(drops))
+	if drops != 0 {
+		attrs = append(attrs, kAttrNetDropReason.String(dropReason))
+	}
+	if len(points) != 0 {
+		attrs = append(attrs, kAttrNetObservationPoints.StringSlice(points))
+	}
+	if !firstSyn.IsZero() && firstSynAck.After(firstSyn) {
+		attrs = append(attrs, kAttrTCPConnectNs.Int64(firstSynAck.Sub(firstSyn).Nanoseconds()))
+	}
+	if numSyn > 1 {
+		attrs = append(attrs, kAttrTCPSynRetransmits.Int(numSyn-1))
+	}
+	if numSock != 0 {
+		attrs = append(attrs, kAttrSockEvents.Int(numSock))
+	}
+
+	// 事件过多时只保留最早的部分
+	if len(events) > config.MaxSpanEvents {
+		events = events[:config.MaxSpanEvents]
+	}
+	return attrs, events
+}
+
+type evidenceEvent struct {
+	name  string
+	time  time.Time
+	attrs []attr.KeyValue
+}
+
+// 添加到 span 上，需在 span.End 之前调用
+func addEvidence(span tr.Span, attrs []attr.KeyValue, events []evidenceEvent) {
+	span.SetAttributes(attrs...)
+	for _, e := range events {
+		span.AddEvent(e.name, tr.WithTimestamp(e.time), tr.WithAttributes(e.attrs...))
+	}
+}
+
+// 没有响应的请求的错误描述，有丢包时以首个丢包原因作为原因
+func noResponseStatus(attrs []attr.KeyValue) string {
+	for _, kv := range attrs {
+		if kv.Key == kAttrNetDropReason {
+			return fmt.Sprintf("no response, dropped: %s", kv.Value.AsString())
+		}
+	}
+	return "no response"
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// 将 TCP 标志位格式化为 "SYN,ACK"，非 TCP 为空
+func formatTCPFlags(flags *flowpb.TCPFlags) string {
+	if flags == nil {
+		return ""
+	}
+	names := make([]string, 0)
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{flags.GetSYN(), "SYN"},
+		{flags.GetACK(), "ACK"},
+		{flags.GetFIN(), "FIN"},
+		{flags.GetRST(), "RST"},
+		{flags.GetPSH(), "PSH"},
+		{flags.GetURG(), "URG"},
+		{flags.GetECE(), "ECE"},
+		{flags.GetCWR(), "CWR"},
+		{flags.GetNS(), "NS"},
+	} {
+		if f.set {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// 构造 "?,?,?" 与对应参数
+func inPlaceholders(identities []uint32) (string, []any) {
+	placeholders := make([]string, 0, len(identities))
+	args := make([]any, 0, len(identities))
+	for _, id := range identities {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+	return strings.Join(placeholders, ","), args
+}
+
+// SelectL34Flows 选择时间窗口内、两端都在 identities 中的 L34 流量
+func (o *Olap) SelectL34Flows(from time.Time, to time.Time, identities []uint32) ([]*L34FlowEntity, error) {
+	in, ids := inPlaceholders(identities)
+	args := append([]any{from, to}, ids...)
+	args = append(args, ids...)
+	flows := make([]*L34FlowEntity, 0)
+	// t_L34 不存储 event_type、sub_type
+	err := o.conn.QueryRowsPartial(&flows, fmt.Sprintf("SELECT "+
+		"time, "+
+		"namespace, "+
+		"src_identity, "+
+		"dest_identity, "+
+		"is_reply, "+
+		"traffic_direction, "+
+		"traffic_observation, "+
+		"verdict, "+
+		"tcp_flags, "+
+		"drop_reason "+
+		"FROM `t_L34` WHERE time BETWEEN ? AND ? "+
+		"AND src_identity IN (%s) AND dest_identity IN (%s) "+
+		"ORDER BY time", in, in), args...)
+	return flows, err
+}
+
+// SelectSockFlows 选择时间窗口内、两端都在 identities 中的 Sock 流量
+func (o *Olap) SelectSockFlows(from time.Time, to time.Time, identities []uint32) ([]*SockFlowEntity, error) {
+	in, ids := inPlaceholders(identities)
+	args := append([]any{from, to}, ids...)
+	args = append(args, ids...)
+	flows := make([]*SockFlowEntity, 0)
+	err := o.conn.QueryRows(&flows, fmt.Sprintf("SELECT "+
+		"time, "+
+		"namespace, "+
+		"src_identity, "+
+		"dest_identity, "+
+		"event_type, "+
+		"sub_type, "+
+		"cgroup_id "+
+		"FROM `t_Sock` WHERE time BETWEEN ? AND ? "+
+		"AND src_identity IN (%s) AND dest_identity IN (%s) "+
+		"ORDER BY time", in, in), args...)
+	return flows, err
+}
@@ -0,0 +1,119 @@
+package tracer
+
+import (
+	"context"
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	"github.com/stleox/seeflow/pkg/config"
+	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func TestTracer_evidenceOf(t *testing.T) {
+	defer resetMockIdentities()
+
+	tm := mockNewTracerManager()
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+	fooBar := mockPreSpan(uuid1, "foo", "bar", time.Unix(10, 0), time.Unix(20, 0))
+	foo, bar, loo := fooBar.SrcIdentity, fooBar.DestIdentity, queryPodName2Identity("loo")
+	l34 := func(at time.Time, src uint32, dest uint32, point string, verdict flowpb.Verdict, flags string) *L34FlowEntity {
+		return &L34FlowEntity{
+			Time:               at,
+			SrcIdentity:        src,
+			DestIdentity:       dest,
+			TrafficObservation: point,
+			Verdict:            verdict.String(),
+			TCPFlags:           flags,
+		}
+	}
+
+	tracer := tm.newTracer(mockTraceID())
+	tracer.bufPreSpan = append(tracer.bufPreSpan, fooBar)
+	tracer.l34Evidence = []*L34FlowEntity{
+		// SYN 重传一次，同一报文在另一观测点不重复计数
+		l34(time.Unix(10, 0), foo, bar, "TO_STACK", flowpb.Verdict_FORWARDED, "SYN"),
+		l34(time.Unix(10, 0), foo, bar, "TO_ENDPOINT", flowpb.Verdict_FORWARDED, "SYN"),
+		l34(time.Unix(11, 0), foo, bar, "TO_STACK", flowpb.Verdict_FORWARDED, "SYN"),
+		l34(time.Unix(12, 0), bar, foo, "TO_STACK", flowpb.Verdict_FORWARDED, "SYN,ACK"),
+		l34(time.Unix(15, 0), foo, bar, "TO_ENDPOINT", flowpb.Verdict_DROPPED, ""),
+		// 其它连接、窗口外的流量
+		l34(time.Unix(15, 0), foo, loo, "TO_STACK", flowpb.Verdict_DROPPED, ""),
+		l34(time.Unix(30, 0), foo, bar, "TO_STACK", flowpb.Verdict_DROPPED, ""),
+	}
+	tracer.sockEvidence = []*SockFlowEntity{
+		{Time: time.Unix(13, 0), SrcIdentity: foo, DestIdentity: bar},
+	}
+	r.NoError(t, tracer.Assemble(kAssemble_CausalAssemble, context.Background()))
+
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 1)
+	attrs := make(map[attr.Key]attr.Value, 0)
+	for _, kv := range spans[0].Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	r.Equal(t, int64(1), attrs[kAttrNetDrops].AsInt64())
+	r.Equal(t, []string{"TO_STACK", "TO_ENDPOINT"}, attrs[kAttrNetObservationPoints].AsStringSlice())
+	r.Equal(t, (2 * time.Second).Nanoseconds(), attrs[kAttrTCPConnectNs].AsInt64())
+	r.Equal(t, int64(1), attrs[kAttrTCPSynRetransmits].AsInt64())
+	r.Equal(t, int64(1), attrs[kAttrSockEvents].AsInt64())
+	r.Len(t, spans[0].Events, 6)
+}
+
+func TestTracer_evidenceWindow(t *testing.T) {
+	defer resetMockIdentities()
+
+	spans := []*PreSpan{
+		mockPreSpan(uuid1, "foo", "bar", time.Unix(10, 0), time.Unix(20, 0)),
+		mockPreSpan(uuid2, "bar", "loo", time.Unix(12, 0), time.Unix(25, 0)),
+		// broken span 不参与
+		mockPreSpan(uuid3, "loo", "zoo", config.MinSpanTimestamp, time.Unix(30, 0)),
+	}
+	from, to, identities := evidenceWindow(spans)
+	r.Equal(t, time.Unix(10, 0).Add(-config.EvidenceSlack), from)
+	r.Equal(t, time.Unix(25, 0), to)
+	r.Equal(t, []uint32{1, 2, 3}, identities)
+}
+
+func TestTracer_NoResponseStatus(t *testing.T) {
+	defer resetMockIdentities()
+
+	tm := mockNewTracerManager()
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+	fooBar := mockPreSpan(uuid1, "foo", "bar", time.Unix(10, 0), time.Unix(40, 0))
+	fooBar.NoResponse = true
+	fooLoo := mockPreSpan(uuid2, "foo", "loo", time.Unix(10, 0), time.Unix(40, 0))
+	fooLoo.NoResponse = true
+
+	tracer := tm.newTracer(mockTraceID())
+	tracer.bufPreSpan = append(tracer.bufPreSpan, fooBar, fooLoo)
+	tracer.l34Evidence = []*L34FlowEntity{{
+		Time:         time.Unix(11, 0),
+		SrcIdentity:  fooBar.SrcIdentity,
+		DestIdentity: fooBar.DestIdentity,
+		Verdict:      flowpb.Verdict_DROPPED.String(),
+		DropReason:   flowpb.DropReason_POLICY_DENIED.String(),
+	}}
+	r.NoError(t, tracer.Assemble(kAssemble_CausalAssemble, context.Background()))
+
+	status := make(map[string]sdktr.Status, 0)
+	for _, span := range exporter.GetSpans() {
+		for _, kv := range span.Attributes {
+			if kv.Key == "dest" {
+				status[kv.Value.AsString()] = span.Status
+			}
+		}
+	}
+	r.Equal(t, codes.Error, status[fooBar.DestPod].Code)
+	r.Equal(t, "no response, dropped: POLICY_DENIED", status[fooBar.DestPod].Description)
+	r.Equal(t, codes.Error, status[fooLoo.DestPod].Code)
+	r.Equal(t, "no response", status[fooLoo.DestPod].Description)
+}
@@ -2,26 +2,100 @@ package tracer
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	attr "go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+	"os"
+	"sort"
 )
 
+// 可选的 exporter 后端
+const (
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterOTLPHTTP = "otlp-http"
+	ExporterZipkin   = "zipkin"
+	ExporterStdout   = "stdout"
+	ExporterFile     = "file"
+	ExporterNone     = "none"
+)
+
+// 可选的压缩方式
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// ExporterOptions 描述 exporter 后端及其连接参数，通常来自 `--exporter*` 参数。
+type ExporterOptions struct {
+	Kind        string            // 后端类型，见 Exporter* 常量
+	Endpoint    string            // 后端地址；对于 file 是输出文件路径
+	Headers     map[string]string // 附加的请求头，比如鉴权
+	Insecure    bool              // 不使用 TLS
+	CAFile      string            // 自定义 CA 证书路径
+	Compression string            // 压缩方式，见 Compression* 常量
+	Encoding    string            // OTLP/HTTP 编码，见 Encoding* 常量
+}
+
+type exporterFactory func(ctx context.Context, opts ExporterOptions) (sdktr.SpanExporter, error)
+
+// exporter 注册表，none 不在其中，由 InitDummyExporter 处理
+var exporterRegistry = map[string]exporterFactory{
+	ExporterOTLPGRPC: newGRPCExporter,
+	ExporterOTLPHTTP: newHTTPExporter,
+	ExporterZipkin:   newZipkinExporter,
+	ExporterStdout:   newStdoutExporter,
+	ExporterFile:     newFileExporter,
+}
+
+// ExporterKinds 返回全部可选的 exporter 后端
+func ExporterKinds() []string {
+	kinds := []string{ExporterNone}
+	for kind := range exporterRegistry {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// InitExporter 按配置选择 exporter 后端
+func (tm *TracerManager) InitExporter(opts ExporterOptions) (func(context.Context) error, error) {
+	if opts.Kind == "" || opts.Kind == ExporterNone {
+		return tm.InitDummyExporter()
+	}
+	if opts.Compression != "" && opts.Compression != CompressionNone && opts.Compression != CompressionGzip {
+		return nil, fmt.Errorf("unsupported exporter compression: %s", opts.Compression)
+	}
+
+	factory, ok := exporterRegistry[opts.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown exporter: %s", opts.Kind)
+	}
+	return tm.initExporter(tm.ShutdownCtx, factory, opts.Kind, opts)
+}
+
+// InitExporter 与各 Init*Exporter 共用：由 factory 创建 exporter 并设置共用的 batcher
+func (tm *TracerManager) initExporter(shutdownCtx context.Context, factory exporterFactory, kind string, opts ExporterOptions) (func(context.Context) error, error) {
+	exporter, err := factory(shutdownCtx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating %s exporter: %w", kind, err)
+	}
+
+	return tm.initProvider(exporter), nil
+}
+
 func (tm *TracerManager) InitGRPCExporter(shutdownCtx context.Context) (func(context.Context) error, error) {
 	exporter, err := otlptracegrpc.New(shutdownCtx)
 	if err != nil {
 		return nil, fmt.Errorf("creating gRPC exporter: %w", err)
 	}
 
-	tm.tracerProvider = sdktr.NewTracerProvider(
-		sdktr.WithBatcher(exporter),
-		sdktr.WithResource(resource.Empty()))
-
-	return tm.tracerProvider.Shutdown, nil
-
+	return tm.initProvider(exporter), nil
 }
 
 func (tm *TracerManager) InitStdoutExporter() (func(context.Context) error, error) {
@@ -30,17 +104,88 @@ func (tm *TracerManager) InitStdoutExporter() (func(context.Context) error, erro
 		return nil, fmt.Errorf("creating stdout exporter: %w", err)
 	}
 
-	tm.tracerProvider = sdktr.NewTracerProvider(
-		sdktr.WithBatcher(exporter),
-		sdktr.WithResource(resource.Empty()))
-
-	return tm.tracerProvider.Shutdown, nil
+	return tm.initProvider(exporter), nil
 }
 
 // InitDummyExporter only for testing purposes
 func (tm *TracerManager) InitDummyExporter() (func(context.Context) error, error) {
-	tm.tracerProvider = sdktr.NewTracerProvider(
-		sdktr.WithResource(resource.NewSchemaless(attr.Bool("debug", true))),
-	)
-	return tm.tracerProvider.Shutdown, nil
+	tm.spanProcessor = nil
+	tm.baseResource, _ = resource.Merge(tm.baseResource, resource.NewSchemaless(attr.Bool("debug", true)))
+	return tm.shutdownProviders, nil
+}
+
+// 所有 exporter 共用的 batcher，resource 由 providerOf 按服务设置
+func (tm *TracerManager) initProvider(exporter sdktr.SpanExporter) func(context.Context) error {
+	tm.spanProcessor = sdktr.NewBatchSpanProcessor(exporter)
+	return tm.shutdownProviders
+}
+
+func newGRPCExporter(ctx context.Context, opts ExporterOptions) (sdktr.SpanExporter, error) {
+	grpcOpts := make([]otlptracegrpc.Option, 0)
+	if opts.Endpoint != "" {
+		grpcOpts = append(grpcOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+	}
+	if len(opts.Headers) != 0 {
+		grpcOpts = append(grpcOpts, otlptracegrpc.WithHeaders(opts.Headers))
+	}
+	if opts.Compression == CompressionGzip {
+		grpcOpts = append(grpcOpts, otlptracegrpc.WithCompressor(CompressionGzip))
+	}
+	switch {
+	case opts.Insecure:
+		grpcOpts = append(grpcOpts, otlptracegrpc.WithInsecure())
+	case opts.CAFile != "":
+		creds, err := credentials.NewClientTLSFromFile(opts.CAFile, "")
+		if err != nil {
+			return nil, err
+		}
+		grpcOpts = append(grpcOpts, otlptracegrpc.WithTLSCredentials(creds))
+	}
+	return otlptracegrpc.New(ctx, grpcOpts...)
+}
+
+func newStdoutExporter(_ context.Context, _ ExporterOptions) (sdktr.SpanExporter, error) {
+	return stdouttrace.New(stdouttrace.WithPrettyPrint())
+}
+
+// fileExporter 在 Shutdown 时关闭输出文件
+type fileExporter struct {
+	*stdouttrace.Exporter
+	file *os.File
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.Exporter.Shutdown(ctx)
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func newFileExporter(_ context.Context, opts ExporterOptions) (sdktr.SpanExporter, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("file exporter requires an output path as endpoint")
+	}
+	file, err := os.OpenFile(opts.Endpoint, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &fileExporter{Exporter: exporter, file: file}, nil
+}
+
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
 }
@@ -0,0 +1,239 @@
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OTLP/HTTP 可选的编码
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+const (
+	kOTLPTracesPath  = "/v1/traces"
+	kZipkinSpansPath = "/api/v2/spans"
+	kHTTPTimeout     = 10 * time.Second
+	kDefaultOTLPHTTP = "localhost:4318"
+	kDefaultZipkin   = "localhost:9411"
+)
+
+// InitHTTPExporter 使用 OTLP/HTTP 协议，编码由 opts.Encoding 决定
+func (tm *TracerManager) InitHTTPExporter(shutdownCtx context.Context, opts ExporterOptions) (func(context.Context) error, error) {
+	return tm.initExporter(shutdownCtx, newHTTPExporter, ExporterOTLPHTTP, opts)
+}
+
+// InitZipkinExporter 使用 Zipkin v2 JSON 协议
+func (tm *TracerManager) InitZipkinExporter(shutdownCtx context.Context, opts ExporterOptions) (func(context.Context) error, error) {
+	return tm.initExporter(shutdownCtx, newZipkinExporter, ExporterZipkin, opts)
+}
+
+func newHTTPExporter(ctx context.Context, opts ExporterOptions) (sdktr.SpanExporter, error) {
+	switch opts.Encoding {
+	case "", EncodingProtobuf:
+	case EncodingJSON:
+		return newJSONExporter(ctx, opts)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP/HTTP encoding: %s", opts.Encoding)
+	}
+
+	httpOpts := make([]otlptracehttp.Option, 0)
+	if opts.Endpoint != "" {
+		httpOpts = append(httpOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+	}
+	if len(opts.Headers) != 0 {
+		httpOpts = append(httpOpts, otlptracehttp.WithHeaders(opts.Headers))
+	}
+	if opts.Compression == CompressionGzip {
+		httpOpts = append(httpOpts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+	}
+	switch {
+	case opts.Insecure:
+		httpOpts = append(httpOpts, otlptracehttp.WithInsecure())
+	case opts.CAFile != "":
+		tlsCfg, err := loadTLSConfig(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		httpOpts = append(httpOpts, otlptracehttp.WithTLSClientConfig(tlsCfg))
+	}
+	return otlptracehttp.New(ctx, httpOpts...)
+}
+
+func newZipkinExporter(_ context.Context, opts ExporterOptions) (sdktr.SpanExporter, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = kDefaultZipkin
+	}
+	client, err := newHTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return zipkin.New(buildURL(endpoint, kZipkinSpansPath, opts.Insecure), zipkin.WithClient(client))
+}
+
+// jsonClient 实现 otlptrace.Client，以 OTLP/JSON 编码上报。
+// otlptracehttp 只支持 protobuf 编码，所以单独实现；请求头与 TLS 由 newHTTPClient 处理。
+type jsonClient struct {
+	url         string
+	compression string
+	client      *http.Client
+}
+
+func newJSONExporter(ctx context.Context, opts ExporterOptions) (sdktr.SpanExporter, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = kDefaultOTLPHTTP
+	}
+	client, err := newHTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return otlptrace.New(ctx, &jsonClient{
+		url:         buildURL(endpoint, kOTLPTracesPath, opts.Insecure),
+		compression: opts.Compression,
+		client:      client,
+	})
+}
+
+func (c *jsonClient) Start(_ context.Context) error {
+	return nil
+}
+
+func (c *jsonClient) Stop(_ context.Context) error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+func (c *jsonClient) UploadTraces(ctx context.Context, protoSpans []*tracepb.ResourceSpans) error {
+	body, err := marshalOTLPJSON(&coltracepb.ExportTraceServiceRequest{ResourceSpans: protoSpans})
+	if err != nil {
+		return err
+	}
+
+	if c.compression == CompressionGzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err = gz.Write(body); err != nil {
+			return err
+		}
+		if err = gz.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.compression == CompressionGzip {
+		req.Header.Set("Content-Encoding", CompressionGzip)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP/JSON export to %s failed: %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// marshalOTLPJSON
+// protojson 把 bytes 编码为 base64，而 OTLP/JSON 规定 traceId、spanId 必须是十六进制字符串，
+// 所以编码之后再转换一遍。
+func marshalOTLPJSON(req *coltracepb.ExportTraceServiceRequest) ([]byte, error) {
+	raw, err := protojson.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err = json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	hexifyIDs(doc)
+	return json.Marshal(doc)
+}
+
+func hexifyIDs(node any) {
+	switch node := node.(type) {
+	case map[string]any:
+		for k, v := range node {
+			if s, ok := v.(string); ok && (k == "traceId" || k == "spanId" || k == "parentSpanId") {
+				if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+					node[k] = hex.EncodeToString(b)
+				}
+				continue
+			}
+			hexifyIDs(v)
+		}
+	case []any:
+		for _, v := range node {
+			hexifyIDs(v)
+		}
+	}
+}
+
+// headerTransport 为每个请求附加固定请求头
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func newHTTPClient(opts ExporterOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !opts.Insecure && opts.CAFile != "" {
+		tlsCfg, err := loadTLSConfig(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsCfg
+	}
+
+	var rt http.RoundTripper = transport
+	if len(opts.Headers) != 0 {
+		rt = &headerTransport{base: transport, headers: opts.Headers}
+	}
+	return &http.Client{Transport: rt, Timeout: kHTTPTimeout}, nil
+}
+
+// 补全 scheme 与 path，已经是完整 URL 的原样返回
+func buildURL(endpoint string, path string, insecure bool) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	return scheme + "://" + endpoint + path
+}
@@ -0,0 +1,234 @@
+package tracer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stleox/seeflow/pkg/config"
+	r "github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracerManager_InitExporter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ExporterOptions
+		wantErr bool
+	}{
+		{"default", ExporterOptions{}, false},
+		{"none", ExporterOptions{Kind: ExporterNone}, false},
+		{"stdout", ExporterOptions{Kind: ExporterStdout}, false},
+		{"unknown", ExporterOptions{Kind: "jaeger"}, true},
+		{"file without path", ExporterOptions{Kind: ExporterFile}, true},
+		{"bad compression", ExporterOptions{Kind: ExporterOTLPGRPC, Compression: "zstd"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := NewTracerManager(nil)
+			shutdown, err := tm.InitExporter(tt.opts)
+			if tt.wantErr {
+				r.Error(t, err)
+				return
+			}
+			r.NoError(t, err)
+			r.NoError(t, shutdown(context.Background()))
+		})
+	}
+}
+
+func TestTracerManager_InitExporter_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	mockExport(t, ExporterOptions{Kind: ExporterFile, Endpoint: path})
+
+	content, err := os.ReadFile(path)
+	r.NoError(t, err)
+	r.Contains(t, string(content), "foo-bar")
+}
+
+// 本地 HTTP 替身，记录收到的请求
+type mockCollector struct {
+	server      *httptest.Server
+	mu          sync.Mutex
+	paths       []string
+	contentType []string
+	bodies      [][]byte
+}
+
+func newMockCollector(t *testing.T) *mockCollector {
+	c := &mockCollector{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		c.mu.Lock()
+		c.paths = append(c.paths, req.URL.Path)
+		c.contentType = append(c.contentType, req.Header.Get("Content-Type"))
+		c.bodies = append(c.bodies, body)
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+// 构造一条 foo-bar span 并经 exporter 导出
+func mockExport(t *testing.T, opts ExporterOptions) {
+	tm := NewTracerManager(nil)
+	shutdown, err := tm.InitExporter(opts)
+	r.NoError(t, err)
+
+	a := tm.newTracer(uuid1)
+	a.bufPreSpan = append(a.bufPreSpan, &PreSpan{
+		ID:        uuid1,
+		TraceID:   uuid1,
+		SrcPod:    "foo-0000000000-00000",
+		DestPod:   "bar-0000000000-00000",
+		StartTime: time.Unix(1, 0),
+		EndTime:   time.Unix(10, 0),
+	})
+	r.NoError(t, a.BasicAssemble(context.Background()))
+	r.NoError(t, shutdown(context.Background()))
+}
+
+func TestTracerManager_InitExporter_HTTPProtobuf(t *testing.T) {
+	c := newMockCollector(t)
+	mockExport(t, ExporterOptions{
+		Kind:     ExporterOTLPHTTP,
+		Endpoint: strings.TrimPrefix(c.server.URL, "http://"),
+		Insecure: true,
+	})
+
+	r.Len(t, c.bodies, 1)
+	r.Equal(t, "/v1/traces", c.paths[0])
+	r.Equal(t, "application/x-protobuf", c.contentType[0])
+	var req coltracepb.ExportTraceServiceRequest
+	r.NoError(t, proto.Unmarshal(c.bodies[0], &req))
+	r.Equal(t, "foo-bar", req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+}
+
+func TestTracerManager_InitExporter_HTTPJSON(t *testing.T) {
+	c := newMockCollector(t)
+	mockExport(t, ExporterOptions{
+		Kind:     ExporterOTLPHTTP,
+		Endpoint: strings.TrimPrefix(c.server.URL, "http://"),
+		Insecure: true,
+		Encoding: EncodingJSON,
+	})
+
+	r.Len(t, c.bodies, 1)
+	r.Equal(t, "/v1/traces", c.paths[0])
+	r.Equal(t, "application/json", c.contentType[0])
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+					Name    string `json:"name"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	r.NoError(t, json.Unmarshal(c.bodies[0], &req))
+	span := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	r.Equal(t, "foo-bar", span.Name)
+	r.Len(t, span.TraceID, 32)
+	r.Len(t, span.SpanID, 16)
+}
+
+func TestTracerManager_InitExporter_Zipkin(t *testing.T) {
+	c := newMockCollector(t)
+	mockExport(t, ExporterOptions{
+		Kind:     ExporterZipkin,
+		Endpoint: strings.TrimPrefix(c.server.URL, "http://"),
+		Insecure: true,
+		Headers:  map[string]string{"X-Scope-OrgID": "seeflow"},
+	})
+
+	r.Len(t, c.bodies, 1)
+	r.Equal(t, "/api/v2/spans", c.paths[0])
+	var spans []struct {
+		Name string `json:"name"`
+	}
+	r.NoError(t, json.Unmarshal(c.bodies[0], &spans))
+	r.Equal(t, "foo-bar", spans[0].Name)
+}
+
+func TestTracerManager_providerOf(t *testing.T) {
+	c := newMockCollector(t)
+	tm := NewTracerManager(nil)
+	tm.baseResource = newBaseResource("test-cluster")
+	shutdown, err := tm.InitExporter(ExporterOptions{
+		Kind:     ExporterOTLPHTTP,
+		Endpoint: strings.TrimPrefix(c.server.URL, "http://"),
+		Insecure: true,
+	})
+	r.NoError(t, err)
+
+	// 同一服务实例复用 provider
+	r.Same(t, tm.providerOf("demo", "bar", "bar-0"), tm.providerOf("demo", "bar", "bar-0"))
+	r.NotSame(t, tm.providerOf("demo", "bar", "bar-0"), tm.providerOf("demo", "loo", "loo-0"))
+
+	a := tm.newTracer(uuid1)
+	a.bufPreSpan = append(a.bufPreSpan, &PreSpan{
+		ID:        uuid1,
+		TraceID:   uuid1,
+		Namespace: "demo",
+		SrcPod:    "foo-0",
+		SrcSvc:    "foo",
+		DestPod:   "bar-0",
+		DestSvc:   "bar",
+		StartTime: time.Unix(1, 0),
+		EndTime:   time.Unix(10, 0),
+	})
+	r.NoError(t, a.BasicAssemble(context.Background()))
+	r.NoError(t, shutdown(context.Background()))
+
+	r.Len(t, c.bodies, 1)
+	var req coltracepb.ExportTraceServiceRequest
+	r.NoError(t, proto.Unmarshal(c.bodies[0], &req))
+	attrs := make(map[string]string)
+	for _, kv := range req.ResourceSpans[0].Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	r.Equal(t, "bar", attrs["service.name"])
+	r.Equal(t, "demo", attrs["k8s.namespace.name"])
+	r.Equal(t, "bar-0", attrs["k8s.pod.name"])
+	r.Equal(t, "test-cluster", attrs["k8s.cluster.name"])
+	r.Equal(t, config.Version, attrs["seeflow.version"])
+}
+
+func TestTracerManager_providerOfEvict(t *testing.T) {
+	defer func(n int) { config.MaxNumProvider = n }(config.MaxNumProvider)
+	config.MaxNumProvider = 2
+	tm := NewTracerManager(nil)
+
+	// 超过上限淘汰最久未使用的
+	bar := tm.providerOf("demo", "bar", "bar-0")
+	loo := tm.providerOf("demo", "loo", "loo-0")
+	r.Same(t, bar, tm.providerOf("demo", "bar", "bar-0"))
+	tm.providerOf("demo", "foo", "foo-0")
+	r.Equal(t, 2, tm.providers.Len())
+	r.NotSame(t, loo, tm.providerOf("demo", "loo", "loo-0"))
+
+	// 超过 TTL 未使用的淘汰
+	for _, entry := range tm.providers.Values() {
+		entry.usedAt = entry.usedAt.Add(-config.ProviderTTL)
+	}
+	tm.providerOf("demo", "bar", "bar-0")
+	r.Equal(t, 1, tm.providers.Len())
+
+	// 所有 span 共用同一 instrumentation scope
+	a := tm.newTracer(uuid1)
+	span := &PreSpan{Namespace: "demo", DestSvc: "bar", DestPod: "bar-0"}
+	r.Equal(t, a.tracerOf(span), a.tracerOf(span))
+	r.NoError(t, tm.shutdownProviders(context.Background()))
+	r.Zero(t, tm.providers.Len())
+}
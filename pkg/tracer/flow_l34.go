@@ -20,6 +20,8 @@ type L34FlowEntity struct {
 	TrafficDirection   string `db:"traffic_direction"`   // 区分流量方向2，一般是这两种 "INGRESS" 或 "EGRESS"。
 	TrafficObservation string `db:"traffic_observation"` // 捕获位置，@pkg/monitor/api/types.go:150
 	Verdict            string `db:"verdict"`             // 一般是这两种 "FORWARDED" 或 "DROPPED"。
+	TCPFlags           string `db:"tcp_flags"`           // TCP 标志位，比如 "SYN,ACK"，非 TCP 为空。
+	DropReason         string `db:"drop_reason"`         // 丢包原因，未丢包为 "DROP_REASON_UNKNOWN"。
 
 	EventType int8 `db:"event_type"` // 事件类型，@pkg/monitor/api/types.go:18
 	SubType   int8 `db:"sub_type"`   // 事件子类型，@pkg/monitor/api/types.go:217
@@ -47,24 +49,18 @@ func (l *L34Flow) Build(flow *observerpb.Flow) error {
 		TrafficDirection:   flow.TrafficDirection.String(),
 		TrafficObservation: flow.TraceObservationPoint.String(),
 		Verdict:            flow.Verdict.String(),
+		TCPFlags:           formatTCPFlags(flow.GetL4().GetTCP().GetFlags()),
+		DropReason:         flow.DropReasonDesc.String(),
 	}
 	return nil
 
 }
 
 func (l *L34Flow) Insert() error {
-	if l.tm.olap == nil {
+	if l.tm.store == nil {
 		return nil
 	}
-	err := l.tm.olap.l34Inserter.Insert(
-		l.Time.String()[:config.L_DATE6],
-		l.Namespace,
-		l.SrcIdentity,
-		l.DestIdentity,
-		l.IsReply,
-		l.TrafficDirection,
-		l.TrafficObservation,
-		l.Verdict)
+	err := l.tm.store.InsertL34(&l.L34FlowEntity)
 	if err != nil {
 		logrus.WithError(err).Warn("SeeFlow couldn't insert into t_L34")
 		return err
@@ -73,20 +69,22 @@ func (l *L34Flow) Insert() error {
 }
 
 func (l *L34Flow) MarkExFlow(exFlow ExFlow) {
-	o := l.tm.olap
-	if o == nil {
+	countExFlow(exFlow.reason)
+
+	if l.tm.store == nil {
 		return
 	}
-
-	o.muExL34.Lock()
-	o.arrExL34 = append(o.arrExL34, exFlow)
-	o.muExL34.Unlock()
+	l.tm.store.RecordExFlow(observerpb.FlowType_L3_L4, exFlow)
 
 }
 
 func (l *L34Flow) Consume(flow *flowpb.Flow) {
-	// 异步处理，不需要 WG 同步
-	go func() {
+	// 写入或者记为异常流量之后才算提交，检查点不越过尚未提交的 flow
+	commit := l.tm.uncommitted.begin(flow)
+
+	// 由 worker pool 异步处理，不需要 WG 同步；队列持续满时丢弃
+	accepted := l.tm.pools[observerpb.FlowType_L3_L4].Submit(func() {
+		defer commit()
 		var reason int
 		var err error
 		// 首先检查
@@ -119,27 +117,15 @@ func (l *L34Flow) Consume(flow *flowpb.Flow) {
 			flow:   flow,
 		})
 
-	}()
+	})
+	if !accepted {
+		commit()
+	}
 
 }
 
 // DB
 
-func CreateL34Table(db sqlx.SqlConn) error {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS `t_L34` " +
-		"(time DATETIME(6), " +
-		"namespace VARCHAR(127), " +
-		"src_identity BIGINT, " +
-		"dest_identity BIGINT, " +
-		"is_reply BOOLEAN, " +
-		"traffic_direction VARCHAR(15), " +
-		"traffic_observation VARCHAR(15), " +
-		"verdict VARCHAR(15)) " +
-		"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
-		"PROPERTIES (\"replication_num\" = \"1\");")
-	return err
-}
-
 func NewL34Inserter(db sqlx.SqlConn) (*sqlx.BulkInserter, error) {
 	return sqlx.NewBulkInserter(db, "INSERT INTO `t_L34` "+
 		"(time, "+
@@ -149,6 +135,22 @@ func NewL34Inserter(db sqlx.SqlConn) (*sqlx.BulkInserter, error) {
 		"is_reply, "+
 		"traffic_direction, "+
 		"traffic_observation, "+
-		"verdict) "+
-		"VALUES (?,?,?,?,?,?,?,?)")
+		"verdict, "+
+		"tcp_flags, "+
+		"drop_reason) "+
+		"VALUES (?,?,?,?,?,?,?,?,?,?)")
+}
+
+func (o *Olap) InsertL34(l *L34FlowEntity) error {
+	return o.l34Inserter.Insert(
+		l.Time.String()[:config.L_DATE6],
+		l.Namespace,
+		l.SrcIdentity,
+		l.DestIdentity,
+		l.IsReply,
+		l.TrafficDirection,
+		l.TrafficObservation,
+		l.Verdict,
+		l.TCPFlags,
+		l.DropReason)
 }
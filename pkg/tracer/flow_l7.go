@@ -12,28 +12,44 @@ import (
 
 type L7FlowEntity struct {
 	ID      string `db:"id"`       // UUID32 格式的 SpanID
-	TraceID string `db:"trace_id"` // UUID16、X-B3-Traceid 格式的 TraceID
+	TraceID string `db:"trace_id"` // 32 位十六进制的 TraceID，由 Propagator 析取
+
+	ParentSpanID string `db:"parent_span_id"` // 请求头中上游的 SpanID，16 位十六进制，缺失为空
+
+	Namespace string `db:"namespace"` // 流量相关名字空间，存在“或”逻辑
 
 	SrcIdentity uint32 `db:"src_identity"` // identity 是对服务组的编址
 	SrcPod      string `db:"src_pod"`      // pod_name 是对 pod 的编址，类似的有 endpoint
+	SrcSvc      string `db:"src_svc"`      // svc_name 用作 Resource 的 service.name
 
 	DestIdentity uint32 `db:"dest_identity"`
 	DestPod      string `db:"dest_pod"`
+	DestSvc      string `db:"dest_svc"`
 
 	StartTime time.Time `db:"start_time"` // 请求发出时间
 	EndTime   time.Time `db:"end_time"`   // 响应发出时间（不是响应被接收的时间）
 
-	// 其他字段
-	// http.method
-	// http.url
-	// http.status_code
+	// HTTP 字段，broken span 只有请求或响应一侧
+	Protocol   string `db:"protocol"`         // 比如 "HTTP/1.1"
+	Method     string `db:"http_method"`      // 来自请求
+	URL        string `db:"http_url"`         // 来自请求
+	StatusCode uint32 `db:"http_status_code"` // 来自响应，0 表示缺失
+	LatencyNs  uint64 `db:"latency_ns"`       // 来自响应，envoy 统计的请求时延
+	Headers    string `db:"http_headers"`     // 白名单内的请求头，JSON 格式
 
+	// 请求在超时或被淘汰之前没有得到响应，EndTime 是超时、淘汰的时刻
+	NoResponse bool `db:"no_response"`
 }
 
 // L7Flow 别名 Span、PreSpan。
 type L7Flow struct {
 	L7FlowEntity
 	tm *TracerManager
+
+	// 本次 Build 淘汰的流量构造的 broken span，与 L7FlowEntity 一同插入
+	broken []L7FlowEntity
+	// 本次 Build 从缓存中取出的流量，插入之后释放，见 pendingStore.Release
+	taken []*pendingFlow
 }
 
 func (l *L7Flow) Check(flow *flowpb.Flow) error {
@@ -53,143 +69,260 @@ func (l *L7Flow) Build(flow *observerpb.Flow) error {
 		return err
 	}
 
-	// 检查缓存
-	l7FlowLRU := l.tm.bufFlow
-	hitFlow, hit := l7FlowLRU.Get(xreqID)
+	// 检查缓存，命中即取出
+	wall := time.Now()
+	l.tm.bufFlow.Observe(flow, wall)
+	hitPending, hit := l.tm.bufFlow.Take(xreqID)
 	if hit {
+		l.taken = append(l.taken, hitPending)
 		// 命中，构造 span
+		hitFlow := hitPending.flow
 		spanReq, spanResp := flow, hitFlow
 		if flow.IsReply.Value {
 			spanReq, spanResp = hitFlow, flow
 		}
 
 		// TraceID 只存在于请求当中。
-		traceID, err := extractTraceID(spanReq)
+		tc, err := extractTraceContext(spanReq, l.tm.propagator)
 		if err != nil {
 			return err
 		}
+		traceID := tc.TraceID.String()
 
 		l.L7FlowEntity = L7FlowEntity{
 			ID:           xreqID,
 			TraceID:      traceID,
+			ParentSpanID: spanIDOrEmpty(tc.ParentSpanID),
+			Namespace:    extractNamespace(spanReq),
 			SrcIdentity:  spanReq.Source.Identity,
 			SrcPod:       extractPodName(spanReq.Source),
+			SrcSvc:       extractSvcName(spanReq.Source),
 			DestIdentity: spanReq.Destination.Identity,
 			DestPod:      extractPodName(spanReq.Destination),
+			DestSvc:      extractSvcName(spanReq.Destination),
 			// fixme: StartTime 好像是 envoy 接收到 src_pod 请求的时间，所以 pod 内部构造请求的事件时间会更早
 			StartTime: spanReq.Time.AsTime(),
 			// fixme: EndTime 是否涉及到 latencyNs 字段
 			EndTime: spanResp.Time.AsTime(),
 		}
 
-		// 命中后清除
-		l7FlowLRU.Remove(xreqID)
+		extractHTTPFields(&l.L7FlowEntity, spanReq, spanResp, l.tm.headerAllowList)
 
-		// 标记为活跃（暂时不标记 broken span）
-		l.tm.setActiveTraceID[traceID] = true
+		if l.tm.online != nil {
+			span := l.L7FlowEntity
+			l.tm.online.Close(&span)
+		}
 
 		return nil
 	}
 
-	// 缺失匹配项，放入缓存
-	l7FlowLRU.Add(xreqID, flow)
+	// 缺失匹配项，放入缓存，并淘汰超出 namespace 容量、已超时的流量。
+	// 超时以各流量所在节点的流量时钟计，时钟超前的节点不会提前淘汰其它节点的请求
+	evicted := append(l.tm.bufFlow.Put(xreqID, flow, flow.Time.AsTime()), l.tm.bufFlow.ExpireIdle(wall)...)
+	l.taken = append(l.taken, evicted...)
+	l.broken = l.tm.buildBrokenSpans(evicted)
+	return nil
+}
 
-	// 缓存未满，不淘汰，返回 L7 是空的
-	if l7FlowLRU.Len() < config.MaxNumFlow {
-		return nil
+// ExpireFlows 淘汰超时的流量，并写入 broken span，返回淘汰的数量。
+// 由后台任务以墙上时间 wall 调用：超时仍以流量所在节点的流量时间计，节点静默超过 RequestTimeout 后才随墙上时间推进，
+// 保证流量稀疏时缓存中的请求也能超时，而回放历史流量时不会被提前淘汰。
+func (tm *TracerManager) ExpireFlows(wall time.Time) int {
+	expired := tm.bufFlow.ExpireIdle(wall)
+	defer tm.bufFlow.Release(expired)
+	l := L7Flow{tm: tm, broken: tm.buildBrokenSpans(expired)}
+	if err := l.Insert(); err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't insert broken spans")
 	}
+	return len(l.broken)
+}
+
+// PendingStats 返回待配对流量的统计
+func (tm *TracerManager) PendingStats() PendingStats {
+	return tm.bufFlow.Stats()
+}
 
-	// 缓存满，淘汰最旧项，并为其构造 BrokenSpan
-	_, evict, _ := l7FlowLRU.RemoveOldest()
-	if evict.IsReply.Value {
+// 为被淘汰的流量构造 broken span，在线聚合下同时关闭对应节点
+func (tm *TracerManager) buildBrokenSpans(flows []*pendingFlow) []L7FlowEntity {
+	broken := make([]L7FlowEntity, 0, len(flows))
+	for _, p := range flows {
+		span, err := tm.buildBrokenSpan(p.flow, p.deadline)
+		if err != nil {
+			logrus.WithError(err).Debug("SeeFlow dropped broken span")
+			continue
+		}
+		if tm.online != nil && span.TraceID != "" {
+			closed := span
+			tm.online.Close(&closed)
+		}
+		broken = append(broken, span)
+	}
+	return broken
+}
+
+// buildBrokenSpan 为缺失匹配项的单条流量构造 broken span，请求的结束时间是 deadline
+func (tm *TracerManager) buildBrokenSpan(flow *observerpb.Flow, deadline time.Time) (L7FlowEntity, error) {
+	var span L7FlowEntity
+	if flow.IsReply.Value {
 		// 从单条响应构建
-		l.L7FlowEntity = L7FlowEntity{
+		span = L7FlowEntity{
 			ID:           flow.Uuid,
 			TraceID:      "", // 注意：空 TraceID 的记录不该写入数据库
+			Namespace:    extractNamespace(flow),
 			SrcIdentity:  config.IdentityWorld,
 			SrcPod:       config.NameWorld,
+			SrcSvc:       config.NameWorld,
 			DestIdentity: flow.Destination.Identity,
 			DestPod:      extractPodName(flow.Destination),
+			DestSvc:      extractSvcName(flow.Destination),
 			StartTime:    config.MinSpanTimestamp, // 如果是响应，其请求时间是 MinSpanTimestamp
 			EndTime:      flow.Time.AsTime(),
 		}
-	} else {
-		// 从单条请求构建
-		traceID, err := extractTraceID(flow)
-		if err != nil {
+		extractHTTPFields(&span, nil, flow, tm.headerAllowList)
+		return span, nil
+	}
+
+	// 从单条请求构建：请求没有得到响应，视为被网络丢弃，保留两端以便关联 L34 丢包
+	xreqID, err := extractXreqID(flow)
+	if err != nil {
+		return span, err
+	}
+	tc, err := extractTraceContext(flow, tm.propagator)
+	if err != nil {
+		return span, err
+	}
+	span = L7FlowEntity{
+		ID:           xreqID,
+		TraceID:      tc.TraceID.String(),
+		ParentSpanID: spanIDOrEmpty(tc.ParentSpanID),
+		Namespace:    extractNamespace(flow),
+		SrcIdentity:  flow.Source.Identity,
+		SrcPod:       extractPodName(flow.Source),
+		SrcSvc:       extractSvcName(flow.Source),
+		DestIdentity: flow.Destination.Identity,
+		DestPod:      extractPodName(flow.Destination),
+		DestSvc:      extractSvcName(flow.Destination),
+		StartTime:    flow.Time.AsTime(),
+		EndTime:      deadline, // 超时或被淘汰的时刻
+		NoResponse:   true,
+	}
+	extractHTTPFields(&span, flow, nil, tm.headerAllowList)
+	return span, nil
+}
+
+func (l *L7Flow) Insert() error {
+	if l.tm.store == nil {
+		return nil
+	}
+
+	// 缺失匹配项时没有 span；写入后再标记活跃，保证聚合时能读到
+	if l.ID != "" {
+		if err := l.tm.insertL7(&l.L7FlowEntity); err != nil {
 			return err
 		}
-
-		l.L7FlowEntity = L7FlowEntity{
-			ID:           flow.Uuid,
-			TraceID:      traceID,
-			SrcIdentity:  flow.Source.Identity,
-			SrcPod:       extractPodName(flow.Source),
-			DestIdentity: config.IdentityWorld,
-			DestPod:      config.NameWorld,
-			StartTime:    flow.Time.AsTime(),
-			EndTime:      config.MaxSpanTimestamp, // 如果是请求，其响应时间是 MaxSpanTimestamp
+		l.tm.markActiveTraceID(l.TraceID)
+	}
+	for i := range l.broken {
+		span := &l.broken[i]
+		if span.TraceID == "" {
+			continue
+		}
+		if err := l.tm.insertL7(span); err != nil {
+			return err
 		}
+		l.tm.markActiveTraceID(span.TraceID)
 	}
 	return nil
 }
 
-func (l *L7Flow) Insert() error {
-	o := l.tm.olap
-	if o == nil {
-		return nil
+func (tm *TracerManager) insertL7(l *L7FlowEntity) error {
+	err := tm.store.InsertL7(l)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't insert into t_L7")
+		return err
 	}
+	return nil
+}
 
-	err := o.l7Inserter.Insert(
+func (o *Olap) InsertL7(l *L7FlowEntity) error {
+	return o.l7Inserter.Insert(
 		l.ID,
 		l.TraceID,
+		l.ParentSpanID,
+		l.Namespace,
 		l.SrcIdentity,
+		l.SrcPod,
+		l.SrcSvc,
 		l.DestIdentity,
+		l.DestPod,
+		l.DestSvc,
 		l.StartTime,
-		l.EndTime)
-	if err != nil {
-		logrus.WithError(err).Warn("SeeFlow couldn't insert into t_L7")
-		return err
-	}
-	return nil
+		l.EndTime,
+		l.Protocol,
+		l.Method,
+		l.URL,
+		l.StatusCode,
+		l.LatencyNs,
+		l.Headers,
+		l.NoResponse)
 }
 
 func (l *L7Flow) MarkExFlow(exFlow ExFlow) {
-	o := l.tm.olap
-	if o == nil {
+	countExFlow(exFlow.reason)
+
+	if l.tm.store == nil {
 		return
 	}
-
-	o.muExL7.Lock()
-	o.arrExL7 = append(o.arrExL7, exFlow)
-	o.muExL7.Unlock()
+	l.tm.store.RecordExFlow(observerpb.FlowType_L7, exFlow)
 
 }
 
-// Consume 异步处理，且需要 WG 同步
+// Consume 异步处理，聚合前由 waitL7Consume 同步
 func (l *L7Flow) Consume(flow *flowpb.Flow) {
+	// 写入、放入缓存或者记为异常流量之后才算提交，检查点不越过尚未提交的 flow
+	commit := l.tm.uncommitted.begin(flow)
+
 	// 首先检查，保证是轻量的
 	err := l.Check(flow)
 	if err != nil {
 		l.MarkExFlow(ExFlow{kExL7Broken, err.Error(), flow})
+		commit()
 		return
 	}
 
-	// 拿到主键
-	traceID, err := extractTraceIDOrZero(flow)
+	// 拿到主键：请求、响应都携带 x-request-id，用于分片；TraceID 只在请求中
+	xreqID, err := extractXreqID(flow)
 	if err != nil {
 		l.MarkExFlow(ExFlow{kExL7Broken, err.Error(), flow})
+		commit()
 		return
 	}
+	traceID, traced := extractTraceIDOrZero(flow, l.tm.propagator)
 
-	wg, _ := l.tm.mapWgL7Consume[traceID]
-	wg.Add(1)
+	// 在线聚合下同步登记请求，保证 parent 先于 child
+	if l.tm.online != nil && !flow.GetIsReply().GetValue() {
+		l.tm.online.Open(flow)
+	}
 
-	go func() {
-		defer wg.Done()
+	// 响应中没有 TraceID，按到达顺序登记，聚合任一 Trace 前都等待此前到达的响应；
+	// span 写入后才标记所属 Trace 活跃，所以聚合不会漏掉
+	var done func()
+	if traced {
+		done = l.tm.traces.begin(traceID)
+	} else {
+		done = l.tm.traces.beginUntraced()
+	}
+
+	// 同一 x-request-id 的流量路由到同一分片串行处理，配对时不会同时缺失而重复放入缓存；
+	// 队列持续满时丢弃
+	accepted := l.tm.l7Pool.Submit(xreqID, func() {
+		defer done()
+		defer commit()
+		// 取出的流量随本条流量一同提交
+		defer func() { l.tm.bufFlow.Release(l.taken) }()
 
 		// 然后构建
-		err = l.Build(flow)
+		err := l.Build(flow)
 		if err != nil {
 			l.MarkExFlow(ExFlow{kExL7Broken, err.Error(), flow})
 			return
@@ -202,71 +335,90 @@ func (l *L7Flow) Consume(flow *flowpb.Flow) {
 			return
 		}
 
-	}()
+	})
+	if !accepted {
+		done()
+		commit()
+	}
 
 }
 
 // DB
 
-func CreateL7Table(db sqlx.SqlConn) error {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS `t_L7` " +
-		"(id CHAR(36), " + // len(UUID32)
-		"trace_id CHAR(16), " + // len(UUID16)
-		"src_identity BIGINT, " +
-		"dest_identity BIGINT, " +
-		"start_time DATETIME(6), " +
-		"end_time DATETIME(6)) " +
-		"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
-		"PROPERTIES (\"replication_num\" = \"1\");")
-	return err
-}
-
 func NewL7Inserter(db sqlx.SqlConn) (*sqlx.BulkInserter, error) {
 	return sqlx.NewBulkInserter(db, "INSERT INTO `t_L7` "+
 		"(id, "+
 		"trace_id, "+
+		"parent_span_id, "+
+		"namespace, "+
 		"src_identity, "+
+		"src_pod, "+
+		"src_svc, "+
 		"dest_identity, "+
+		"dest_pod, "+
+		"dest_svc, "+
 		"start_time, "+
-		"end_time) "+
-		"VALUES (?,?,?,?,?,?)")
+		"end_time, "+
+		"protocol, "+
+		"http_method, "+
+		"http_url, "+
+		"http_status_code, "+
+		"latency_ns, "+
+		"http_headers, "+
+		"no_response) "+
+		"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)")
 }
 
 // SelectL7Spans 选择某一 trace_id 下的全体 span
-func (o *Olap) SelectL7Spans(spans *[]*L7FlowEntity, trace_id string) {
-	err := o.conn.QueryRows(*spans, "SELECT "+
+func (o *Olap) SelectL7Spans(trace_id string) ([]*L7FlowEntity, error) {
+	spans := make([]*L7FlowEntity, 0)
+	err := o.conn.QueryRows(&spans, "SELECT "+
 		"id, "+
 		"trace_id, "+
+		"parent_span_id, "+
+		"namespace, "+
 		"src_identity, "+
-		"'', "+
+		"src_pod, "+
+		"src_svc, "+
 		"dest_identity, "+
-		"'', "+
+		"dest_pod, "+
+		"dest_svc, "+
 		"start_time, "+
-		"end_time "+
+		"end_time, "+
+		"protocol, "+
+		"http_method, "+
+		"http_url, "+
+		"http_status_code, "+
+		"latency_ns, "+
+		"http_headers, "+
+		"no_response "+
 		"FROM `t_L7` WHERE trace_id = ? "+
 		"ORDER BY start_time", trace_id)
-	if err != nil {
-		logrus.WithError(err).Warn("SeeFlow couldn't select t_L7")
-	}
+	return spans, err
+}
+
+func (o *Olap) CountL7Spans(trace_id string) (int, error) {
+	return o.countL7Spans("trace_id", trace_id)
 }
 
-// 目前允许的 filterKey: "namespace"
-func (o *Olap) countL7Spans(filterKey string, filterValue string) int {
+// 目前允许的 filterKey: "namespace"、"trace_id"
+func (o *Olap) countL7Spans(filterKey string, filterValue string) (int, error) {
 	if filterKey != "namespace" &&
 		filterKey != "trace_id" {
-		return -1
+		return -1, fmt.Errorf("unsupported filter key %s", filterKey)
 	}
 	var count int
 	err := o.conn.QueryRow(&count, fmt.Sprintf("SELECT COUNT(*) FROM `t_L7` WHERE "+
 		"%s = ?", filterKey), filterValue)
-	if err != nil {
-		logrus.WithError(err).Warn("SeeFlow couldn't select t_L7")
-	}
-	return count
+	return count, err
 }
 
 // CheckSpansCount 检查某一 namespace 下的 span 是否增加了
 // true 代表增加了
 func (o *Olap) CheckSpansCount(namespace string) bool {
-	return o.countL7Spans("namespace", namespace) != o.mapSpanCount[namespace]
+	count, err := o.countL7Spans("namespace", namespace)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_L7")
+	}
+	return count != o.GetSpanCount(namespace)
 }
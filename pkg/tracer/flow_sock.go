@@ -49,18 +49,10 @@ func (s *SockFlow) Build(flow *observerpb.Flow) error {
 }
 
 func (s *SockFlow) Insert() error {
-	o := s.tm.olap
-	if o == nil {
+	if s.tm.store == nil {
 		return nil
 	}
-	err := o.sockInserter.Insert(
-		s.Time.String()[:config.L_DATE6],
-		s.Namespace,
-		s.SrcIdentity,
-		s.DestIdentity,
-		s.EventType,
-		s.SubType,
-		s.CgroupId)
+	err := s.tm.store.InsertSock(&s.SockFlowEntity)
 	if err != nil {
 		logrus.WithError(err).Warn("SeeFlow couldn't insert into t_Sock")
 		return err
@@ -69,20 +61,22 @@ func (s *SockFlow) Insert() error {
 }
 
 func (s *SockFlow) MarkExFlow(exFlow ExFlow) {
-	o := s.tm.olap
-	if o == nil {
+	countExFlow(exFlow.reason)
+
+	if s.tm.store == nil {
 		return
 	}
-
-	o.muExSock.Lock()
-	o.arrExSock = append(o.arrExSock, exFlow)
-	o.muExSock.Unlock()
+	s.tm.store.RecordExFlow(observerpb.FlowType_SOCK, exFlow)
 
 }
 
 func (s *SockFlow) Consume(flow *flowpb.Flow) {
-	// 异步处理，不需要 WG 同步
-	go func() {
+	// 写入或者记为异常流量之后才算提交，检查点不越过尚未提交的 flow
+	commit := s.tm.uncommitted.begin(flow)
+
+	// 由 worker pool 异步处理，不需要 WG 同步；队列持续满时丢弃
+	accepted := s.tm.pools[observerpb.FlowType_SOCK].Submit(func() {
+		defer commit()
 		var reason int
 		var err error
 		// 首先检查
@@ -115,25 +109,14 @@ func (s *SockFlow) Consume(flow *flowpb.Flow) {
 			flow:   flow,
 		})
 
-	}()
+	})
+	if !accepted {
+		commit()
+	}
 }
 
 // DB
 
-func CreateSockTable(db sqlx.SqlConn) error {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS `t_Sock` " +
-		"(time DATETIME(6), " +
-		"namespace VARCHAR(127), " +
-		"src_identity BIGINT, " +
-		"dest_identity BIGINT, " +
-		"event_type TINYINT, " +
-		"sub_type TINYINT, " +
-		"cgroup_id INT) " +
-		"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
-		"PROPERTIES (\"replication_num\" = \"1\");")
-	return err
-}
-
 func NewSockInserter(db sqlx.SqlConn) (*sqlx.BulkInserter, error) {
 	return sqlx.NewBulkInserter(db, "INSERT INTO `t_Sock` "+
 		"(time, "+
@@ -145,3 +128,14 @@ func NewSockInserter(db sqlx.SqlConn) (*sqlx.BulkInserter, error) {
 		"cgroup_id) "+
 		"VALUES (?,?,?,?,?,?,?)")
 }
+
+func (o *Olap) InsertSock(s *SockFlowEntity) error {
+	return o.sockInserter.Insert(
+		s.Time.String()[:config.L_DATE6],
+		s.Namespace,
+		s.SrcIdentity,
+		s.DestIdentity,
+		s.EventType,
+		s.SubType,
+		s.CgroupId)
+}
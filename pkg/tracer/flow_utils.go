@@ -1,50 +1,47 @@
 package tracer
 
 import (
+	"encoding/json"
 	"fmt"
 	flowpb "github.com/cilium/cilium/api/v1/flow"
 	observerpb "github.com/cilium/cilium/api/v1/observer"
 	"github.com/stleox/seeflow/pkg/config"
 	tr "go.opentelemetry.io/otel/trace"
 	"strings"
+	"unicode/utf8"
 )
 
-// TraceID 选用首个非空字段，优先级顺序：`x-client-trace-ID`(128 bits) > `X-B3-Traceid`(64 bits)
-// 数据可能缺少 TraceID 字段，返回空
-func extractTraceID(flow *observerpb.Flow) (string, error) {
-	headers := flow.L7.GetHttp().Headers
-	for i := 0; i < len(headers); i++ {
-		if strings.EqualFold(headers[i].Key, "x-client-trace-ID") ||
-			strings.EqualFold(headers[i].Key, "x-b3-traceid") {
-			return headers[i].Value, nil
-		}
+// 按 propagator 的顺序析取链路上下文
+// 数据可能缺少链路上下文，返回错误
+func extractTraceContext(flow *observerpb.Flow, propagator Propagator) (TraceContext, error) {
+	tc, ok := propagator.Extract(flow.L7.GetHttp().GetHeaders())
+	if !ok {
+		return TraceContext{}, fmt.Errorf("flow#%s doesn't have TraceID in HTTP headers", flow.Uuid)
 	}
-	return "", fmt.Errorf("flow#%s doesn't have TraceID in HTTP headers", flow.Uuid)
+	return tc, nil
 }
 
 // 返回空 ID，比如在 WG 中作为键，并且不检查
-func extractTraceIDOrZero(flow *observerpb.Flow) (string, error) {
-	traceID, err := extractTraceID(flow)
-	if traceID == "" {
-		return tr.TraceID{}.String(), nil
-	}
-	return traceID, err
+func extractTraceIDOrZero(flow *observerpb.Flow, propagator Propagator) (string, bool) {
+	tc, _ := propagator.Extract(flow.L7.GetHttp().GetHeaders())
+	return tc.TraceID.String(), tc.TraceID.IsValid()
 }
 
-// convert to UUID32
-// demo input: "000000000000000a", usually extractTraceID's output.
-// demo output: "0000000000004000800000000000000a", `zero` if fail to convert.
-// https://stackoverflow.com/questions/7905929/how-to-test-valid-uuid-guid
-func convertTraceID(uuid string) tr.TraceID {
-	if len(uuid) == 16 {
-		validMiddle := "0000400080000000"
-		uuid = uuid[:8] + validMiddle + uuid[8:]
+// 空 SpanID 记为空字符串
+func spanIDOrEmpty(spanID tr.SpanID) string {
+	if !spanID.IsValid() {
+		return ""
 	}
-	traceID, err := tr.TraceIDFromHex(uuid)
+	return spanID.String()
+}
+
+// 析取 span 在请求头中携带的上游 SpanID，缺失或无效返回空
+func extractUpstreamSpanID(span *PreSpan) tr.SpanID {
+	spanID, err := tr.SpanIDFromHex(span.ParentSpanID)
 	if err != nil {
-		return tr.TraceID{}
+		return tr.SpanID{}
 	}
-	return traceID
+	return spanID
 }
 
 func extractXreqID(flow *observerpb.Flow) (string, error) {
@@ -58,6 +55,79 @@ func extractXreqID(flow *observerpb.Flow) (string, error) {
 	return "", fmt.Errorf("X-Request-Id not in HTTP headers")
 }
 
+// 析取 HTTP 字段，req 或 resp 为空时对应字段缺失（broken span）。
+// 请求头只保留 allowList 中的键（大小写不敏感），序列化为 JSON。
+func extractHTTPFields(entity *L7FlowEntity, req *observerpb.Flow, resp *observerpb.Flow, allowList []string) {
+	if req != nil {
+		reqHTTP := req.L7.GetHttp()
+		entity.Protocol = reqHTTP.GetProtocol()
+		entity.Method = reqHTTP.GetMethod()
+		entity.URL = reqHTTP.GetUrl()
+
+		headers := make(map[string]string, 0)
+		for _, h := range reqHTTP.GetHeaders() {
+			for _, allowed := range allowList {
+				if strings.EqualFold(h.Key, allowed) {
+					headers[strings.ToLower(h.Key)] = h.Value
+					break
+				}
+			}
+		}
+		entity.Headers = marshalHeaders(headers)
+	}
+	if resp != nil {
+		respHTTP := resp.L7.GetHttp()
+		entity.StatusCode = respHTTP.GetCode()
+		entity.LatencyNs = resp.L7.GetLatencyNs()
+		// 缺失请求时，从响应补全
+		if entity.Protocol == "" {
+			entity.Protocol = respHTTP.GetProtocol()
+		}
+		if entity.Method == "" {
+			entity.Method = respHTTP.GetMethod()
+		}
+		if entity.URL == "" {
+			entity.URL = respHTTP.GetUrl()
+		}
+	}
+	entity.URL = truncateUTF8(entity.URL, kMaxHTTPFieldLen)
+}
+
+// 同 t_L7 中 http_url、http_headers 的 VARCHAR(2048)，超长的值会使整批插入失败
+const kMaxHTTPFieldLen = 2048
+
+// 按字节截断，不拆开 UTF-8 字符
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// 序列化请求头，超长时依次去掉值最长的请求头，保证仍是完整的 JSON
+func marshalHeaders(headers map[string]string) string {
+	for len(headers) != 0 {
+		b, err := json.Marshal(headers)
+		if err != nil {
+			return ""
+		}
+		if len(b) <= kMaxHTTPFieldLen {
+			return string(b)
+		}
+		longest := ""
+		for k, v := range headers {
+			if longest == "" || len(v) > len(headers[longest]) || (len(v) == len(headers[longest]) && k < longest) {
+				longest = k
+			}
+		}
+		delete(headers, longest)
+	}
+	return ""
+}
+
 // convert from UUID32 to UUID16
 // demo input: "00000000-0000-0000-0000-00000000000a", usually extractXreqID's output.
 // demo output: "000000000000000a", zero if error.
@@ -0,0 +1,141 @@
+package tracer
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zeromicro/go-zero/core/stores/sqlx"
+	"time"
+)
+
+// 流水线的 Prometheus 指标，由 RegisterMetrics 注册，serve 通过 /metrics 暴露
+
+const kMetricsNamespace = "seeflow"
+
+var (
+	metricFlowsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: kMetricsNamespace,
+		Name:      "flows_received_total",
+		Help:      "Number of flows received from Hubble, by flow type.",
+	}, []string{"type"})
+
+	metricFlowsInserted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: kMetricsNamespace,
+		Name:      "flows_inserted_total",
+		Help:      "Number of rows written into OLAP, by table.",
+	}, []string{"table"})
+
+	metricExFlows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: kMetricsNamespace,
+		Name:      "exceptional_flows_total",
+		Help:      "Number of exceptional flows, by reason.",
+	}, []string{"reason"})
+
+	metricInsertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: kMetricsNamespace,
+		Name:      "olap_insert_duration_seconds",
+		Help:      "Latency of bulk inserts into OLAP, by table.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"table"})
+
+	metricTracesAssembled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: kMetricsNamespace,
+		Name:      "traces_assembled_total",
+		Help:      "Number of traces assembled.",
+	})
+
+	metricSpansExported = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: kMetricsNamespace,
+		Name:      "spans_exported_total",
+		Help:      "Number of spans handed to the span processor.",
+	})
+)
+
+// ExFlow 原因对应的指标标签
+var exReasonLabels = map[int]string{
+	kExFlowUnknownProblem: "unknown",
+	kExL34Broken:          "l34_broken",
+	kExL34NotInserted:     "l34_not_inserted",
+	kExL7Broken:           "l7_broken",
+	kExL7NotInserted:      "l7_not_inserted",
+	kExSockBroken:         "sock_broken",
+	kExSockNotInserted:    "sock_not_inserted",
+}
+
+func countExFlow(reason int) {
+	label, ok := exReasonLabels[reason]
+	if !ok {
+		label = exReasonLabels[kExFlowUnknownProblem]
+	}
+	metricExFlows.WithLabelValues(label).Inc()
+}
+
+// RegisterMetrics 注册流水线指标，以及 tm 中缓存、队列的状态
+func (tm *TracerManager) RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		metricFlowsReceived,
+		metricFlowsInserted,
+		metricExFlows,
+		metricInsertDuration,
+		metricTracesAssembled,
+		metricSpansExported,
+		&stateCollector{tm: tm},
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateCollector 在抓取时读取 tm 的状态
+type stateCollector struct {
+	tm *TracerManager
+}
+
+var (
+	descPendingFlows = prometheus.NewDesc(kMetricsNamespace+"_pending_flows",
+		"Number of unmatched requests and responses waiting to be paired.", nil, nil)
+	descPendingResults = prometheus.NewDesc(kMetricsNamespace+"_pending_flows_removed_total",
+		"Number of flows removed from the pending store, by result (matched, expired, evicted).", []string{"result"}, nil)
+	descQueueDepth = prometheus.NewDesc(kMetricsNamespace+"_consume_queue_depth",
+		"Number of flows queued for consumption, by flow type.", []string{"type"}, nil)
+	descQueueDropped = prometheus.NewDesc(kMetricsNamespace+"_consume_dropped_total",
+		"Number of flows dropped because the consume queue stayed full, by flow type.", []string{"type"}, nil)
+)
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descPendingFlows
+	ch <- descPendingResults
+	ch <- descQueueDepth
+	ch <- descQueueDropped
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	pending := c.tm.PendingStats()
+	ch <- prometheus.MustNewConstMetric(descPendingFlows, prometheus.GaugeValue, float64(pending.Pending))
+	ch <- prometheus.MustNewConstMetric(descPendingResults, prometheus.CounterValue, float64(pending.Matched), "matched")
+	ch <- prometheus.MustNewConstMetric(descPendingResults, prometheus.CounterValue, float64(pending.Expired), "expired")
+	ch <- prometheus.MustNewConstMetric(descPendingResults, prometheus.CounterValue, float64(pending.Evicted), "evicted")
+	for flowType, stats := range c.tm.ConsumeStats() {
+		ch <- prometheus.MustNewConstMetric(descQueueDepth, prometheus.GaugeValue, float64(stats.Queued), flowType)
+		ch <- prometheus.MustNewConstMetric(descQueueDropped, prometheus.CounterValue, float64(stats.Dropped), flowType)
+	}
+}
+
+// timedConn 统计 BulkInserter 每次批量写入的时延与行数
+type timedConn struct {
+	sqlx.SqlConn
+	table string
+}
+
+func (c timedConn) Exec(query string, args ...any) (sql.Result, error) {
+	start := time.Now()
+	result, err := c.SqlConn.Exec(query, args...)
+	metricInsertDuration.WithLabelValues(c.table).Observe(time.Since(start).Seconds())
+	if err == nil {
+		if rows, err := result.RowsAffected(); err == nil {
+			metricFlowsInserted.WithLabelValues(c.table).Add(float64(rows))
+		}
+	}
+	return result, err
+}
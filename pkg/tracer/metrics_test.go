@@ -0,0 +1,55 @@
+package tracer
+
+import (
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stleox/seeflow/pkg/config"
+	"strings"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func TestTracerManager_RegisterMetrics(t *testing.T) {
+	defer resetMockIdentities()
+	defer func(n int) { config.MaxNumFlow = n }(config.MaxNumFlow)
+	config.MaxNumFlow = 1024
+
+	tm := mockNewTracerManager()
+	reg := prometheus.NewRegistry()
+	r.NoError(t, tm.RegisterMetrics(reg))
+
+	received := testutil.ToFloat64(metricFlowsReceived.WithLabelValues("L7"))
+	broken := testutil.ToFloat64(metricExFlows.WithLabelValues("l7_broken"))
+
+	// 一对请求、响应，一条未配对的请求，一条缺少 HTTP 字段的异常流量
+	flows := []*observerpb.Flow{
+		mockFlow(uuid1, time.Unix(1, 0), false, "foo", "bar"),
+		mockFlow(uuid1, time.Unix(2, 0), true, "bar", "foo"),
+		mockFlow(uuid2, time.Unix(3, 0), false, "foo", "loo"),
+		{Type: observerpb.FlowType_L7, Source: &observerpb.Endpoint{}, Destination: &observerpb.Endpoint{}, L7: &observerpb.Layer7{}},
+	}
+	for _, flow := range flows {
+		flow.Type = observerpb.FlowType_L7
+		tm.ConsumeFlow(flow)
+	}
+	tm.StopConsume()
+
+	r.Equal(t, received+4, testutil.ToFloat64(metricFlowsReceived.WithLabelValues("L7")))
+	r.Equal(t, broken+1, testutil.ToFloat64(metricExFlows.WithLabelValues("l7_broken")))
+
+	expected := `
+# HELP seeflow_pending_flows Number of unmatched requests and responses waiting to be paired.
+# TYPE seeflow_pending_flows gauge
+seeflow_pending_flows 1
+# HELP seeflow_pending_flows_removed_total Number of flows removed from the pending store, by result (matched, expired, evicted).
+# TYPE seeflow_pending_flows_removed_total counter
+seeflow_pending_flows_removed_total{result="evicted"} 0
+seeflow_pending_flows_removed_total{result="expired"} 0
+seeflow_pending_flows_removed_total{result="matched"} 1
+`
+	r.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"seeflow_pending_flows", "seeflow_pending_flows_removed_total"))
+}
@@ -0,0 +1,275 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/stleox/seeflow/pkg/config"
+	"github.com/zeromicro/go-zero/core/stores/sqlx"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration 一次 schema 变更，按 Version 升序执行，全部语句执行成功后记录到 t_schema_version。
+// 失败后从第一条语句重新执行，所以除了最后一条，每条语句都必须可以重复执行；
+// RENAME、ADD COLUMN 等不能重复执行的语句单独作为一个迁移
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// MigrationStatus 数据库当前的 schema 版本与待执行的迁移
+type MigrationStatus struct {
+	Current int // 已执行的最大版本，0 表示尚未迁移
+	Latest  int // 当前 SeeFlow 支持的版本
+	Pending []Migration
+}
+
+// schemaConn 执行迁移需要的数据库操作，各后端分别实现
+type schemaConn interface {
+	// CreateVersionTable 创建 t_schema_version，只在执行迁移时调用
+	CreateVersionTable() error
+	// Versions 已执行的迁移版本，t_schema_version 不存在时为空
+	Versions() ([]int, error)
+	Exec(stmt string) error
+	RecordVersion(m Migration) error
+}
+
+// Migrator 对比 t_schema_version 与内置的迁移，执行或检查待执行的迁移
+type Migrator struct {
+	conn       schemaConn
+	migrations []Migration
+}
+
+// NewMigrator 按 SEEFLOW_OLAP_DSN 的 scheme 选择后端
+func NewMigrator(vp *viper.Viper) (*Migrator, error) {
+	dsn := olapDSN(vp)
+	switch {
+	case strings.HasPrefix(dsn, kMemoryDSN):
+		return nil, fmt.Errorf("in-memory store has no schema to migrate")
+	case strings.HasPrefix(dsn, kClickHouseDSN):
+		conn, err := openClickHouse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return newMigrator(chSchema{conn}, chMigrations), nil
+	default:
+		replicationNum := vp.GetInt("SEEFLOW_REPLICATION_NUM")
+		if replicationNum <= 0 {
+			replicationNum = config.ReplicationNum
+		}
+		return newMigrator(dorisSchema{sqlx.NewMysql(dsn), replicationNum}, expandMigrations(dorisMigrations, replicationNum, time.Now())), nil
+	}
+}
+
+// 替换迁移中的副本数，以及以 today 计算的历史分区，不修改原迁移
+func expandMigrations(migrations []Migration, replicationNum int, today time.Time) []Migration {
+	historyStart := today.AddDate(0, 0, -kDorisHistoryDays)
+	replacer := strings.NewReplacer(
+		kReplicationNum, strconv.Itoa(replicationNum),
+		kHistoryStart, historyStart.Format(time.DateOnly),
+		kHistoryPartition, historyStart.AddDate(0, 0, -1).Format(kDorisPartitionLayout))
+	expanded := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		stmts := make([]string, 0, len(migration.Statements))
+		for _, stmt := range migration.Statements {
+			stmts = append(stmts, replacer.Replace(stmt))
+		}
+		expanded = append(expanded, Migration{migration.Version, migration.Description, stmts})
+	}
+	return expanded
+}
+
+// 只读，执行迁移之前不向数据库发出 DDL
+func newMigrator(conn schemaConn, migrations []Migration) *Migrator {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{conn: conn, migrations: sorted}
+}
+
+func (m *Migrator) Status() (MigrationStatus, error) {
+	var status MigrationStatus
+	versions, err := m.conn.Versions()
+	if err != nil {
+		return status, fmt.Errorf("couldn't select t_schema_version: %w", err)
+	}
+	applied := make(map[int]struct{}, len(versions))
+	for _, v := range versions {
+		applied[v] = struct{}{}
+		if v > status.Current {
+			status.Current = v
+		}
+	}
+	status.Pending = make([]Migration, 0)
+	for _, migration := range m.migrations {
+		status.Latest = migration.Version
+		if _, hit := applied[migration.Version]; !hit {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+	return status, nil
+}
+
+// Up 按顺序执行待执行的迁移，并将语句写到 w；dryRun 时只写不执行，也不创建 t_schema_version。返回执行的迁移数量
+func (m *Migrator) Up(w io.Writer, dryRun bool) (int, error) {
+	status, err := m.Status()
+	if err != nil {
+		return 0, err
+	}
+	if status.Current > status.Latest {
+		return 0, fmt.Errorf("schema version %d is newer than %d supported by this SeeFlow", status.Current, status.Latest)
+	}
+	if !dryRun && len(status.Pending) != 0 {
+		if err := m.conn.CreateVersionTable(); err != nil {
+			return 0, fmt.Errorf("couldn't create t_schema_version: %w", err)
+		}
+	}
+	for i, migration := range status.Pending {
+		_, _ = fmt.Fprintf(w, "-- %d: %s\n", migration.Version, migration.Description)
+		for _, stmt := range migration.Statements {
+			_, _ = fmt.Fprintf(w, "%s;\n", stmt)
+			if dryRun {
+				continue
+			}
+			if err := m.conn.Exec(stmt); err != nil {
+				return i, fmt.Errorf("migration %d failed: %w", migration.Version, err)
+			}
+		}
+		if dryRun {
+			continue
+		}
+		if err := m.conn.RecordVersion(migration); err != nil {
+			return i, fmt.Errorf("couldn't record migration %d: %w", migration.Version, err)
+		}
+	}
+	if dryRun {
+		return 0, nil
+	}
+	return len(status.Pending), nil
+}
+
+// Check 启动时检查 schema 与当前 SeeFlow 是否兼容，不兼容则拒绝运行
+func (m *Migrator) Check() error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if status.Current > status.Latest {
+		return fmt.Errorf("schema version %d is newer than %d supported by this SeeFlow, upgrade SeeFlow first", status.Current, status.Latest)
+	}
+	if len(status.Pending) != 0 {
+		return fmt.Errorf("schema version %d is behind %d, run `seeflow migrate up` first", status.Current, status.Latest)
+	}
+	return nil
+}
+
+// CheckSchema 连接 SEEFLOW_OLAP_DSN 并检查 schema 版本，内存存储无需检查
+func CheckSchema(vp *viper.Viper) error {
+	if strings.HasPrefix(olapDSN(vp), kMemoryDSN) {
+		return nil
+	}
+	m, err := NewMigrator(vp)
+	if err != nil {
+		return err
+	}
+	return m.Check()
+}
+
+// Doris
+
+type dorisSchema struct {
+	conn           sqlx.SqlConn
+	replicationNum int
+}
+
+func (s dorisSchema) CreateVersionTable() error {
+	_, err := s.conn.Exec("CREATE TABLE IF NOT EXISTS `t_schema_version` " +
+		"(version INT, " +
+		"description VARCHAR(255), " +
+		"applied_at DATETIME) " +
+		"UNIQUE KEY(version) " +
+		"DISTRIBUTED BY HASH(version) BUCKETS 1 " +
+		"PROPERTIES (\"replication_num\" = \"" + strconv.Itoa(s.replicationNum) + "\")")
+	return err
+}
+
+func (s dorisSchema) Versions() ([]int, error) {
+	versions := make([]int, 0)
+	tables := make([]string, 0)
+	if err := s.conn.QueryRows(&tables, "SHOW TABLES LIKE 't_schema_version'"); err != nil || len(tables) == 0 {
+		return versions, err
+	}
+	err := s.conn.QueryRows(&versions, "SELECT version FROM `t_schema_version`")
+	return versions, err
+}
+
+func (s dorisSchema) Exec(stmt string) error {
+	_, err := s.conn.Exec(stmt)
+	return err
+}
+
+func (s dorisSchema) RecordVersion(m Migration) error {
+	_, err := s.conn.Exec("INSERT INTO `t_schema_version` "+
+		"(version, "+
+		"description, "+
+		"applied_at) "+
+		"VALUES (?,?,?)", m.Version, m.Description, time.Now())
+	return err
+}
+
+// ClickHouse
+
+type chSchema struct {
+	conn chConn
+}
+
+func (s chSchema) CreateVersionTable() error {
+	return s.conn.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS `t_schema_version` "+
+		"(version UInt32, "+
+		"description String, "+
+		"applied_at DateTime) "+
+		"ENGINE = ReplacingMergeTree "+
+		"ORDER BY version")
+}
+
+func (s chSchema) Versions() ([]int, error) {
+	versions := make([]int, 0)
+	exists, err := s.conn.Query(context.Background(), "SELECT name FROM system.tables "+
+		"WHERE database = currentDatabase() AND name = 't_schema_version'")
+	if err != nil {
+		return nil, err
+	}
+	found := exists.Next()
+	_ = exists.Close()
+	if !found {
+		return versions, nil
+	}
+	rows, err := s.conn.Query(context.Background(), "SELECT version FROM `t_schema_version` FINAL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v uint32
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, int(v))
+	}
+	return versions, rows.Err()
+}
+
+func (s chSchema) Exec(stmt string) error {
+	return s.conn.Exec(context.Background(), stmt)
+}
+
+func (s chSchema) RecordVersion(m Migration) error {
+	return sendBatch(s.conn, "INSERT INTO `t_schema_version` "+
+		"(version, "+
+		"description, "+
+		"applied_at)", [][]any{{uint32(m.Version), m.Description, time.Now()}})
+}
@@ -0,0 +1,163 @@
+package tracer
+
+import (
+	"bytes"
+	"fmt"
+	r "github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSchema 记录执行的语句与已执行的版本
+type fakeSchema struct {
+	versions []int
+	execs    []string
+	failOn   string
+	created  bool // 是否创建了 t_schema_version
+}
+
+func (s *fakeSchema) CreateVersionTable() error {
+	s.created = true
+	return nil
+}
+
+func (s *fakeSchema) Versions() ([]int, error) { return s.versions, nil }
+
+func (s *fakeSchema) Exec(stmt string) error {
+	if stmt == s.failOn {
+		return fmt.Errorf("boom")
+	}
+	s.execs = append(s.execs, stmt)
+	return nil
+}
+
+func (s *fakeSchema) RecordVersion(m Migration) error {
+	s.versions = append(s.versions, m.Version)
+	return nil
+}
+
+var testMigrations = []Migration{
+	{2, "second", []string{"ALTER 2"}},
+	{1, "first", []string{"CREATE 1a", "CREATE 1b"}},
+	{3, "third", []string{"ALTER 3"}},
+}
+
+func TestMigrator_Status(t *testing.T) {
+	m := newMigrator(&fakeSchema{versions: []int{1}}, testMigrations)
+	status, err := m.Status()
+	r.NoError(t, err)
+	r.Equal(t, 1, status.Current)
+	r.Equal(t, 3, status.Latest)
+	// 按版本升序
+	r.Len(t, status.Pending, 2)
+	r.Equal(t, 2, status.Pending[0].Version)
+	r.Equal(t, 3, status.Pending[1].Version)
+}
+
+func TestMigrator_Up(t *testing.T) {
+	conn := &fakeSchema{versions: []int{1}}
+	m := newMigrator(conn, testMigrations)
+
+	var out bytes.Buffer
+	n, err := m.Up(&out, false)
+	r.NoError(t, err)
+	r.Equal(t, 2, n)
+	r.Equal(t, []string{"ALTER 2", "ALTER 3"}, conn.execs)
+	r.Equal(t, []int{1, 2, 3}, conn.versions)
+	r.Equal(t, "-- 2: second\nALTER 2;\n-- 3: third\nALTER 3;\n", out.String())
+	r.NoError(t, m.Check())
+
+	// 已是最新，再次执行什么都不做
+	n, err = m.Up(&out, false)
+	r.NoError(t, err)
+	r.Equal(t, 0, n)
+}
+
+func TestMigrator_UpDryRun(t *testing.T) {
+	conn := &fakeSchema{}
+	m := newMigrator(conn, testMigrations)
+
+	var out bytes.Buffer
+	n, err := m.Up(&out, true)
+	r.NoError(t, err)
+	r.Equal(t, 0, n)
+	r.Empty(t, conn.execs)
+	r.Empty(t, conn.versions)
+	r.False(t, conn.created)
+	r.Contains(t, out.String(), "-- 1: first\nCREATE 1a;\nCREATE 1b;\n")
+}
+
+func TestMigrator_UpFailed(t *testing.T) {
+	conn := &fakeSchema{failOn: "ALTER 3"}
+	m := newMigrator(conn, testMigrations)
+
+	// 失败的迁移不记录版本，修复后从它重新开始
+	n, err := m.Up(&bytes.Buffer{}, false)
+	r.ErrorContains(t, err, "migration 3 failed")
+	r.Equal(t, 2, n)
+	r.Equal(t, []int{1, 2}, conn.versions)
+}
+
+func TestMigrator_Check(t *testing.T) {
+	// 检查是只读的
+	conn := &fakeSchema{versions: []int{1, 2}}
+	m := newMigrator(conn, testMigrations)
+	r.ErrorContains(t, m.Check(), "run `seeflow migrate up` first")
+	r.False(t, conn.created)
+
+	// 数据库由更新的 SeeFlow 迁移过
+	m = newMigrator(&fakeSchema{versions: []int{1, 2, 3, 4}}, testMigrations)
+	r.ErrorContains(t, m.Check(), "upgrade SeeFlow first")
+	_, err := m.Up(&bytes.Buffer{}, false)
+	r.Error(t, err)
+}
+
+func TestExpandMigrations(t *testing.T) {
+	today := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	expanded := expandMigrations(dorisMigrations, 3, today)
+	r.Len(t, expanded, len(dorisMigrations))
+	for i, migration := range expanded {
+		for j, stmt := range migration.Statements {
+			r.NotContains(t, stmt, kReplicationNum)
+			r.NotContains(t, stmt, "${")
+			if stmt != dorisMigrations[i].Statements[j] && strings.HasPrefix(stmt, "CREATE") {
+				r.Contains(t, stmt, "\"replication_num\" = \"3\"")
+			}
+		}
+	}
+	// 不修改原迁移
+	r.Contains(t, dorisMigrations[0].Statements[0], kReplicationNum)
+	r.Contains(t, expanded[6].Statements[0], "PARTITION BY RANGE(time)")
+	r.Contains(t, expanded[6].Statements[0], "\"dynamic_partition.create_history_partition\" = \"true\"")
+	// 分区后复制保留时长内的流量，t_SpanAssign 全部复制
+	for _, i := range []int{6, 8, 10, 12} {
+		migration := expanded[i]
+		r.Contains(t, expanded[i-1].Statements[0], "RENAME")
+		last := migration.Statements[len(migration.Statements)-1]
+		r.Contains(t, last, "INSERT INTO")
+		r.Contains(t, last, "_legacy`")
+	}
+	r.Contains(t, expanded[6].Statements[1], "WHERE time >= DATE_SUB(CURDATE(), INTERVAL 7 DAY)")
+	spanAssign := expanded[12].Statements
+	r.NotContains(t, spanAssign[len(spanAssign)-1], "WHERE")
+	// 早于历史分区的 span 原样放入兜底分区，不改写 UNIQUE KEY 中的 start_time
+	r.Contains(t, spanAssign[len(spanAssign)-1], "SELECT trace_id, id, start_time,")
+	r.Contains(t, strings.Join(spanAssign, ";"), "ADD PARTITION IF NOT EXISTS `p20240302` VALUES LESS THAN (\"2024-03-03\")")
+}
+
+func TestMigrations_Rerunnable(t *testing.T) {
+	// 失败后从第一条语句重新执行，除最后一条外都必须可以重复执行
+	rerunnable := []string{"CREATE TABLE IF NOT EXISTS", "ALTER TABLE `t_SpanAssign` SET", "ALTER TABLE `t_SpanAssign` ADD PARTITION IF NOT EXISTS"}
+	for _, migrations := range [][]Migration{dorisMigrations, chMigrations} {
+		for _, migration := range migrations {
+			for _, stmt := range migration.Statements[:len(migration.Statements)-1] {
+				ok := false
+				for _, prefix := range rerunnable {
+					ok = ok || strings.HasPrefix(stmt, prefix)
+				}
+				r.True(t, ok, "migration %d: %s", migration.Version, stmt)
+			}
+		}
+	}
+}
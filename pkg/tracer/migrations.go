@@ -0,0 +1,346 @@
+package tracer
+
+import "strconv"
+
+// 各后端的 schema 迁移，只允许在末尾追加，已发布的迁移不再修改。
+// 新增列时追加一个迁移，并同步修改插入与查询语句。
+
+// 副本数在执行时替换为 SEEFLOW_REPLICATION_NUM，默认 1，与替换前发布的迁移一致
+const kReplicationNum = "${replication_num}"
+
+// 迁移时保留的历史天数，与各表默认的保留时长一致
+const kDorisHistoryDays = 7
+
+// 最早的历史分区的起始日期，及其前一天的分区名，在执行时替换，见 expandMigrations
+const (
+	kHistoryStart     = "${history_start}"
+	kHistoryPartition = "${history_partition}"
+)
+
+// 按天动态分区：自动创建今天起 3 天的分区，以及此前 7 天的历史分区，用于容纳从 *_legacy 复制的流量。
+// 不设置 dynamic_partition.start，所以不自动删除，过期分区由后台任务按各表的保留时长删除。
+var kDorisDynamicPartition = "\"dynamic_partition.enable\" = \"true\", " +
+	"\"dynamic_partition.time_unit\" = \"DAY\", " +
+	"\"dynamic_partition.end\" = \"3\", " +
+	"\"dynamic_partition.prefix\" = \"p\", " +
+	"\"dynamic_partition.buckets\" = \"32\", " +
+	"\"dynamic_partition.create_history_partition\" = \"true\", " +
+	"\"dynamic_partition.history_partition_num\" = \"" + strconv.Itoa(kDorisHistoryDays) + "\""
+
+// 迁移时已创建的分区范围，从 *_legacy 复制的流量只能写入这个范围
+func inDorisPartitions(column string) string {
+	return column + " >= DATE_SUB(CURDATE(), INTERVAL " + strconv.Itoa(kDorisHistoryDays) + " DAY) " +
+		"AND " + column + " < DATE_ADD(CURDATE(), INTERVAL 4 DAY)"
+}
+
+// Doris 的迁移，版本 1 是最初发布的表结构，已部署的实例从这里升级
+var dorisMigrations = []Migration{
+	{1, "create baseline tables", []string{
+		"CREATE TABLE IF NOT EXISTS `t_L34` " +
+			"(time DATETIME(6), " +
+			"namespace VARCHAR(127), " +
+			"src_identity BIGINT, " +
+			"dest_identity BIGINT, " +
+			"is_reply BOOLEAN, " +
+			"traffic_direction VARCHAR(15), " +
+			"traffic_observation VARCHAR(15), " +
+			"verdict VARCHAR(15)) " +
+			"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\")",
+		"CREATE TABLE IF NOT EXISTS `t_L7` " +
+			"(id CHAR(36), " + // len(UUID32)
+			"trace_id CHAR(16), " +
+			"src_identity BIGINT, " +
+			"dest_identity BIGINT, " +
+			"start_time DATETIME(6), " +
+			"end_time DATETIME(6)) " +
+			"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\")",
+		"CREATE TABLE IF NOT EXISTS `t_Sock` " +
+			"(time DATETIME(6), " +
+			"namespace VARCHAR(127), " +
+			"src_identity BIGINT, " +
+			"dest_identity BIGINT, " +
+			"event_type TINYINT, " +
+			"sub_type TINYINT, " +
+			"cgroup_id INT) " +
+			"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\")",
+		"CREATE TABLE IF NOT EXISTS `t_Ep` " +
+			"(namespace VARCHAR(127), " +
+			"pod_name VARCHAR(127), " +
+			"svc_name VARCHAR(127), " +
+			"endpoint BIGINT, " +
+			"identity VARCHAR(127), " +
+			"state VARCHAR(15), " +
+			"ip VARCHAR(15)) " +
+			"DISTRIBUTED BY HASH(endpoint) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\")",
+	}},
+	{2, "add tcp_flags and drop_reason to t_L34", []string{
+		"ALTER TABLE `t_L34` ADD COLUMN " +
+			"(tcp_flags VARCHAR(63), " +
+			"drop_reason VARCHAR(63))",
+	}},
+	{3, "add trace context and HTTP fields to t_L7", []string{
+		"ALTER TABLE `t_L7` ADD COLUMN " +
+			"(parent_span_id CHAR(16), " + // len(SpanID)
+			"namespace VARCHAR(127), " +
+			"src_pod VARCHAR(127), " +
+			"src_svc VARCHAR(127), " +
+			"dest_pod VARCHAR(127), " +
+			"dest_svc VARCHAR(127), " +
+			"protocol VARCHAR(15), " +
+			"http_method VARCHAR(15), " +
+			"http_url VARCHAR(2048), " +
+			"http_status_code INT, " +
+			"latency_ns BIGINT, " +
+			"http_headers VARCHAR(2048), " +
+			"no_response BOOLEAN)",
+	}},
+	// MODIFY COLUMN 是异步的重量级 schema change，同一张表上不能并发。
+	// Doris 只支持加长 VARCHAR，所以同时由 CHAR 改为 VARCHAR
+	{4, "widen trace_id of t_L7", []string{
+		"ALTER TABLE `t_L7` MODIFY COLUMN trace_id VARCHAR(32)", // len(TraceID)
+	}},
+	{5, "create t_Ckpt and t_SpanAssign", []string{
+		// 插入即更新
+		"CREATE TABLE IF NOT EXISTS `t_Ckpt` " +
+			"(node_name VARCHAR(127), " +
+			"time_ns BIGINT, " +
+			"uuids VARCHAR(4096)) " +
+			"UNIQUE KEY(node_name) " +
+			"DISTRIBUTED BY HASH(node_name) BUCKETS 1 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\")",
+		// 重复写入同一 span 是幂等的
+		"CREATE TABLE IF NOT EXISTS `t_SpanAssign` " +
+			"(trace_id CHAR(32), " +
+			"id CHAR(36), " +
+			"span_id CHAR(16), " +
+			"dest_identity BIGINT, " +
+			"dest_pod VARCHAR(127), " +
+			"start_time DATETIME(6), " +
+			"end_time DATETIME(6)) " +
+			"UNIQUE KEY(trace_id, id) " +
+			"DISTRIBUTED BY HASH(trace_id) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\")",
+	}},
+	// Doris 不能为已有的表增加分区，原表重命名为 *_legacy，建表后复制保留时长内的流量。
+	// *_legacy 不再读写，仍保留完整的数据，确认不需要后手动删除，见 README。
+	// 重命名单独作为一个迁移，建表与复制失败后可以重新执行。
+	// 分区列必须是 key 列，key 列必须在最前，所以调整了 t_L7、t_SpanAssign 的列顺序
+	{6, "rename t_L34 to t_L34_legacy", []string{
+		"ALTER TABLE `t_L34` RENAME `t_L34_legacy`",
+	}},
+	{7, "partition t_L34 by day", []string{
+		"CREATE TABLE IF NOT EXISTS `t_L34` " +
+			"(time DATETIME(6), " +
+			"namespace VARCHAR(127), " +
+			"src_identity BIGINT, " +
+			"dest_identity BIGINT, " +
+			"is_reply BOOLEAN, " +
+			"traffic_direction VARCHAR(15), " +
+			"traffic_observation VARCHAR(15), " +
+			"verdict VARCHAR(15), " +
+			"tcp_flags VARCHAR(63), " +
+			"drop_reason VARCHAR(63)) " +
+			"DUPLICATE KEY(time) " +
+			"PARTITION BY RANGE(time) () " +
+			"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\", " + kDorisDynamicPartition + ")",
+		"INSERT INTO `t_L34` (time, namespace, src_identity, dest_identity, is_reply, traffic_direction, traffic_observation, verdict, tcp_flags, drop_reason) " +
+			"SELECT time, namespace, src_identity, dest_identity, is_reply, traffic_direction, traffic_observation, verdict, tcp_flags, drop_reason FROM `t_L34_legacy` " +
+			"WHERE " + inDorisPartitions("time"),
+	}},
+	{8, "rename t_Sock to t_Sock_legacy", []string{
+		"ALTER TABLE `t_Sock` RENAME `t_Sock_legacy`",
+	}},
+	{9, "partition t_Sock by day", []string{
+		"CREATE TABLE IF NOT EXISTS `t_Sock` " +
+			"(time DATETIME(6), " +
+			"namespace VARCHAR(127), " +
+			"src_identity BIGINT, " +
+			"dest_identity BIGINT, " +
+			"event_type TINYINT, " +
+			"sub_type TINYINT, " +
+			"cgroup_id INT) " +
+			"DUPLICATE KEY(time) " +
+			"PARTITION BY RANGE(time) () " +
+			"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\", " + kDorisDynamicPartition + ")",
+		"INSERT INTO `t_Sock` (time, namespace, src_identity, dest_identity, event_type, sub_type, cgroup_id) " +
+			"SELECT time, namespace, src_identity, dest_identity, event_type, sub_type, cgroup_id FROM `t_Sock_legacy` " +
+			"WHERE " + inDorisPartitions("time"),
+	}},
+	{10, "rename t_L7 to t_L7_legacy", []string{
+		"ALTER TABLE `t_L7` RENAME `t_L7_legacy`",
+	}},
+	{11, "partition t_L7 by day", []string{
+		"CREATE TABLE IF NOT EXISTS `t_L7` " +
+			"(start_time DATETIME(6), " +
+			"id CHAR(36), " + // len(UUID32)
+			"trace_id CHAR(32), " + // len(TraceID)
+			"parent_span_id CHAR(16), " + // len(SpanID)
+			"namespace VARCHAR(127), " +
+			"src_identity BIGINT, " +
+			"src_pod VARCHAR(127), " +
+			"src_svc VARCHAR(127), " +
+			"dest_identity BIGINT, " +
+			"dest_pod VARCHAR(127), " +
+			"dest_svc VARCHAR(127), " +
+			"end_time DATETIME(6), " +
+			"protocol VARCHAR(15), " +
+			"http_method VARCHAR(15), " +
+			"http_url VARCHAR(2048), " +
+			"http_status_code INT, " +
+			"latency_ns BIGINT, " +
+			"http_headers VARCHAR(2048), " +
+			"no_response BOOLEAN) " +
+			"DUPLICATE KEY(start_time) " +
+			"PARTITION BY RANGE(start_time) () " +
+			"DISTRIBUTED BY HASH(src_identity, dest_identity) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\", " + kDorisDynamicPartition + ")",
+		"INSERT INTO `t_L7` (start_time, id, trace_id, parent_span_id, namespace, src_identity, src_pod, src_svc, dest_identity, dest_pod, dest_svc, end_time, protocol, http_method, http_url, http_status_code, latency_ns, http_headers, no_response) " +
+			"SELECT start_time, id, trace_id, parent_span_id, namespace, src_identity, src_pod, src_svc, dest_identity, dest_pod, dest_svc, end_time, protocol, http_method, http_url, http_status_code, latency_ns, http_headers, no_response FROM `t_L7_legacy` " +
+			"WHERE " + inDorisPartitions("start_time"),
+	}},
+	{12, "rename t_SpanAssign to t_SpanAssign_legacy", []string{
+		"ALTER TABLE `t_SpanAssign` RENAME `t_SpanAssign_legacy`",
+	}},
+	// 同一 span 的 start_time 不变，加入 UNIQUE KEY 后重复写入仍是幂等的
+	{13, "partition t_SpanAssign by day", []string{
+		"CREATE TABLE IF NOT EXISTS `t_SpanAssign` " +
+			"(trace_id CHAR(32), " +
+			"id CHAR(36), " +
+			"start_time DATETIME(6), " +
+			"span_id CHAR(16), " +
+			"dest_identity BIGINT, " +
+			"dest_pod VARCHAR(127), " +
+			"end_time DATETIME(6)) " +
+			"UNIQUE KEY(trace_id, id, start_time) " +
+			"PARTITION BY RANGE(start_time) () " +
+			"DISTRIBUTED BY HASH(trace_id) BUCKETS 32 " +
+			"PROPERTIES (\"replication_num\" = \"" + kReplicationNum + "\", " + kDorisDynamicPartition + ")",
+		// 晚到的 span 依赖完整的记录，全部复制，start_time 是 UNIQUE KEY 的一部分，原样保留。
+		// 早于历史分区的记录放入一个兜底分区：按分区名视为历史分区的前一天，由后台任务按保留时长删除。
+		// 动态分区开启时不能手动增加分区，所以暂时关闭
+		"ALTER TABLE `t_SpanAssign` SET (\"dynamic_partition.enable\" = \"false\")",
+		"ALTER TABLE `t_SpanAssign` ADD PARTITION IF NOT EXISTS `" + kHistoryPartition + "` VALUES LESS THAN (\"" + kHistoryStart + "\")",
+		"ALTER TABLE `t_SpanAssign` SET (\"dynamic_partition.enable\" = \"true\")",
+		"INSERT INTO `t_SpanAssign` (trace_id, id, start_time, span_id, dest_identity, dest_pod, end_time) " +
+			"SELECT trace_id, id, start_time, span_id, dest_identity, dest_pod, end_time FROM `t_SpanAssign_legacy`",
+	}},
+	// 重启后只重放尚未提交的 flow，见 Checkpoint
+	{14, "add replay to t_Ckpt", []string{
+		"ALTER TABLE `t_Ckpt` ADD COLUMN " +
+			"(replay_ns BIGINT DEFAULT \"0\", " +
+			"replay STRING)",
+	}},
+}
+
+// ClickHouse 的迁移：MergeTree 表按天分区，排序键对应聚合时的查询条件
+var chMigrations = []Migration{
+	{1, "create tables", []string{
+		"CREATE TABLE IF NOT EXISTS `t_L34` " +
+			"(time DateTime64(6), " +
+			"namespace LowCardinality(String), " +
+			"src_identity UInt32, " +
+			"dest_identity UInt32, " +
+			"is_reply Bool, " +
+			"traffic_direction LowCardinality(String), " +
+			"traffic_observation LowCardinality(String), " +
+			"verdict LowCardinality(String), " +
+			"tcp_flags LowCardinality(String), " +
+			"drop_reason LowCardinality(String)) " +
+			"ENGINE = MergeTree " +
+			"PARTITION BY toDate(time) " +
+			"ORDER BY (src_identity, dest_identity, time)",
+		"CREATE TABLE IF NOT EXISTS `t_L7` " +
+			"(id String, " +
+			"trace_id String, " +
+			"parent_span_id String, " +
+			"namespace LowCardinality(String), " +
+			"src_identity UInt32, " +
+			"src_pod String, " +
+			"src_svc LowCardinality(String), " +
+			"dest_identity UInt32, " +
+			"dest_pod String, " +
+			"dest_svc LowCardinality(String), " +
+			"start_time DateTime64(6), " +
+			"end_time DateTime64(6), " +
+			"protocol LowCardinality(String), " +
+			"http_method LowCardinality(String), " +
+			"http_url String, " +
+			"http_status_code UInt32, " +
+			"latency_ns UInt64, " +
+			"http_headers String, " +
+			"no_response Bool) " +
+			"ENGINE = MergeTree " +
+			"PARTITION BY toDate(start_time) " +
+			"ORDER BY (trace_id, start_time)",
+		"CREATE TABLE IF NOT EXISTS `t_Sock` " +
+			"(time DateTime64(6), " +
+			"namespace LowCardinality(String), " +
+			"src_identity UInt32, " +
+			"dest_identity UInt32, " +
+			"event_type Int8, " +
+			"sub_type Int8, " +
+			"cgroup_id Int64) " +
+			"ENGINE = MergeTree " +
+			"PARTITION BY toDate(time) " +
+			"ORDER BY (src_identity, dest_identity, time)",
+		"CREATE TABLE IF NOT EXISTS `t_Ep` " +
+			"(namespace String, " +
+			"pod_name String, " +
+			"svc_name String, " +
+			"endpoint UInt32, " +
+			"identity String, " +
+			"state LowCardinality(String), " +
+			"ip String) " +
+			"ENGINE = MergeTree " +
+			"ORDER BY endpoint",
+		// 以下两张表需要插入即更新，使用 ReplacingMergeTree，查询时加 FINAL
+		"CREATE TABLE IF NOT EXISTS `t_Ckpt` " +
+			"(node_name String, " +
+			"time_ns Int64, " +
+			"uuids String) " +
+			"ENGINE = ReplacingMergeTree " +
+			"ORDER BY node_name",
+		"CREATE TABLE IF NOT EXISTS `t_SpanAssign` " +
+			"(trace_id String, " +
+			"id String, " +
+			"span_id String, " +
+			"dest_identity UInt32, " +
+			"dest_pod String, " +
+			"start_time DateTime64(6), " +
+			"end_time DateTime64(6)) " +
+			"ENGINE = ReplacingMergeTree " +
+			"ORDER BY (trace_id, id)",
+	}},
+	// 按天分区，过期分区才能由后台任务删除；同一 span 的 start_time 不变，仍在同一分区内去重。
+	// 原表重命名为 t_SpanAssign_legacy，与 Doris 一致，确认不需要后手动删除
+	{2, "partition t_SpanAssign by day", []string{
+		"CREATE TABLE IF NOT EXISTS `t_SpanAssign_partitioned` " +
+			"(trace_id String, " +
+			"id String, " +
+			"span_id String, " +
+			"dest_identity UInt32, " +
+			"dest_pod String, " +
+			"start_time DateTime64(6), " +
+			"end_time DateTime64(6)) " +
+			"ENGINE = ReplacingMergeTree " +
+			"PARTITION BY toDate(start_time) " +
+			"ORDER BY (trace_id, id)",
+		// 重新执行时重复的行在合并时去重，查询时加 FINAL
+		"INSERT INTO `t_SpanAssign_partitioned` " +
+			"SELECT trace_id, id, span_id, dest_identity, dest_pod, start_time, end_time FROM `t_SpanAssign` FINAL",
+	}},
+	{3, "replace t_SpanAssign with the partitioned table", []string{
+		"RENAME TABLE `t_SpanAssign` TO `t_SpanAssign_legacy`, `t_SpanAssign_partitioned` TO `t_SpanAssign`",
+	}},
+	{4, "add replay to t_Ckpt", []string{
+		"ALTER TABLE `t_Ckpt` " +
+			"ADD COLUMN IF NOT EXISTS replay_ns Int64, " +
+			"ADD COLUMN IF NOT EXISTS replay String",
+	}},
+}
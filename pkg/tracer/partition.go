@@ -0,0 +1,69 @@
+package tracer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Partition 按天分区的表中的一个分区，范围为 [From, To)
+type Partition struct {
+	Table string
+	Name  string
+	From  time.Time
+	To    time.Time
+}
+
+// Partitioner 按天分区的存储后端，由后台任务删除过期分区；内存存储不实现
+type Partitioner interface {
+	// DropPartitions 删除 table 中整个范围都早于 before 的分区，返回已删除的分区，按时间升序
+	DropPartitions(table string, before time.Time) ([]Partition, error)
+}
+
+// expiredPartitions 从分区名中解析日期，选出整个范围都早于 before 的分区。
+// 分区名不符合 layout 的（比如手动创建的分区、未分区的表）忽略
+func expiredPartitions(table string, names []string, layout string, before time.Time) []Partition {
+	expired := make([]Partition, 0)
+	for _, name := range names {
+		from, err := time.ParseInLocation(layout, name, time.Local)
+		if err != nil {
+			continue
+		}
+		to := from.AddDate(0, 0, 1)
+		if to.After(before) {
+			continue
+		}
+		expired = append(expired, Partition{Table: table, Name: name, From: from, To: to})
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].From.Before(expired[j].From) })
+	return expired
+}
+
+// Doris 动态分区的名字，见 kDorisDynamicPartition
+const kDorisPartitionLayout = "p20060102"
+
+// SHOW PARTITIONS 的结果中只需要分区名
+type dorisPartition struct {
+	Name string `db:"PartitionName"`
+}
+
+func (o *Olap) DropPartitions(table string, before time.Time) ([]Partition, error) {
+	rows := make([]*dorisPartition, 0)
+	err := o.conn.QueryRowsPartial(&rows, fmt.Sprintf("SHOW PARTITIONS FROM `%s`", table))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row.Name)
+	}
+
+	dropped := make([]Partition, 0)
+	for _, p := range expiredPartitions(table, names, kDorisPartitionLayout, before) {
+		if _, err := o.conn.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP PARTITION %s", table, p.Name)); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, p)
+	}
+	return dropped, nil
+}
@@ -0,0 +1,23 @@
+package tracer
+
+import (
+	r "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExpiredPartitions(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.Local) }
+	names := []string{"p20240103", "p20240101", "p20240102", "p_manual", "p20240104"}
+
+	// 1 月 3 日中午之前：1 日、2 日整个分区都已过期，3 日的分区还有未过期的部分
+	expired := expiredPartitions("t_L34", names, kDorisPartitionLayout, day(3).Add(12*time.Hour))
+	r.Equal(t, []Partition{
+		{Table: "t_L34", Name: "p20240101", From: day(1), To: day(2)},
+		{Table: "t_L34", Name: "p20240102", From: day(2), To: day(3)},
+	}, expired)
+
+	// 边界：范围 [From, To) 不包含 To
+	r.Len(t, expiredPartitions("t_L34", names, kDorisPartitionLayout, day(2)), 1)
+	r.Empty(t, expiredPartitions("t_L34", names, kDorisPartitionLayout, day(1)))
+}
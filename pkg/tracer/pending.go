@@ -0,0 +1,226 @@
+package tracer
+
+import (
+	"container/list"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pendingStore 缓存等待配对的请求、响应：
+// 等待超过 ttl 的流量由 ExpireIdle 淘汰；每个 namespace 的缓存数量有上限，超出时淘汰该 namespace 最旧的流量，
+// 避免高流量的 namespace 挤掉其它 namespace 中有效的配对。
+// 超时以流量时间计，回放历史流量时不会被墙上时间提前淘汰，见 ExpireIdle。
+type pendingStore struct {
+	ttl             time.Duration
+	maxPerNamespace int
+
+	// xreqID -> 所在 namespace 链表中的元素
+	flows map[string]*list.Element
+	// namespace -> 按放入顺序排列的 *pendingFlow
+	namespaces map[string]*list.List
+	// Hubble 节点 -> 该节点的流量时钟
+	clocks map[string]*flowClock
+	// 已取出、淘汰但尚未写入的流量，由 Release 释放；检查点不越过其中的流量
+	transit map[*pendingFlow]struct{}
+	mu      sync.Mutex
+
+	numMatched atomic.Int64
+	numExpired atomic.Int64
+	numEvicted atomic.Int64
+}
+
+// pendingFlow 被淘汰的流量
+type pendingFlow struct {
+	xreqID    string
+	namespace string
+	node      string
+	flow      *observerpb.Flow
+	// 超时的时刻；因容量被淘汰时是淘汰的时刻
+	deadline time.Time
+}
+
+// PendingStats 待配对流量的统计
+type PendingStats struct {
+	Pending int   // 当前缓存的数量
+	Matched int64 // 配对成功的数量
+	Expired int64 // 超时淘汰的数量
+	Evicted int64 // 超出容量淘汰的数量
+}
+
+func newPendingStore(ttl time.Duration, maxPerNamespace int) *pendingStore {
+	return &pendingStore{
+		ttl:             ttl,
+		maxPerNamespace: maxPerNamespace,
+		flows:           make(map[string]*list.Element, 0),
+		namespaces:      make(map[string]*list.List, 0),
+		clocks:          make(map[string]*flowClock, 0),
+		transit:         make(map[*pendingFlow]struct{}, 0),
+	}
+}
+
+// flowClock 某个 Hubble 节点最新的流量时间，及其到达时的墙上时间
+type flowClock struct {
+	flowTime time.Time
+	seenAt   time.Time
+}
+
+// at 返回墙上时间 wall 时该节点的流量时间。
+// 节点持续有流量时就是最新的流量时间；静默超过 idle 后随墙上时间推进，保证流量稀疏时请求也能超时
+func (c *flowClock) at(wall time.Time, idle time.Duration) time.Time {
+	if elapsed := wall.Sub(c.seenAt); elapsed >= idle {
+		return c.flowTime.Add(elapsed)
+	}
+	return c.flowTime
+}
+
+// Observe 以流量推进其所在节点的流量时钟，wall 是流量到达的墙上时间
+func (s *pendingStore) Observe(flow *observerpb.Flow, wall time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flowTime := flow.Time.AsTime()
+	c, hit := s.clocks[flow.NodeName]
+	if !hit {
+		c = &flowClock{flowTime: flowTime}
+		s.clocks[flow.NodeName] = c
+	}
+	if flowTime.After(c.flowTime) {
+		c.flowTime = flowTime
+	}
+	c.seenAt = wall
+}
+
+// Take 取出 xreqID 对应的流量，命中即配对成功；写入 span 之后由 Release 释放
+func (s *pendingStore) Take(xreqID string) (*pendingFlow, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, hit := s.flows[xreqID]
+	if !hit {
+		return nil, false
+	}
+	p := s.remove(e)
+	s.transit[p] = struct{}{}
+	s.numMatched.Add(1)
+	return p, true
+}
+
+// Release 释放已写入的、取出或淘汰的流量
+func (s *pendingStore) Release(flows []*pendingFlow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range flows {
+		delete(s.transit, p)
+	}
+}
+
+// collect 将尚未写入的流量加入 s：包括待配对的，以及已取出、淘汰但尚未释放的
+func (s *pendingStore) collect(u uncommittedSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.flows {
+		u.add(e.Value.(*pendingFlow).flow)
+	}
+	for p := range s.transit {
+		u.add(p.flow)
+	}
+}
+
+// Put 放入流量，返回因超出 namespace 容量被淘汰的流量
+func (s *pendingStore) Put(xreqID string, flow *observerpb.Flow, now time.Time) []*pendingFlow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, hit := s.flows[xreqID]; hit {
+		// 重复的 xreqID，保留最新的流量
+		s.remove(e)
+	}
+	namespace := extractNamespace(flow)
+	l, hit := s.namespaces[namespace]
+	if !hit {
+		l = list.New()
+		s.namespaces[namespace] = l
+	}
+	s.flows[xreqID] = l.PushBack(&pendingFlow{
+		xreqID:    xreqID,
+		namespace: namespace,
+		node:      flow.NodeName,
+		flow:      flow,
+		deadline:  flow.Time.AsTime().Add(s.ttl),
+	})
+
+	evicted := make([]*pendingFlow, 0)
+	for l.Len() > s.maxPerNamespace {
+		p := s.remove(l.Front())
+		p.deadline = now
+		s.transit[p] = struct{}{}
+		evicted = append(evicted, p)
+		s.numEvicted.Add(1)
+	}
+	return evicted
+}
+
+// ExpireIdle 以流量所在节点的流量时钟淘汰已超时的流量，wall 是当前的墙上时间。
+// 节点静默超过 ttl 时流量时钟才随墙上时间推进，所以回放历史流量时不会提前淘汰
+func (s *pendingStore) ExpireIdle(wall time.Time) []*pendingFlow {
+	return s.expire(func(p *pendingFlow) time.Time {
+		c, hit := s.clocks[p.node]
+		if !hit {
+			return wall
+		}
+		return c.at(wall, s.ttl)
+	})
+}
+
+// expire 淘汰已超时的流量，nowOf 返回判断 p 是否超时的流量时间
+func (s *pendingStore) expire(nowOf func(p *pendingFlow) time.Time) []*pendingFlow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := make([]*pendingFlow, 0)
+	for _, l := range s.namespaces {
+		// 同一 namespace 内按放入顺序近似有序，遇到未超时的即停止
+		for l.Len() != 0 {
+			p := l.Front().Value.(*pendingFlow)
+			if nowOf(p).Before(p.deadline) {
+				break
+			}
+			p = s.remove(l.Front())
+			s.transit[p] = struct{}{}
+			expired = append(expired, p)
+			s.numExpired.Add(1)
+		}
+	}
+	return expired
+}
+
+func (s *pendingStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.flows)
+}
+
+func (s *pendingStore) Stats() PendingStats {
+	return PendingStats{
+		Pending: s.Len(),
+		Matched: s.numMatched.Load(),
+		Expired: s.numExpired.Load(),
+		Evicted: s.numEvicted.Load(),
+	}
+}
+
+// 需持有锁
+func (s *pendingStore) remove(e *list.Element) *pendingFlow {
+	p := e.Value.(*pendingFlow)
+	l := s.namespaces[p.namespace]
+	l.Remove(e)
+	if l.Len() == 0 {
+		delete(s.namespaces, p.namespace)
+	}
+	delete(s.flows, p.xreqID)
+	return p
+}
@@ -0,0 +1,124 @@
+package tracer
+
+import (
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func mockNamespacedFlow(xreqID string, flowTime time.Time, namespace string) *observerpb.Flow {
+	flow := mockFlow(xreqID, flowTime, false, "foo", "bar")
+	flow.Source.Namespace = namespace
+	return flow
+}
+
+func TestPendingStore_Namespace(t *testing.T) {
+	s := newPendingStore(time.Minute, 2)
+
+	// 高流量的 namespace 只淘汰自己的流量
+	r.Empty(t, s.Put(uuid1, mockNamespacedFlow(uuid1, time.Unix(1, 0), "quiet"), time.Unix(1, 0)))
+	r.Empty(t, s.Put(uuid2, mockNamespacedFlow(uuid2, time.Unix(2, 0), "busy"), time.Unix(2, 0)))
+	r.Empty(t, s.Put(uuid3, mockNamespacedFlow(uuid3, time.Unix(3, 0), "busy"), time.Unix(3, 0)))
+	evicted := s.Put(uuid4, mockNamespacedFlow(uuid4, time.Unix(4, 0), "busy"), time.Unix(4, 0))
+	r.Len(t, evicted, 1)
+	r.Equal(t, uuid2, evicted[0].xreqID)
+	r.Equal(t, time.Unix(4, 0), evicted[0].deadline)
+
+	_, hit := s.Take(uuid1)
+	r.True(t, hit)
+	_, hit = s.Take(uuid1)
+	r.False(t, hit)
+
+	r.Equal(t, PendingStats{Pending: 2, Matched: 1, Evicted: 1}, s.Stats())
+}
+
+func TestPendingStore_Expire(t *testing.T) {
+	s := newPendingStore(10*time.Second, 1024)
+
+	wall := time.Now()
+	put := func(xreqID string, sec int64, namespace string) {
+		flow := mockNamespacedFlow(xreqID, time.Unix(sec, 0), namespace)
+		s.Observe(flow, wall)
+		s.Put(xreqID, flow, time.Unix(sec, 0))
+	}
+	put(uuid1, 1, "foo")
+	put(uuid2, 5, "bar")
+	put(uuid3, 9, "foo")
+
+	// 以节点的流量时钟淘汰
+	s.Observe(mockNamespacedFlow(uuid4, time.Unix(10, 0), "foo"), wall)
+	r.Empty(t, s.ExpireIdle(wall))
+	s.Observe(mockNamespacedFlow(uuid4, time.Unix(15, 0), "foo"), wall)
+	expired := s.ExpireIdle(wall)
+	r.Len(t, expired, 2)
+	ids := []string{expired[0].xreqID, expired[1].xreqID}
+	r.ElementsMatch(t, []string{uuid1, uuid2}, ids)
+	for _, p := range expired {
+		r.Equal(t, p.flow.Time.AsTime().Add(10*time.Second), p.deadline)
+	}
+
+	r.Equal(t, PendingStats{Pending: 1, Expired: 2}, s.Stats())
+}
+
+func TestPendingStore_ExpireIdle(t *testing.T) {
+	s := newPendingStore(10*time.Second, 1024)
+	wall := time.Now()
+
+	// 回放历史流量，后台任务同时以墙上时间运行
+	replayed := time.Unix(1, 0)
+	put := func(xreqID string, node string, flowTime time.Time, at time.Time) {
+		flow := mockNamespacedFlow(xreqID, flowTime, "foo")
+		flow.NodeName = node
+		s.Observe(flow, at)
+		s.Put(xreqID, flow, flowTime)
+	}
+	put(uuid1, "node-a", replayed, wall)
+	put(uuid2, "node-b", replayed.Add(5*time.Second), wall)
+	r.Empty(t, s.ExpireIdle(wall.Add(time.Second)))
+
+	// 节点 a 的流量时间推进到 uuid1 超时，节点 b 没有
+	put(uuid3, "node-a", replayed.Add(12*time.Second), wall.Add(2*time.Second))
+	expired := s.ExpireIdle(wall.Add(3 * time.Second))
+	r.Len(t, expired, 1)
+	r.Equal(t, uuid1, expired[0].xreqID)
+
+	// 节点 b 静默超过 ttl 后，流量时钟随墙上时间推进
+	expired = s.ExpireIdle(wall.Add(11 * time.Second))
+	r.Len(t, expired, 1)
+	r.Equal(t, uuid2, expired[0].xreqID)
+	r.Equal(t, replayed.Add(15*time.Second).UTC(), expired[0].deadline)
+	r.Equal(t, 1, s.Len())
+}
+
+func TestPendingStore_Collect(t *testing.T) {
+	s := newPendingStore(time.Minute, 1024)
+	put := func(xreqID string, node string, sec int64) {
+		flow := mockNamespacedFlow(xreqID, time.Unix(sec, 0), "foo")
+		flow.NodeName = node
+		flow.Uuid = xreqID
+		s.Put(xreqID, flow, time.Unix(sec, 0))
+	}
+	collect := func() uncommittedSet {
+		u := make(uncommittedSet, 0)
+		s.collect(u)
+		return u
+	}
+	put(uuid1, "node1", 1)
+	put(uuid2, "node1", 2)
+	put(uuid3, "node2", 3)
+	u := collect()
+	r.Equal(t, time.Unix(1, 0).UTC(), u["node1"].Oldest)
+	r.Equal(t, map[string]struct{}{uuid1: {}, uuid2: {}}, u["node1"].Uuids)
+	r.Equal(t, time.Unix(3, 0).UTC(), u["node2"].Oldest)
+
+	// 取出后、释放前仍未写入
+	p, hit := s.Take(uuid1)
+	r.True(t, hit)
+	r.Equal(t, time.Unix(1, 0).UTC(), collect()["node1"].Oldest)
+	s.Release([]*pendingFlow{p})
+	u = collect()
+	r.Equal(t, time.Unix(2, 0).UTC(), u["node1"].Oldest)
+	r.Equal(t, map[string]struct{}{uuid2: {}}, u["node1"].Uuids)
+}
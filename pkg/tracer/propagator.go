@@ -0,0 +1,215 @@
+package tracer
+
+import (
+	"context"
+	"fmt"
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	"go.opentelemetry.io/otel/propagation"
+	tr "go.opentelemetry.io/otel/trace"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 可选的链路上下文格式
+const (
+	PropagatorTraceContext   = "tracecontext"      // W3C `traceparent`、`tracestate`
+	PropagatorB3             = "b3"                // B3 单头 `b3`
+	PropagatorJaeger         = "jaeger"            // `uber-trace-id`
+	PropagatorXClientTraceID = "x-client-trace-id" // envoy 的 `x-client-trace-id`
+	PropagatorB3Multi        = "b3multi"           // B3 多头 `X-B3-Traceid`、`X-B3-Spanid`
+)
+
+// TraceContext 从请求头析取的链路上下文
+type TraceContext struct {
+	TraceID tr.TraceID
+	// 上游（调用方）的 SpanID，缺失为空。
+	// 对 traceparent 是 parent-id，对 B3 和 Jaeger 是 span-id，二者都指调用方发出请求的 span。
+	ParentSpanID tr.SpanID
+	Sampled      bool
+	TraceState   string // 仅 W3C
+}
+
+// Propagator 从请求头析取链路上下文，请求头中没有该格式时返回 false
+type Propagator interface {
+	Extract(headers []*flowpb.HTTPHeader) (TraceContext, bool)
+}
+
+type propagatorFunc func(headers []*flowpb.HTTPHeader) (TraceContext, bool)
+
+func (f propagatorFunc) Extract(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	return f(headers)
+}
+
+// propagator 注册表
+var propagatorRegistry = map[string]Propagator{
+	PropagatorTraceContext:   propagatorFunc(extractW3C),
+	PropagatorB3:             propagatorFunc(extractB3Single),
+	PropagatorJaeger:         propagatorFunc(extractJaeger),
+	PropagatorXClientTraceID: propagatorFunc(extractXClientTraceID),
+	PropagatorB3Multi:        propagatorFunc(extractB3Multi),
+}
+
+// PropagatorChain 依次尝试各个 Propagator，选用首个析取成功的
+type PropagatorChain []Propagator
+
+func (c PropagatorChain) Extract(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	for _, p := range c {
+		if tc, ok := p.Extract(headers); ok {
+			return tc, true
+		}
+	}
+	return TraceContext{}, false
+}
+
+// NewPropagatorChain 按名称顺序构造 PropagatorChain，名称见 Propagator* 常量
+func NewPropagatorChain(names []string) (PropagatorChain, error) {
+	chain := make(PropagatorChain, 0, len(names))
+	for _, name := range names {
+		p, ok := propagatorRegistry[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown propagator: %s", name)
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+// 大小写不敏感地查找请求头，缺失返回空
+func lookupHeader(headers []*flowpb.HTTPHeader, key string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Key, key) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// flowpb.HTTPHeader 到 OTel TextMapCarrier 的适配，只读
+type headerCarrier []*flowpb.HTTPHeader
+
+func (c headerCarrier) Get(key string) string {
+	return lookupHeader(c, key)
+}
+
+func (c headerCarrier) Set(string, string) {}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for _, h := range c {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// W3C Trace Context，解析交给 OTel
+func extractW3C(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), headerCarrier(headers))
+	sc := tr.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return TraceContext{}, false
+	}
+	return TraceContext{
+		TraceID:      sc.TraceID(),
+		ParentSpanID: sc.SpanID(),
+		Sampled:      sc.IsSampled(),
+		TraceState:   sc.TraceState().String(),
+	}, true
+}
+
+// B3 单头：{TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}，后两段可选；
+// 只有 SamplingState 的 "0"、"1"、"d" 不携带 TraceID，视为缺失。
+func extractB3Single(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	parts := strings.Split(lookupHeader(headers, "b3"), "-")
+	if len(parts) < 2 {
+		return TraceContext{}, false
+	}
+	traceID, ok := parseTraceID(parts[0])
+	if !ok {
+		return TraceContext{}, false
+	}
+	spanID, err := tr.SpanIDFromHex(parts[1])
+	if err != nil {
+		return TraceContext{}, false
+	}
+	tc := TraceContext{TraceID: traceID, ParentSpanID: spanID, Sampled: true}
+	if len(parts) > 2 {
+		tc.Sampled = parts[2] == "1" || parts[2] == "d"
+	}
+	return tc, true
+}
+
+// B3 多头：X-B3-Traceid、X-B3-Spanid、X-B3-Sampled，缺失 X-B3-Sampled 时视为采样
+func extractB3Multi(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	traceID, ok := parseTraceID(lookupHeader(headers, "x-b3-traceid"))
+	if !ok {
+		return TraceContext{}, false
+	}
+	tc := TraceContext{TraceID: traceID, Sampled: true}
+	if spanID, err := tr.SpanIDFromHex(lookupHeader(headers, "x-b3-spanid")); err == nil {
+		tc.ParentSpanID = spanID
+	}
+	switch lookupHeader(headers, "x-b3-sampled") {
+	case "0", "false":
+		tc.Sampled = false
+	}
+	if lookupHeader(headers, "x-b3-flags") == "1" {
+		tc.Sampled = true
+	}
+	return tc, true
+}
+
+// Jaeger：{trace-id}:{span-id}:{parent-span-id}:{flags}，可能被 URL 编码，ID 可能省略前导零
+func extractJaeger(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	value := lookupHeader(headers, "uber-trace-id")
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		value = unescaped
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 {
+		return TraceContext{}, false
+	}
+	traceID, ok := parseTraceID(parts[0])
+	if !ok {
+		return TraceContext{}, false
+	}
+	tc := TraceContext{TraceID: traceID}
+	if spanID, err := tr.SpanIDFromHex(leftPad(parts[1], 16)); err == nil {
+		tc.ParentSpanID = spanID
+	}
+	if flags, err := strconv.ParseUint(parts[3], 16, 8); err == nil {
+		tc.Sampled = flags&1 == 1
+	}
+	return tc, true
+}
+
+// envoy 的 x-client-trace-id，通常是 UUID，只有 TraceID
+func extractXClientTraceID(headers []*flowpb.HTTPHeader) (TraceContext, bool) {
+	traceID, ok := parseTraceID(lookupHeader(headers, "x-client-trace-id"))
+	if !ok {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: traceID, Sampled: true}, true
+}
+
+// parseTraceID 解析 128 或 64 位的十六进制 TraceID，允许 UUID 的连字符与省略的前导零。
+// 64 位 TraceID 与 B3、OTel 互通时一样左补零，比如 "000000000000000a" -> "0000000000000000000000000000000a"，
+// 与应用自己上报的 span 属于同一 Trace
+func parseTraceID(s string) (tr.TraceID, bool) {
+	s = strings.ToLower(strings.ReplaceAll(s, "-", ""))
+	if strings.Trim(s, "0") == "" || len(s) > 32 {
+		return tr.TraceID{}, false
+	}
+	traceID, err := tr.TraceIDFromHex(leftPad(s, 32))
+	if err != nil {
+		return tr.TraceID{}, false
+	}
+	return traceID, true
+}
+
+func leftPad(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+	return strings.Repeat("0", n-len(s)) + s
+}
@@ -0,0 +1,142 @@
+package tracer
+
+import (
+	flowpb "github.com/cilium/cilium/api/v1/flow"
+	"github.com/stleox/seeflow/pkg/config"
+	r "github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPropagatorChain_Extract(t *testing.T) {
+	chain, err := NewPropagatorChain(config.Propagators)
+	r.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantOK     bool
+		wantTrace  string
+		wantParent string
+		wantSample bool
+	}{
+		{
+			name: "traceparent",
+			headers: map[string]string{
+				"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				"tracestate":  "congo=t61rcWkgMzE",
+			},
+			wantOK:     true,
+			wantTrace:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantParent: "00f067aa0ba902b7",
+			wantSample: true,
+		},
+		{
+			name:       "b3 single",
+			headers:    map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"},
+			wantOK:     true,
+			wantTrace:  "80f198ee56343ba864fe8b2a57d3eff7",
+			wantParent: "e457b5a2e4d86bd1",
+			wantSample: true,
+		},
+		{
+			name:       "b3 single 64 bits not sampled",
+			headers:    map[string]string{"b3": "000000000000000a-e457b5a2e4d86bd1-0"},
+			wantOK:     true,
+			wantTrace:  "0000000000000000000000000000000a",
+			wantParent: "e457b5a2e4d86bd1",
+			wantSample: false,
+		},
+		{
+			name:    "b3 single sampling only",
+			headers: map[string]string{"b3": "0"},
+			wantOK:  false,
+		},
+		{
+			name:       "jaeger url encoded",
+			headers:    map[string]string{"uber-trace-id": "abc%3A1f%3A0%3A1"},
+			wantOK:     true,
+			wantTrace:  "00000000000000000000000000000abc",
+			wantParent: "000000000000001f",
+			wantSample: true,
+		},
+		{
+			name:       "x-client-trace-id uuid",
+			headers:    map[string]string{"X-Client-Trace-ID": "00000000-0000-0000-0000-000000000001"},
+			wantOK:     true,
+			wantTrace:  "00000000000000000000000000000001",
+			wantSample: true,
+		},
+		{
+			name: "x-client-trace-id before b3 multi",
+			headers: map[string]string{
+				"X-B3-Traceid":      "000000000000000a",
+				"X-Client-Trace-ID": "0000000000000000000000000000000b",
+			},
+			wantOK:     true,
+			wantTrace:  "0000000000000000000000000000000b",
+			wantSample: true,
+		},
+		{
+			name: "b3 multi",
+			headers: map[string]string{
+				"X-B3-Traceid": "000000000000000a",
+				"X-B3-Spanid":  "e457b5a2e4d86bd1",
+				"X-B3-Sampled": "0",
+			},
+			wantOK:     true,
+			wantTrace:  "0000000000000000000000000000000a",
+			wantParent: "e457b5a2e4d86bd1",
+			wantSample: false,
+		},
+		{
+			name: "b3 multi debug",
+			headers: map[string]string{
+				"X-B3-Traceid": "000000000000000a",
+				"X-B3-Sampled": "0",
+				"X-B3-Flags":   "1",
+			},
+			wantOK:     true,
+			wantTrace:  "0000000000000000000000000000000a",
+			wantSample: true,
+		},
+		{
+			name:       "jaeger not sampled",
+			headers:    map[string]string{"uber-trace-id": "abc:1f:0:0"},
+			wantOK:     true,
+			wantTrace:  "00000000000000000000000000000abc",
+			wantParent: "000000000000001f",
+			wantSample: false,
+		},
+		{
+			name:    "zero trace id",
+			headers: map[string]string{"X-B3-Traceid": "0000000000000000"},
+			wantOK:  false,
+		},
+		{
+			name:    "missing",
+			headers: map[string]string{"X-Request-Id": "00000000-0000-0000-0000-000000000001"},
+			wantOK:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make([]*flowpb.HTTPHeader, 0)
+			for k, v := range tt.headers {
+				headers = append(headers, &flowpb.HTTPHeader{Key: k, Value: v})
+			}
+			tc, ok := chain.Extract(headers)
+			r.Equal(t, tt.wantOK, ok)
+			if !ok {
+				return
+			}
+			r.Equal(t, tt.wantTrace, tc.TraceID.String())
+			r.Equal(t, tt.wantParent, spanIDOrEmpty(tc.ParentSpanID))
+			r.Equal(t, tt.wantSample, tc.Sampled)
+		})
+	}
+}
+
+func TestNewPropagatorChain_Unknown(t *testing.T) {
+	_, err := NewPropagatorChain([]string{"tracecontext", "foo"})
+	r.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package tracer
+
+import (
+	"context"
+	"errors"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/stleox/seeflow/pkg/config"
+	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"time"
+)
+
+// OTel 的 Resource 属于 TracerProvider，而 SeeFlow 代替所有服务生成 span，
+// 所以为每个服务实例（namespace/svc/pod）维护一个 TracerProvider，共用同一个 SpanProcessor。
+
+const kAttrSeeFlowVersion = attr.Key("seeflow.version")
+
+// 基础 Resource：集群名、SeeFlow 版本
+func newBaseResource(clusterName string) *resource.Resource {
+	attrs := []attr.KeyValue{kAttrSeeFlowVersion.String(config.Version)}
+	if clusterName != "" {
+		attrs = append(attrs, semconv.K8SClusterName(clusterName))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
+// 服务实例 Resource：service.name、k8s.namespace.name、k8s.pod.name
+func newServiceResource(base *resource.Resource, namespace string, svcName string, podName string) *resource.Resource {
+	attrs := []attr.KeyValue{semconv.ServiceName(svcName)}
+	if namespace != "" && namespace != config.NameUnknown {
+		attrs = append(attrs, semconv.ServiceNamespace(namespace), semconv.K8SNamespaceName(namespace))
+	}
+	if podName != "" && podName != config.NameUnknown && podName != config.NameWorld {
+		attrs = append(attrs, semconv.K8SPodName(podName), semconv.ServiceInstanceID(podName))
+	}
+	// 同一 SchemaURL 下合并不会出错
+	res, _ := resource.Merge(base, resource.NewWithAttributes(semconv.SchemaURL, attrs...))
+	return res
+}
+
+// 缓存的 TracerProvider 及其最近使用时间
+type providerEntry struct {
+	provider *sdktr.TracerProvider
+	usedAt   time.Time
+}
+
+// 缓存 TracerProvider 的上限，pod 频繁变更时避免无限增长
+func newProviderCache() *lru.Cache[string, *providerEntry] {
+	providers, _ := lru.New[string, *providerEntry](config.MaxNumProvider)
+	return providers
+}
+
+// providerOf 返回服务实例对应的 TracerProvider，缺失则新建。
+// 超过上限或 config.ProviderTTL 未使用的 provider 从缓存中淘汰；
+// 淘汰时不关闭，关闭 provider 会同时关闭共用的 SpanProcessor，而已结束的 span 已经交给了 SpanProcessor。
+func (tm *TracerManager) providerOf(namespace string, svcName string, podName string) *sdktr.TracerProvider {
+	if svcName == "" {
+		svcName = config.NameUnknown
+	}
+	key := namespace + "/" + svcName + "/" + podName
+	now := time.Now()
+
+	tm.muProviders.Lock()
+	defer tm.muProviders.Unlock()
+
+	// LRU 的尾部最久未使用，依次淘汰过期的
+	for {
+		_, oldest, ok := tm.providers.GetOldest()
+		if !ok || now.Sub(oldest.usedAt) < config.ProviderTTL {
+			break
+		}
+		tm.providers.RemoveOldest()
+	}
+
+	if entry, hit := tm.providers.Get(key); hit {
+		entry.usedAt = now
+		return entry.provider
+	}
+
+	opts := []sdktr.TracerProviderOption{
+		sdktr.WithResource(newServiceResource(tm.baseResource, namespace, svcName, podName)),
+		// 在线聚合预先分配 SpanID
+		sdktr.WithIDGenerator(presetIDGenerator{}),
+	}
+	if tm.spanProcessor != nil {
+		opts = append(opts, sdktr.WithSpanProcessor(tm.spanProcessor))
+	}
+	provider := sdktr.NewTracerProvider(opts...)
+	tm.providers.Add(key, &providerEntry{provider: provider, usedAt: now})
+	return provider
+}
+
+// shutdownProviders 关闭全部 TracerProvider 及共用的 SpanProcessor，作为 Init*Exporter 返回的 shutdown。
+func (tm *TracerManager) shutdownProviders(ctx context.Context) error {
+	tm.muProviders.Lock()
+	defer tm.muProviders.Unlock()
+
+	var errs []error
+	for _, entry := range tm.providers.Values() {
+		errs = append(errs, entry.provider.Shutdown(ctx))
+	}
+	tm.providers.Purge()
+	// 可能一个 provider 都没有创建，SpanProcessor 的重复关闭是安全的
+	if tm.spanProcessor != nil {
+		errs = append(errs, tm.spanProcessor.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
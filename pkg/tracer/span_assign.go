@@ -0,0 +1,127 @@
+package tracer
+
+import (
+	"context"
+	tr "go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// SpanAssign 记录已导出 span 分配到的 SpanID。
+// 同一 Trace 的 span 晚到时，据此把新 span 挂到已导出的 parent 之下，并且不重复导出已导出的 span。
+type SpanAssign struct {
+	TraceID      string    `db:"trace_id"`
+	ID           string    `db:"id"`      // 对应 t_L7.id
+	SpanID       string    `db:"span_id"` // 导出时分配的 SpanID
+	DestIdentity uint32    `db:"dest_identity"`
+	DestPod      string    `db:"dest_pod"`
+	StartTime    time.Time `db:"start_time"`
+	EndTime      time.Time `db:"end_time"`
+}
+
+// 恢复为 PostSpan，只保留查找 parent 需要的字段
+func (a *SpanAssign) postSpan(ctx context.Context) (*PostSpan, bool) {
+	traceID, ok := parseTraceID(a.TraceID)
+	if !ok {
+		return nil, false
+	}
+	spanID, err := tr.SpanIDFromHex(a.SpanID)
+	if err != nil {
+		return nil, false
+	}
+	sc := tr.NewSpanContext(tr.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: tr.FlagsSampled,
+	})
+	return &PostSpan{
+		preSpan: &PreSpan{
+			ID:           a.ID,
+			TraceID:      a.TraceID,
+			DestIdentity: a.DestIdentity,
+			DestPod:      a.DestPod,
+			StartTime:    a.StartTime,
+			EndTime:      a.EndTime,
+		},
+		ctx:    tr.ContextWithSpanContext(ctx, sc),
+		spanID: spanID,
+	}, true
+}
+
+// restoreAssigns 恢复已导出的 span 作为 parent 候选，并从 bufPreSpan 中去除它们，只聚合增量
+func (t *Tracer) restoreAssigns(ctx context.Context, assigns []*SpanAssign) {
+	exported := make(map[string]struct{}, len(assigns))
+	for _, a := range assigns {
+		if p, ok := a.postSpan(ctx); ok {
+			t.exported = append(t.exported, p)
+			exported[a.ID] = struct{}{}
+		}
+	}
+
+	delta := make([]*PreSpan, 0, len(t.bufPreSpan))
+	for _, preSpan := range t.bufPreSpan {
+		if _, hit := exported[preSpan.ID]; !hit {
+			delta = append(delta, preSpan)
+		}
+	}
+	t.bufPreSpan = delta
+}
+
+// 记录新分配的 SpanID
+func (t *Tracer) recordAssign(preSpan *PreSpan, spanID tr.SpanID) {
+	t.assigns = append(t.assigns, &SpanAssign{
+		TraceID:      t.traceID,
+		ID:           preSpan.ID,
+		SpanID:       spanID.String(),
+		DestIdentity: preSpan.DestIdentity,
+		DestPod:      preSpan.DestPod,
+		StartTime:    preSpan.StartTime,
+		EndTime:      preSpan.EndTime,
+	})
+}
+
+// DB
+
+// SelectSpanAssigns 选择某一 trace_id 下已导出的 span
+func (o *Olap) SelectSpanAssigns(trace_id string) ([]*SpanAssign, error) {
+	assigns := make([]*SpanAssign, 0)
+	err := o.conn.QueryRows(&assigns, "SELECT "+
+		"trace_id, "+
+		"id, "+
+		"span_id, "+
+		"dest_identity, "+
+		"dest_pod, "+
+		"start_time, "+
+		"end_time "+
+		"FROM `t_SpanAssign` WHERE trace_id = ?", trace_id)
+	return assigns, err
+}
+
+// SaveSpanAssigns 同步写入，保证同一 Trace 的下一轮聚合能读到
+func (o *Olap) SaveSpanAssigns(assigns []*SpanAssign) error {
+	if len(assigns) == 0 {
+		return nil
+	}
+	placeholders := make([]string, 0, len(assigns))
+	args := make([]any, 0, 7*len(assigns))
+	for _, a := range assigns {
+		placeholders = append(placeholders, "(?,?,?,?,?,?,?)")
+		args = append(args, a.TraceID, a.ID, a.SpanID, a.DestIdentity, a.DestPod, a.StartTime, a.EndTime)
+	}
+	_, err := o.conn.Exec("INSERT INTO `t_SpanAssign` "+
+		"(trace_id, "+
+		"id, "+
+		"span_id, "+
+		"dest_identity, "+
+		"dest_pod, "+
+		"start_time, "+
+		"end_time) "+
+		"VALUES "+strings.Join(placeholders, ","), args...)
+	return err
+}
+
+func (o *Olap) CountSpanAssigns(trace_id string) (int, error) {
+	var count int
+	err := o.conn.QueryRow(&count, "SELECT COUNT(*) FROM `t_SpanAssign` WHERE trace_id = ?", trace_id)
+	return count, err
+}
@@ -0,0 +1,47 @@
+package tracer
+
+import (
+	"context"
+	"github.com/stleox/seeflow/pkg/config"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func TestTracer_restoreAssigns(t *testing.T) {
+	config.Debug = true
+	defer resetMockIdentities()
+
+	// 第一轮：<foo, bar> 已导出
+	tm := mockNewTracerManager()
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+	fooBar := mockPreSpan(uuid1, "foo", "bar", time.Unix(1, 0), time.Unix(10, 0))
+	a := tm.newTracer(mockTraceID())
+	a.bufPreSpan = append(a.bufPreSpan, fooBar)
+	r.NoError(t, a.Assemble(kAssemble_CausalAssemble, context.Background()))
+	r.Len(t, a.assigns, 1)
+	r.Len(t, exporter.GetSpans(), 1)
+	exporter.Reset()
+
+	// 第二轮：晚到的 <bar, loo>，数据库中同时有 <foo, bar>
+	barLoo := mockPreSpan(uuid2, "bar", "loo", time.Unix(3, 0), time.Unix(7, 0))
+	b := tm.newTracer(mockTraceID())
+	b.bufPreSpan = append(b.bufPreSpan, fooBar, barLoo)
+	b.restoreAssigns(context.Background(), a.assigns)
+	r.Len(t, b.bufPreSpan, 1)
+	r.NoError(t, b.Assemble(kAssemble_CausalAssemble, context.Background()))
+
+	// 只导出增量，并挂在已导出的 <foo, bar> 之下
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 1)
+	r.Equal(t, a.assigns[0].SpanID, spans[0].Parent.SpanID().String())
+	r.Equal(t, mockTraceID(), spans[0].SpanContext.TraceID().String())
+	r.Equal(t, map[string]string{uuid2: uuid1}, b.debMapParentID)
+	r.Len(t, b.assigns, 1)
+	r.Equal(t, uuid2, b.assigns[0].ID)
+}
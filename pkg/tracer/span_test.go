@@ -1,13 +1,20 @@
 package tracer
 
 import (
+	"context"
 	flowpb "github.com/cilium/cilium/api/v1/flow"
 	observerpb "github.com/cilium/cilium/api/v1/observer"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/stleox/seeflow/pkg/config"
+	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	r "github.com/stretchr/testify/require"
 )
@@ -60,36 +67,159 @@ func TestTracer_BuildPreSpan_2(t *testing.T) {
 
 func TestTracer_BuildBrokenPreSpan_1(t *testing.T) {
 	// broken span: f1 is request
-	tm := mockNewTracerManager()
-	// 修改配置：插入一条就触发 evict + BuildBroken。
+	// 修改配置：同一 namespace 插入第二条就淘汰第一条，并 BuildBroken。
+	defer func(n int) { config.MaxNumFlow = n }(config.MaxNumFlow)
 	config.MaxNumFlow = 1
+	tm := mockNewTracerManager()
 
 	f1 := mockFlow(uuid1, time.Unix(1, 0), false, "foo", "bar")
 	l7_1 := &L7Flow{tm: tm}
-	err := l7_1.Build(f1) // l7_1 不为空
+	r.NoError(t, l7_1.Build(f1))
+	r.Empty(t, l7_1.broken)
+	f2 := mockFlow(uuid2, time.Unix(2, 0), false, "foo", "loo")
+	l7_2 := &L7Flow{tm: tm}
+	err := l7_2.Build(f2) // l7_2.broken 不为空
 	r.NoError(t, err)
-	r.Equal(t, "foo-0000000000-00000", l7_1.SrcPod)
-	r.Equal(t, "world", l7_1.DestPod)
-	r.Equal(t, time.Unix(1, 0).UTC(), l7_1.StartTime)
-	r.Equal(t, config.MaxSpanTimestamp.UTC(), l7_1.EndTime)
+	r.Len(t, l7_2.broken, 1)
+	broken := l7_2.broken[0]
+	r.Equal(t, uuid1, broken.ID)
+	r.Equal(t, "foo-0000000000-00000", broken.SrcPod)
+	r.Equal(t, "bar-0000000000-00000", broken.DestPod)
+	r.Equal(t, time.Unix(1, 0).UTC(), broken.StartTime)
+	r.Equal(t, time.Unix(2, 0).UTC(), broken.EndTime) // 结束于淘汰时刻
+	r.True(t, broken.NoResponse)
 
 }
 
 func TestTracer_BuildBrokenPreSpan_2(t *testing.T) {
 	// broken span: f1 is response
-	tm := mockNewTracerManager()
-	// 修改配置：插入一条就触发 evict + BuildBroken。
+	// 修改配置：同一 namespace 插入第二条就淘汰第一条，并 BuildBroken。
+	defer func(n int) { config.MaxNumFlow = n }(config.MaxNumFlow)
 	config.MaxNumFlow = 1
+	tm := mockNewTracerManager()
 
 	f1 := mockFlow(uuid1, time.Unix(1, 0), true, "foo", "bar")
 	l7_1 := &L7Flow{tm: tm}
-	err := l7_1.Build(f1) // l7_1 不为空
+	r.NoError(t, l7_1.Build(f1))
+	r.Empty(t, l7_1.broken)
+	f2 := mockFlow(uuid2, time.Unix(2, 0), false, "foo", "loo")
+	l7_2 := &L7Flow{tm: tm}
+	err := l7_2.Build(f2) // l7_2.broken 不为空
 	r.NoError(t, err)
-	r.Equal(t, "world", l7_1.SrcPod)
-	r.Equal(t, "bar-0000000000-00000", l7_1.DestPod)
-	r.Equal(t, config.MinSpanTimestamp.UTC(), l7_1.StartTime)
-	r.Equal(t, time.Unix(1, 0).UTC(), l7_1.EndTime)
+	r.Len(t, l7_2.broken, 1)
+	broken := l7_2.broken[0]
+	r.Equal(t, "world", broken.SrcPod)
+	r.Equal(t, "bar-0000000000-00000", broken.DestPod)
+	r.Equal(t, config.MinSpanTimestamp.UTC(), broken.StartTime)
+	r.Equal(t, time.Unix(1, 0).UTC(), broken.EndTime)
+	r.False(t, broken.NoResponse)
+
+}
+
+func TestTracer_BuildBrokenPreSpan_Timeout(t *testing.T) {
+	// 缓存未满，请求等待超过 RequestTimeout 后被淘汰
+	defer func(n int) { config.MaxNumFlow = n }(config.MaxNumFlow)
+	config.MaxNumFlow = 1024
+	tm := mockNewTracerManager()
+
+	f1 := mockFlow(uuid1, time.Unix(1, 0), false, "foo", "bar")
+	l7_1 := &L7Flow{tm: tm}
+	r.NoError(t, l7_1.Build(f1))
+	r.Empty(t, l7_1.broken)
+
+	// 未超时的流量不淘汰 f1
+	f2 := mockFlow(uuid2, time.Unix(1, 0).Add(config.RequestTimeout/2), false, "bar", "loo")
+	l7_2 := &L7Flow{tm: tm}
+	r.NoError(t, l7_2.Build(f2))
+	r.Empty(t, l7_2.broken)
+
+	// 后台任务以节点的流量时间淘汰，墙上时间早已超过 f1 的超时时刻，但节点的流量时间没有
+	r.Zero(t, tm.ExpireFlows(time.Now()))
+	r.Equal(t, 2, tm.bufFlow.Len())
+
+	// 以流量时间淘汰 f1，结束时间是超时时刻而不是淘汰时刻
+	f3 := mockFlow(uuid3, time.Unix(100, 0), false, "foo", "bar")
+	l7_3 := &L7Flow{tm: tm}
+	r.NoError(t, l7_3.Build(f3))
+	r.Len(t, l7_3.broken, 2)
+	r.ElementsMatch(t, []string{uuid1, uuid2}, []string{l7_3.broken[0].ID, l7_3.broken[1].ID})
+	for i, f := range []*observerpb.Flow{f1, f2} {
+		r.Equal(t, f.Time.AsTime().Add(config.RequestTimeout), l7_3.broken[i].EndTime)
+		r.True(t, l7_3.broken[i].NoResponse)
+	}
+
+	// 节点静默超过 RequestTimeout 后，后台任务随墙上时间淘汰 f3
+	r.Equal(t, 1, tm.ExpireFlows(time.Now().Add(config.RequestTimeout)))
+	r.Zero(t, tm.bufFlow.Len())
+}
+
+func TestTracer_BuildBrokenPreSpan_Skew(t *testing.T) {
+	// 节点之间时钟不同步，时钟超前的节点不淘汰其它节点的请求
+	defer func(n int) { config.MaxNumFlow = n }(config.MaxNumFlow)
+	config.MaxNumFlow = 1024
+	tm := mockNewTracerManager()
+	build := func(xreqID string, node string, flowTime time.Time) *L7Flow {
+		f := mockFlow(xreqID, flowTime, false, "foo", "bar")
+		f.NodeName = node
+		l7 := &L7Flow{tm: tm}
+		r.NoError(t, l7.Build(f))
+		return l7
+	}
 
+	r.Empty(t, build(uuid1, "node-a", time.Unix(1, 0)).broken)
+	r.Empty(t, build(uuid2, "node-b", time.Unix(1, 0).Add(2*config.RequestTimeout)).broken)
+	r.Equal(t, 2, tm.bufFlow.Len())
+
+	// 节点 a 自己的流量时间超过超时时刻后才淘汰 f1
+	l7 := build(uuid3, "node-a", time.Unix(1, 0).Add(config.RequestTimeout))
+	r.Len(t, l7.broken, 1)
+	r.Equal(t, uuid1, l7.broken[0].ID)
+}
+
+func TestTracer_BuildPreSpan_HTTP(t *testing.T) {
+	// right span with HTTP fields
+	tm := mockNewTracerManager()
+	config.MaxNumFlow = 1024
+
+	f1 := mockFlow(uuid3, time.Unix(1, 0), false, "foo", "bar")
+	f1.L7.GetHttp().Method = "GET"
+	f1.L7.GetHttp().Url = "http://bar/api"
+	f1.L7.GetHttp().Protocol = "HTTP/1.1"
+	f1.L7.GetHttp().Headers = append(f1.L7.GetHttp().Headers,
+		&observerpb.HTTPHeader{Key: "User-Agent", Value: "curl"},
+		&observerpb.HTTPHeader{Key: "Cookie", Value: "secret"})
+	f2 := mockFlow(uuid3, time.Unix(10, 0), true, "bar", "foo")
+	f2.L7.GetHttp().Code = 503
+	f2.L7.LatencyNs = 9000
+
+	r.NoError(t, (&L7Flow{tm: tm}).Build(f1))
+	l7 := &L7Flow{tm: tm}
+	r.NoError(t, l7.Build(f2))
+	r.Equal(t, "GET", l7.Method)
+	r.Equal(t, "http://bar/api", l7.URL)
+	r.Equal(t, "HTTP/1.1", l7.Protocol)
+	r.Equal(t, uint32(503), l7.StatusCode)
+	r.Equal(t, uint64(9000), l7.LatencyNs)
+	r.JSONEq(t, `{"user-agent":"curl"}`, l7.Headers)
+
+	// 导出后检查属性与状态
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+	a := tm.newTracer(uuid3)
+	a.bufPreSpan = append(a.bufPreSpan, &l7.L7FlowEntity)
+	r.NoError(t, a.BasicAssemble(context.Background()))
+
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 1)
+	r.Equal(t, codes.Error, spans[0].Status.Code)
+	attrs := make(map[attr.Key]attr.Value)
+	for _, kv := range spans[0].Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	r.Equal(t, "GET", attrs["http.request.method"].AsString())
+	r.Equal(t, int64(503), attrs["http.response.status_code"].AsInt64())
+	r.Equal(t, "1.1", attrs["network.protocol.version"].AsString())
+	r.Equal(t, []string{"curl"}, attrs["http.request.header.user-agent"].AsStringSlice())
 }
 
 //test utils
@@ -205,6 +335,12 @@ func mockFlow(flowXreqValue string, flowTime time.Time, flowIsReply bool, flowSr
 var mockPodName2Identity = make(map[string]uint32, 0)
 var mockId = uint32(1) // 从 1 开始，区分空值 0。
 
+// 测试结束后重置 identity 分配，不影响依赖分配顺序的其它测试
+func resetMockIdentities() {
+	mockPodName2Identity = make(map[string]uint32, 0)
+	mockId = 1
+}
+
 func queryPodName2Identity(pod string) uint32 {
 	if id, hit := mockPodName2Identity[pod]; hit {
 		return id
@@ -239,3 +375,19 @@ const (
 	uuid3 = "00000000-0000-0000-0000-000000000003"
 	uuid4 = "00000000-0000-0000-0000-000000000004"
 )
+
+func TestTracer_extractHTTPFields_Truncate(t *testing.T) {
+	req := mockFlow(uuid1, time.Unix(1, 0), false, "foo", "bar")
+	// 截断在多字节字符之前
+	req.L7.GetHttp().Url = "/" + strings.Repeat("a", kMaxHTTPFieldLen-2) + "中"
+	req.L7.GetHttp().Headers = append(req.L7.GetHttp().Headers,
+		&observerpb.HTTPHeader{Key: "User-Agent", Value: "curl"},
+		&observerpb.HTTPHeader{Key: "Content-Type", Value: strings.Repeat("x", kMaxHTTPFieldLen)})
+
+	entity := &L7FlowEntity{}
+	extractHTTPFields(entity, req, nil, []string{"user-agent", "content-type"})
+	r.Len(t, entity.URL, kMaxHTTPFieldLen-1)
+	r.True(t, utf8.ValidString(entity.URL))
+	// 去掉超长的请求头，其余的保留
+	r.JSONEq(t, `{"user-agent":"curl"}`, entity.Headers)
+}
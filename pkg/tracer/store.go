@@ -0,0 +1,144 @@
+package tracer
+
+import (
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stleox/seeflow/pkg/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store 存储后端，TracerManager 只通过它读写流量与聚合状态。
+// Doris 实现见 Olap，ClickHouse 实现见 ClickHouse，内存实现见 memStore。
+type Store interface {
+	// InsertL34 等写入可以是批量异步的，Flush 之后才保证可读
+	InsertL34(l *L34FlowEntity) error
+	InsertSock(s *SockFlowEntity) error
+	InsertL7(l *L7FlowEntity) error
+	Flush()
+
+	// SelectL7Spans 选择某一 Trace 下的全体 span，按 StartTime 升序
+	SelectL7Spans(traceID string) ([]*L7FlowEntity, error)
+	CountL7Spans(traceID string) (int, error)
+	// SelectL34Flows 选择时间窗口内、两端都在 identities 中的 L34 流量，按时间升序
+	SelectL34Flows(from time.Time, to time.Time, identities []uint32) ([]*L34FlowEntity, error)
+	SelectSockFlows(from time.Time, to time.Time, identities []uint32) ([]*SockFlowEntity, error)
+
+	// SaveSpanAssigns 同步写入，同一 Trace 的下一轮聚合需要读到
+	SelectSpanAssigns(traceID string) ([]*SpanAssign, error)
+	SaveSpanAssigns(assigns []*SpanAssign) error
+	CountSpanAssigns(traceID string) (int, error)
+
+	SelectCheckpoints() ([]*Checkpoint, error)
+	SaveCheckpoints(ckpts []*Checkpoint) error
+
+	// SaveEndpoints 全量替换 endpoint 列表
+	SaveEndpoints(endpoints []*Endpoint) error
+
+	// RecordExFlow 记录异常流量，SummaryExFlows 在退出时输出到日志文件
+	RecordExFlow(flowType observerpb.FlowType, exFlow ExFlow)
+	SummaryExFlows()
+}
+
+// 使用内存存储的 DSN，不需要数据库，比如 observe 调试时
+const kMemoryDSN = "memory://"
+
+// NewStore 按 SEEFLOW_OLAP_DSN 的 scheme 选择存储后端，默认连接本地 Doris；连接失败返回 nil
+// 表由 `seeflow migrate up` 创建
+func NewStore(vp *viper.Viper) Store {
+	dsn := olapDSN(vp)
+	if strings.HasPrefix(dsn, kMemoryDSN) {
+		logrus.Info("SeeFlow stores flows in memory")
+		return newMemStore()
+	}
+	if strings.HasPrefix(dsn, kClickHouseDSN) {
+		// 避免返回包含 nil 指针的非空接口
+		c := NewClickHouse(dsn)
+		if c == nil {
+			return nil
+		}
+		return c
+	}
+
+	o := NewOlap(dsn)
+	if o == nil {
+		return nil
+	}
+	return o
+}
+
+func olapDSN(vp *viper.Viper) string {
+	dsn := vp.GetString("SEEFLOW_OLAP_DSN")
+	if dsn == "" {
+		dsn = config.SEEFLOW_DEFAULT_DSN
+	}
+	return dsn
+}
+
+// exFlowLog 异常流量列表，目前认为异常概率小，各后端共用
+type exFlowLog struct {
+	arrExL34  []ExFlow
+	muExL34   sync.Mutex
+	arrExL7   []ExFlow
+	muExL7    sync.Mutex
+	arrExSock []ExFlow
+	muExSock  sync.Mutex
+}
+
+func (e *exFlowLog) RecordExFlow(flowType observerpb.FlowType, exFlow ExFlow) {
+	switch flowType {
+	case observerpb.FlowType_L3_L4:
+		e.muExL34.Lock()
+		e.arrExL34 = append(e.arrExL34, exFlow)
+		e.muExL34.Unlock()
+	case observerpb.FlowType_L7:
+		e.muExL7.Lock()
+		e.arrExL7 = append(e.arrExL7, exFlow)
+		e.muExL7.Unlock()
+	case observerpb.FlowType_SOCK:
+		e.muExSock.Lock()
+		e.arrExSock = append(e.arrExSock, exFlow)
+		e.muExSock.Unlock()
+	}
+}
+
+func (e *exFlowLog) SummaryExFlows() {
+	e.muExL34.Lock()
+	e.muExL7.Lock()
+	e.muExSock.Lock()
+
+	if len(e.arrExL34) == 0 && len(e.arrExL7) == 0 && len(e.arrExSock) == 0 {
+		logrus.Info("Seeflow didn't find exceptional flows")
+		e.muExL34.Unlock()
+		e.muExL7.Unlock()
+		e.muExSock.Unlock()
+		return
+	}
+
+	if len(e.arrExL34) != 0 {
+		logrus.Infof("Seeflow found exceptional l34 flows, goto %s", config.PathExL34)
+		for _, ef := range e.arrExL34 {
+			config.Log4ExL34.Info(ef)
+		}
+	}
+	e.muExL34.Unlock()
+
+	if len(e.arrExL7) != 0 {
+		logrus.Infof("Seeflow found exceptional l7 flows, goto %s", config.PathExL7)
+		for _, ef := range e.arrExL7 {
+			config.Log4ExL7.Info(ef)
+		}
+	}
+	e.muExL7.Unlock()
+
+	if len(e.arrExSock) != 0 {
+		logrus.Infof("Seeflow found exceptional sock flows, goto %s", config.PathExSock)
+		for _, ef := range e.arrExSock {
+			config.Log4ExSock.Info(ef)
+		}
+	}
+	e.muExSock.Unlock()
+
+}
@@ -0,0 +1,193 @@
+package tracer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memStore 内存存储后端，写入即可读，不需要数据库。
+// 数据只增不减，适合 observe 的单次调试与单元测试，不适合长期运行的 serve。
+type memStore struct {
+	mu        sync.RWMutex
+	l34       []*L34FlowEntity
+	sock      []*SockFlowEntity
+	l7        map[string][]*L7FlowEntity        // TraceID -> span
+	assigns   map[string]map[string]*SpanAssign // TraceID -> ID -> 已导出的 span，同 t_SpanAssign 的 UNIQUE KEY
+	ckpts     map[string]*Checkpoint            // NodeName -> 检查点
+	endpoints []*Endpoint
+
+	exFlowLog
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		l34:       make([]*L34FlowEntity, 0),
+		sock:      make([]*SockFlowEntity, 0),
+		l7:        make(map[string][]*L7FlowEntity, 0),
+		assigns:   make(map[string]map[string]*SpanAssign, 0),
+		ckpts:     make(map[string]*Checkpoint, 0),
+		endpoints: make([]*Endpoint, 0),
+	}
+}
+
+// 写入副本，调用方可以继续修改实体
+
+func (m *memStore) InsertL34(l *L34FlowEntity) error {
+	entity := *l
+	m.mu.Lock()
+	m.l34 = append(m.l34, &entity)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memStore) InsertSock(s *SockFlowEntity) error {
+	entity := *s
+	m.mu.Lock()
+	m.sock = append(m.sock, &entity)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memStore) InsertL7(l *L7FlowEntity) error {
+	entity := *l
+	m.mu.Lock()
+	m.l7[l.TraceID] = append(m.l7[l.TraceID], &entity)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memStore) Flush() {}
+
+func (m *memStore) SelectL7Spans(traceID string) ([]*L7FlowEntity, error) {
+	m.mu.RLock()
+	spans := make([]*L7FlowEntity, 0, len(m.l7[traceID]))
+	for _, span := range m.l7[traceID] {
+		entity := *span
+		spans = append(spans, &entity)
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].StartTime.Before(spans[j].StartTime) })
+	return spans, nil
+}
+
+func (m *memStore) CountL7Spans(traceID string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.l7[traceID]), nil
+}
+
+// 同 SQL 的 BETWEEN，两端都包含
+func between(at time.Time, from time.Time, to time.Time) bool {
+	return !at.Before(from) && !at.After(to)
+}
+
+func identitySet(identities []uint32) map[uint32]struct{} {
+	set := make(map[uint32]struct{}, len(identities))
+	for _, id := range identities {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func (m *memStore) SelectL34Flows(from time.Time, to time.Time, identities []uint32) ([]*L34FlowEntity, error) {
+	set := identitySet(identities)
+	flows := make([]*L34FlowEntity, 0)
+	m.mu.RLock()
+	for _, flow := range m.l34 {
+		_, src := set[flow.SrcIdentity]
+		_, dest := set[flow.DestIdentity]
+		if src && dest && between(flow.Time, from, to) {
+			entity := *flow
+			flows = append(flows, &entity)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].Time.Before(flows[j].Time) })
+	return flows, nil
+}
+
+func (m *memStore) SelectSockFlows(from time.Time, to time.Time, identities []uint32) ([]*SockFlowEntity, error) {
+	set := identitySet(identities)
+	flows := make([]*SockFlowEntity, 0)
+	m.mu.RLock()
+	for _, flow := range m.sock {
+		_, src := set[flow.SrcIdentity]
+		_, dest := set[flow.DestIdentity]
+		if src && dest && between(flow.Time, from, to) {
+			entity := *flow
+			flows = append(flows, &entity)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].Time.Before(flows[j].Time) })
+	return flows, nil
+}
+
+func (m *memStore) SelectSpanAssigns(traceID string) ([]*SpanAssign, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	assigns := make([]*SpanAssign, 0, len(m.assigns[traceID]))
+	for _, a := range m.assigns[traceID] {
+		assign := *a
+		assigns = append(assigns, &assign)
+	}
+	return assigns, nil
+}
+
+func (m *memStore) SaveSpanAssigns(assigns []*SpanAssign) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range assigns {
+		byID, hit := m.assigns[a.TraceID]
+		if !hit {
+			byID = make(map[string]*SpanAssign, 0)
+			m.assigns[a.TraceID] = byID
+		}
+		assign := *a
+		byID[a.ID] = &assign
+	}
+	return nil
+}
+
+func (m *memStore) CountSpanAssigns(traceID string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.assigns[traceID]), nil
+}
+
+func (m *memStore) SelectCheckpoints() ([]*Checkpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ckpts := make([]*Checkpoint, 0, len(m.ckpts))
+	for _, c := range m.ckpts {
+		ckpt := *c
+		ckpts = append(ckpts, &ckpt)
+	}
+	sort.Slice(ckpts, func(i, j int) bool { return ckpts[i].NodeName < ckpts[j].NodeName })
+	return ckpts, nil
+}
+
+func (m *memStore) SaveCheckpoints(ckpts []*Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range ckpts {
+		ckpt := *c
+		m.ckpts[c.NodeName] = &ckpt
+	}
+	return nil
+}
+
+func (m *memStore) SaveEndpoints(endpoints []*Endpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints = make([]*Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		ep := *e
+		m.endpoints = append(m.endpoints, &ep)
+	}
+	return nil
+}
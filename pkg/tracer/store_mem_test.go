@@ -0,0 +1,52 @@
+package tracer
+
+import (
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	r "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemStore_SelectFlows(t *testing.T) {
+	s := newMemStore()
+	r.NoError(t, s.InsertL34(&L34FlowEntity{Time: time.Unix(3, 0), SrcIdentity: 1, DestIdentity: 2}))
+	r.NoError(t, s.InsertL34(&L34FlowEntity{Time: time.Unix(1, 0), SrcIdentity: 2, DestIdentity: 1}))
+	// 时间窗口之外、identity 之外的流量不选择
+	r.NoError(t, s.InsertL34(&L34FlowEntity{Time: time.Unix(5, 0), SrcIdentity: 1, DestIdentity: 2}))
+	r.NoError(t, s.InsertL34(&L34FlowEntity{Time: time.Unix(2, 0), SrcIdentity: 1, DestIdentity: 3}))
+
+	flows, err := s.SelectL34Flows(time.Unix(1, 0), time.Unix(3, 0), []uint32{1, 2})
+	r.NoError(t, err)
+	r.Len(t, flows, 2)
+	r.Equal(t, time.Unix(1, 0), flows[0].Time)
+	r.Equal(t, time.Unix(3, 0), flows[1].Time)
+
+	// 写入的是副本
+	flows[0].SrcIdentity = 4
+	flows, _ = s.SelectL34Flows(time.Unix(1, 0), time.Unix(3, 0), []uint32{1, 2})
+	r.Len(t, flows, 2)
+}
+
+func TestMemStore_SpanAssigns(t *testing.T) {
+	s := newMemStore()
+	r.NoError(t, s.SaveSpanAssigns([]*SpanAssign{
+		{TraceID: uuid1, ID: "a", SpanID: "1"},
+		{TraceID: uuid1, ID: "b", SpanID: "2"},
+	}))
+	// 同 UNIQUE KEY(trace_id, id)，插入即更新
+	r.NoError(t, s.SaveSpanAssigns([]*SpanAssign{{TraceID: uuid1, ID: "a", SpanID: "3"}}))
+
+	count, err := s.CountSpanAssigns(uuid1)
+	r.NoError(t, err)
+	r.Equal(t, 2, count)
+	assigns, err := s.SelectSpanAssigns(uuid1)
+	r.NoError(t, err)
+	for _, a := range assigns {
+		if a.ID == "a" {
+			r.Equal(t, "3", a.SpanID)
+		}
+	}
+
+	s.RecordExFlow(observerpb.FlowType_L7, ExFlow{reason: kExL7Broken})
+	r.Len(t, s.arrExL7, 1)
+}
@@ -2,12 +2,18 @@ package tracer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/stleox/seeflow/pkg/config"
 	attr "go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	tr "go.opentelemetry.io/otel/trace"
+	"sort"
+	"strings"
+	"time"
 )
 
 type PreSpan = L7FlowEntity
@@ -21,13 +27,35 @@ type PostSpan struct {
 const (
 	kAssemble_Unknown = iota
 	kAssemble_BasicAssemble
+	kAssemble_CausalAssemble
 )
 
+// TracerManager 默认使用的聚合策略，可由 SEEFLOW_ASSEMBLE_STRATEGY 覆盖
+const kAssemble_Default = kAssemble_BasicAssemble
+
+// 聚合策略的名字，比如 `--assemble-strategy causal`
+var assembleStrategies = map[string]int{
+	"basic":  kAssemble_BasicAssemble,
+	"causal": kAssemble_CausalAssemble,
+}
+
+// parseAssembleStrategy 解析聚合策略的名字
+func parseAssembleStrategy(name string) (int, error) {
+	kind, ok := assembleStrategies[strings.ToLower(name)]
+	if !ok {
+		return kAssemble_Unknown, fmt.Errorf("unknown assemble strategy %q, expected basic or causal", name)
+	}
+	return kind, nil
+}
+
 func (t *Tracer) Assemble(kind int, amCtx context.Context) error {
 	switch kind {
 	case kAssemble_BasicAssemble:
 		logrus.Debugf("call BasicAssemble() from tracer#%s", t.traceID)
 		return t.BasicAssemble(amCtx)
+	case kAssemble_CausalAssemble:
+		logrus.Debugf("call CausalAssemble() from tracer#%s", t.traceID)
+		return t.CausalAssemble(amCtx)
 	default:
 		return fmt.Errorf("unknown Assemble strategy")
 	}
@@ -41,13 +69,26 @@ func (t *Tracer) BasicAssemble(amCtx context.Context) error {
 		return nil
 	}
 
+	// 按 StartTime 升序，保证 parent 先于 child 构建
+	sort.SliceStable(t.bufPreSpan, func(i, j int) bool {
+		return t.bufPreSpan[i].StartTime.Before(t.bufPreSpan[j].StartTime)
+	})
+
+	// 已导出的 span 先入表，晚到的 span 可以挂在其下
+	for _, postSpan := range t.exported {
+		t.mapService[postSpan.preSpan.DestIdentity] = postSpan
+	}
+
 	// 遍历进行 parent 关联
 	for _, preSpan := range t.bufPreSpan {
 		var curPreSpan *PreSpan
 		var curSpanID tr.SpanID
 		var parentCtx context.Context
-		// 检查缓存
-		if hitPostSpan, hit := t.mapService[preSpan.SrcIdentity]; !hit {
+		// 优先使用请求头中上游的 SpanID，挂在应用自己的 span 之下
+		if upstreamSpanID := extractUpstreamSpanID(preSpan); upstreamSpanID.IsValid() {
+			curPreSpan = preSpan
+			parentCtx, curSpanID = t.buildTrSpan(amCtx, curPreSpan, upstreamSpanID)
+		} else if hitPostSpan, hit := t.mapService[preSpan.SrcIdentity]; !hit {
 			// 缺失，构建 tr.Span
 			// 缺失的情况应该仅限于 Root Span
 			curPreSpan = preSpan
@@ -70,11 +111,150 @@ func (t *Tracer) BasicAssemble(amCtx context.Context) error {
 	return nil
 }
 
+// CausalAssemble
+// 离线算法，输入完备的 Span 数据。
+// 与 BasicAssemble 不同，parent 不按 identity 覆盖式查表，而是在全部 span 中查找：
+//   - 被调方就是 child 的调用方，比较 pod，pod 未知时比较 identity；
+//   - 时间窗口包含 child，即 parent.StartTime <= child.StartTime 且 child.EndTime <= parent.EndTime，
+//     两端按 config.ClockSkew 放宽，容忍不同节点之间的时钟偏差；
+//   - 满足以上条件的多个 span 中，选窗口最内层（开始最晚）的一个。
+//
+// 所以同一服务被多次调用、扇出、递归调用时，child 都能挂到实际发起它的那一次调用下。
+// 时钟偏差可能使 child 早于 parent 开始，所以先为每个 span 选出 parent，再按 parent 先于 child 的顺序构建。
+func (t *Tracer) CausalAssemble(amCtx context.Context) error {
+	if len(t.bufPreSpan) == 0 {
+		return nil
+	}
+
+	// 按 StartTime 升序，同时开始的按 EndTime 降序，保证外层先于内层
+	sort.SliceStable(t.bufPreSpan, func(i, j int) bool {
+		a, b := t.bufPreSpan[i], t.bufPreSpan[j]
+		if !a.StartTime.Equal(b.StartTime) {
+			return a.StartTime.Before(b.StartTime)
+		}
+		return a.EndTime.After(b.EndTime)
+	})
+
+	// 已导出的 span 也是 parent 候选，它们已经构建过
+	candidates := make([]*PostSpan, 0, len(t.exported)+len(t.bufPreSpan))
+	candidates = append(candidates, t.exported...)
+	pending := make([]*PostSpan, 0, len(t.bufPreSpan))
+	for _, preSpan := range t.bufPreSpan {
+		pending = append(pending, &PostSpan{preSpan: preSpan})
+	}
+	candidates = append(candidates, pending...)
+
+	parentOf := make(map[*PostSpan]*PostSpan, len(pending))
+	for _, child := range pending {
+		// 请求头携带上游 SpanID 时挂在应用自己的 span 之下
+		if extractUpstreamSpanID(child.preSpan).IsValid() {
+			continue
+		}
+		if parent := findCausalParent(candidates, child, config.ClockSkew, parentOf); parent != nil {
+			parentOf[child] = parent
+		}
+	}
+
+	var build func(postSpan *PostSpan)
+	build = func(postSpan *PostSpan) {
+		if postSpan.ctx != nil {
+			return
+		}
+		preSpan := postSpan.preSpan
+		var parentID string
+		if upstreamSpanID := extractUpstreamSpanID(preSpan); upstreamSpanID.IsValid() {
+			postSpan.ctx, postSpan.spanID = t.buildTrSpan(amCtx, preSpan, upstreamSpanID)
+		} else if parent, hit := parentOf[postSpan]; !hit {
+			// 缺失的情况应该仅限于 Root Span
+			postSpan.ctx, postSpan.spanID = t.buildTrSpan(amCtx, preSpan, tr.SpanID{})
+		} else {
+			build(parent)
+			postSpan.ctx, postSpan.spanID = t.buildTrSpan(parent.ctx, preSpan, parent.spanID)
+			parentID = parent.preSpan.ID
+		}
+		if config.Debug {
+			t.debMapParentID[preSpan.ID] = parentID
+		}
+	}
+	for _, postSpan := range pending {
+		build(postSpan)
+	}
+	return nil
+}
+
+// 在 candidates 中查找 child 的 parent，缺失返回 nil。
+// 优先选严格包含 child 的；没有时才在 skew 的偏差内查找，
+// 否则同一 pod 收到的、稍晚于 child 开始的另一个调用会因为开始更晚而胜出。
+func findCausalParent(candidates []*PostSpan, child *PostSpan, skew time.Duration, parentOf map[*PostSpan]*PostSpan) *PostSpan {
+	if parent := findCausalParentWithin(candidates, child, 0, parentOf); parent != nil || skew == 0 {
+		return parent
+	}
+	return findCausalParentWithin(candidates, child, skew, parentOf)
+}
+
+// candidates 有序，排在 child 之后的只因时钟偏差才可能是 parent；
+// 两者互为 parent 候选时（比如递归调用）先开始的是 parent，已选的 parentOf 不能成环。
+func findCausalParentWithin(candidates []*PostSpan, child *PostSpan, skew time.Duration, parentOf map[*PostSpan]*PostSpan) *PostSpan {
+	var parent *PostSpan
+	after := false
+	for _, candidate := range candidates {
+		if candidate == child {
+			after = true
+			continue
+		}
+		if !containsCausally(candidate.preSpan, child.preSpan, skew) {
+			continue
+		}
+		if after && containsCausally(child.preSpan, candidate.preSpan, skew) {
+			continue
+		}
+		if isAncestor(parentOf, child, candidate) {
+			continue
+		}
+		// 开始最晚的是最内层；candidates 有序，相同开始时间时后者窗口更小
+		if parent == nil || !candidate.preSpan.StartTime.Before(parent.preSpan.StartTime) {
+			parent = candidate
+		}
+	}
+	return parent
+}
+
+// parent 的被调方是 child 的调用方，且时间窗口在 skew 的偏差内包含 child
+func containsCausally(parent *PreSpan, child *PreSpan, skew time.Duration) bool {
+	if !sameEndpoint(parent.DestPod, parent.DestIdentity, child.SrcPod, child.SrcIdentity) {
+		return false
+	}
+	return !parent.StartTime.After(child.StartTime.Add(skew)) && !parent.EndTime.Before(child.EndTime.Add(-skew))
+}
+
+// ancestor 是否是 postSpan 自身或者其祖先
+func isAncestor(parentOf map[*PostSpan]*PostSpan, ancestor *PostSpan, postSpan *PostSpan) bool {
+	for ; postSpan != nil; postSpan = parentOf[postSpan] {
+		if postSpan == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// 比较两端是否是同一个 pod，pod 未知时退化为比较 identity
+func sameEndpoint(podA string, identityA uint32, podB string, identityB uint32) bool {
+	if isKnownPod(podA) && isKnownPod(podB) {
+		return podA == podB
+	}
+	return identityA == identityB
+}
+
+func isKnownPod(pod string) bool {
+	return pod != "" && pod != config.NameUnknown && pod != config.NameWorld
+}
+
 func (t *Tracer) buildTrSpan(parentCtx context.Context, childSpan *PreSpan, parentSpanID tr.SpanID) (context.Context, tr.SpanID) {
 	startOpts := make([]tr.SpanStartOption, 0)
 	startOpts = append(startOpts, tr.WithTimestamp(childSpan.StartTime))
 	startOpts = append(startOpts, tr.WithAttributes(attr.String("src", childSpan.SrcPod)))
 	startOpts = append(startOpts, tr.WithAttributes(attr.String("dest", childSpan.DestPod)))
+	startOpts = append(startOpts, tr.WithAttributes(httpAttributes(childSpan)...))
 
 	// 暂时不知 TraceFlags 硬编码为 0x01 的后果，所以加个判断去除无效 SpanID
 	traceFlags := tr.TraceFlags(0x01)
@@ -82,15 +262,25 @@ func (t *Tracer) buildTrSpan(parentCtx context.Context, childSpan *PreSpan, pare
 		traceFlags = 0x00
 	}
 
+	// 无效 TraceID 为零值，由 SDK 生成新的 TraceID
+	traceID, _ := parseTraceID(t.traceID)
 	parentSpanCtx := tr.NewSpanContext(tr.SpanContextConfig{
-		TraceID:    convertTraceID(t.traceID),
+		TraceID:    traceID,
 		SpanID:     parentSpanID,
 		TraceFlags: traceFlags,
 	})
 
 	parentCtx = tr.ContextWithSpanContext(parentCtx, parentSpanCtx)
-	ctx, span := t.tracer.Start(parentCtx, constructSpanName(childSpan), startOpts...)
+	ctx, span := t.tracerOf(childSpan).Start(parentCtx, constructSpanName(childSpan), startOpts...)
+	evidenceAttrs, evidenceEvents := t.evidenceOf(childSpan)
+	addEvidence(span, evidenceAttrs, evidenceEvents)
+	if childSpan.NoResponse {
+		span.SetStatus(codes.Error, noResponseStatus(evidenceAttrs))
+	} else if childSpan.StatusCode >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", childSpan.StatusCode))
+	}
 	span.End(tr.WithTimestamp(childSpan.EndTime))
+	metricSpansExported.Inc()
 
 	if config.Debug {
 		// try to convert to sdktr.ReadOnlySpan
@@ -106,5 +296,41 @@ func (t *Tracer) buildTrSpan(parentCtx context.Context, childSpan *PreSpan, pare
 		}
 	}
 
+	t.recordAssign(childSpan, span.SpanContext().SpanID())
 	return ctx, span.SpanContext().SpanID()
 }
+
+const kAttrLatencyNs = attr.Key("seeflow.latency_ns")
+
+// HTTP 字段转换为 OTel 语义约定属性，缺失的字段不设置
+func httpAttributes(span *PreSpan) []attr.KeyValue {
+	attrs := make([]attr.KeyValue, 0)
+	if span.Protocol != "" {
+		name, version, _ := strings.Cut(span.Protocol, "/")
+		attrs = append(attrs, semconv.NetworkProtocolName(strings.ToLower(name)))
+		if version != "" {
+			attrs = append(attrs, semconv.NetworkProtocolVersion(version))
+		}
+	}
+	if span.Method != "" {
+		attrs = append(attrs, semconv.HTTPRequestMethodKey.String(span.Method))
+	}
+	if span.URL != "" {
+		attrs = append(attrs, semconv.URLFull(span.URL))
+	}
+	if span.StatusCode != 0 {
+		attrs = append(attrs, semconv.HTTPResponseStatusCode(int(span.StatusCode)))
+	}
+	if span.LatencyNs != 0 {
+		attrs = append(attrs, kAttrLatencyNs.Int64(int64(span.LatencyNs)))
+	}
+	if span.Headers != "" {
+		headers := make(map[string]string, 0)
+		if err := json.Unmarshal([]byte(span.Headers), &headers); err == nil {
+			for k, v := range headers {
+				attrs = append(attrs, attr.StringSlice("http.request.header."+k, []string{v}))
+			}
+		}
+	}
+	return attrs
+}
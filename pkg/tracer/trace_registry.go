@@ -0,0 +1,221 @@
+package tracer
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// 分片数量，减少 L7 消费的 goroutine 之间对同一把锁的争用
+const kNumTraceShards = 32
+
+// traceRegistry 按 TraceID 分片记录 Trace 的状态：最近活跃时间，以及进行中的 L7 消费。
+// 聚合前需等待该 Trace 进行中的消费完成，保证 span 都已写入数据库。
+// 响应中没有 TraceID，其消费单独按到达顺序登记，聚合任一 Trace 前都等待此前到达的响应。
+type traceRegistry struct {
+	shards   [kNumTraceShards]traceShard
+	untraced untracedConsumes
+}
+
+// untracedConsumes 进行中的、不知道所属 Trace 的消费，按到达顺序编号
+type untracedConsumes struct {
+	mu       sync.Mutex
+	next     uint64
+	inflight map[uint64]struct{}
+	// 某个消费完成时广播，等待者自行检查
+	idle *sync.Cond
+}
+
+type traceShard struct {
+	mu     sync.Mutex
+	traces map[string]*traceEntry
+	// 某个 Trace 进行中的消费归零时广播，等待者自行检查
+	idle *sync.Cond
+}
+
+type traceEntry struct {
+	// 自上次取出后是否构建过 span，以及最近一次构建的时间
+	active   bool
+	lastSeen time.Time
+	// 进行中的 L7 消费数量
+	inflight int
+}
+
+func newTraceRegistry() *traceRegistry {
+	var reg traceRegistry
+	for i := range reg.shards {
+		s := &reg.shards[i]
+		s.traces = make(map[string]*traceEntry, 0)
+		s.idle = sync.NewCond(&s.mu)
+	}
+	reg.untraced.inflight = make(map[uint64]struct{}, 0)
+	reg.untraced.idle = sync.NewCond(&reg.untraced.mu)
+	return &reg
+}
+
+func (reg *traceRegistry) shardOf(traceID string) *traceShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(traceID))
+	return &reg.shards[h.Sum32()%kNumTraceShards]
+}
+
+// 需持有锁
+func (s *traceShard) entryOf(traceID string) *traceEntry {
+	e, hit := s.traces[traceID]
+	if !hit {
+		e = &traceEntry{}
+		s.traces[traceID] = e
+	}
+	return e
+}
+
+// begin 登记一次进行中的消费，返回的 done 标记其完成
+func (reg *traceRegistry) begin(traceID string) (done func()) {
+	s := reg.shardOf(traceID)
+	s.mu.Lock()
+	s.entryOf(traceID).inflight++
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		e := s.traces[traceID]
+		e.inflight--
+		if e.inflight == 0 {
+			s.idle.Broadcast()
+			// 没有构建出 span 的 Trace（比如只有请求）无需保留
+			if !e.active {
+				delete(s.traces, traceID)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// beginUntraced 登记一次不知道所属 Trace 的消费，比如响应，返回的 done 标记其完成
+func (reg *traceRegistry) beginUntraced() (done func()) {
+	u := &reg.untraced
+	u.mu.Lock()
+	ticket := u.next
+	u.next++
+	u.inflight[ticket] = struct{}{}
+	u.mu.Unlock()
+
+	return func() {
+		u.mu.Lock()
+		delete(u.inflight, ticket)
+		u.idle.Broadcast()
+		u.mu.Unlock()
+	}
+}
+
+// waitUntraced 等待此前登记的、不知道所属 Trace 的消费完成；之后登记的不等待，持续有流量时也不会饿死
+func (reg *traceRegistry) waitUntraced() {
+	u := &reg.untraced
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	before := u.next
+	for u.busyBefore(before) {
+		u.idle.Wait()
+	}
+}
+
+// 需持有锁
+func (u *untracedConsumes) busyBefore(ticket uint64) bool {
+	for t := range u.inflight {
+		if t < ticket {
+			return true
+		}
+	}
+	return false
+}
+
+// markActive 记录 Trace 在 at 时构建了 span
+func (reg *traceRegistry) markActive(traceID string, at time.Time) {
+	s := reg.shardOf(traceID)
+	s.mu.Lock()
+	e := s.entryOf(traceID)
+	e.active = true
+	e.lastSeen = at
+	s.mu.Unlock()
+}
+
+// popQuiescent 取出静默超过 quiescence 的活跃 Trace，quiescence 为 0 则全部取出
+func (reg *traceRegistry) popQuiescent(quiescence time.Duration) []string {
+	deadline := time.Now().Add(-quiescence)
+	traceIDs := make([]string, 0)
+	for i := range reg.shards {
+		s := &reg.shards[i]
+		s.mu.Lock()
+		for traceID, e := range s.traces {
+			if e.active && (quiescence == 0 || e.lastSeen.Before(deadline)) {
+				e.active = false
+				traceIDs = append(traceIDs, traceID)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return traceIDs
+}
+
+// wait 等待 Trace 进行中的消费完成，包括此前到达的、可能属于它的响应
+func (reg *traceRegistry) wait(traceID string) {
+	reg.waitUntraced()
+
+	s := reg.shardOf(traceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 等待期间 entry 可能被回收，每次唤醒后重新查找
+	for {
+		e, hit := s.traces[traceID]
+		if !hit || e.inflight == 0 {
+			return
+		}
+		s.idle.Wait()
+	}
+}
+
+// waitAll 等待全部进行中的消费完成
+func (reg *traceRegistry) waitAll() {
+	reg.waitUntraced()
+	for i := range reg.shards {
+		s := &reg.shards[i]
+		s.mu.Lock()
+		for s.busy() {
+			s.idle.Wait()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// 需持有锁
+func (s *traceShard) busy() bool {
+	for _, e := range s.traces {
+		if e.inflight != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// drop 回收已聚合的 Trace；期间又有新的消费或 span 的，保留到下一轮
+func (reg *traceRegistry) drop(traceID string) {
+	s := reg.shardOf(traceID)
+	s.mu.Lock()
+	if e, hit := s.traces[traceID]; hit && e.inflight == 0 && !e.active {
+		delete(s.traces, traceID)
+	}
+	s.mu.Unlock()
+}
+
+func (reg *traceRegistry) Len() int {
+	n := 0
+	for i := range reg.shards {
+		s := &reg.shards[i]
+		s.mu.Lock()
+		n += len(s.traces)
+		s.mu.Unlock()
+	}
+	return n
+}
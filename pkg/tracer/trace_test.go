@@ -22,8 +22,9 @@ func TestTracer_BasicAssemble_2(t *testing.T) {
 	err := a.BasicAssemble(context.Background())
 	r.NoError(t, err)
 
+	// 同一 Trace 下的 span 共用请求头中的 TraceID
 	r.Equal(t, 2, len(a.debMapTraceID))
-	r.NotEqual(t, a.debMapTraceID["foo-bar"], a.debMapTraceID["bar-loo"])
+	r.Equal(t, a.debMapTraceID["foo-bar"], a.debMapTraceID["bar-loo"])
 
 	r.Equal(t, 2, len(a.debMapSpanID))
 	r.NotEqual(t, a.debMapSpanID["foo-bar"], a.debMapSpanID["bar-loo"])
@@ -90,3 +91,210 @@ func TestTracer_BasicAssemble_4_1(t *testing.T) {
 	r.Equal(t, a.debMapSpanID["B-C"], a.debMapParent["C-E"])
 
 }
+
+func TestTracer_BasicAssemble_Upstream(t *testing.T) {
+	config.Debug = true
+
+	// 服务拓补图：foo <-> bar <-> loo
+	// foo 被应用埋点，请求头中携带了 foo 自己的 SpanID，<foo, bar> 应挂在其下；
+	// bar 没有埋点，<bar, loo> 仍按拓补挂在 <foo, bar> 下。
+
+	const upstream = "00f067aa0ba902b7"
+	fooBar := mockPreSpan(uuid1, "foo", "bar", time.Unix(1, 0), time.Unix(10, 0))
+	fooBar.ParentSpanID = upstream
+
+	a := mockNewTracer()
+	a.bufPreSpan = append(a.bufPreSpan, mockPreSpan(uuid2, "bar", "loo", time.Unix(3, 0), time.Unix(7, 0)))
+	a.bufPreSpan = append(a.bufPreSpan, fooBar)
+
+	err := a.BasicAssemble(context.Background())
+	r.NoError(t, err)
+	r.Equal(t, 2, len(a.debMapSpanID))
+	r.Equal(t, upstream, a.debMapParent["foo-bar"])
+	r.Equal(t, a.debMapSpanID["foo-bar"], a.debMapParent["bar-loo"])
+	// 沿用请求头中的 TraceID
+	r.Equal(t, "00000000000000000000000000000001", a.debMapTraceID["foo-bar"])
+	r.Equal(t, a.debMapTraceID["foo-bar"], a.debMapTraceID["bar-loo"])
+}
+
+func TestTracer_CausalAssemble(t *testing.T) {
+	config.Debug = true
+
+	type preSpan struct {
+		id         string
+		src, dest  string
+		start, end int64
+	}
+	tests := []struct {
+		name  string
+		spans []preSpan
+		// preSpan ID -> parent preSpan ID，根为空
+		want map[string]string
+	}{
+		{
+			name: "chain, disordered input",
+			// foo <-> bar <-> loo <-> baz
+			spans: []preSpan{
+				{"s3", "loo", "baz", 4, 5},
+				{"s2", "bar", "loo", 3, 7},
+				{"s1", "foo", "bar", 1, 10},
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": "s2"},
+		},
+		{
+			name: "fan-out",
+			// foo <-> bar <-> loo
+			//             <-> baz
+			spans: []preSpan{
+				{"s1", "foo", "bar", 1, 10},
+				{"s2", "bar", "loo", 2, 4},
+				{"s3", "bar", "baz", 3, 8},
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": "s1"},
+		},
+		{
+			name: "repeated calls",
+			// bar 先后调用两次 loo，每次 loo 都调用 baz
+			spans: []preSpan{
+				{"s1", "foo", "bar", 1, 20},
+				{"s2", "bar", "loo", 2, 8},
+				{"s3", "loo", "baz", 3, 4},
+				{"s4", "bar", "loo", 10, 18},
+				{"s5", "loo", "baz", 12, 15},
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": "s2", "s4": "s1", "s5": "s4"},
+		},
+		{
+			name: "called by two services",
+			// foo 与 qux 都调用 bar，bar 各自调用 loo
+			spans: []preSpan{
+				{"s1", "foo", "bar", 1, 10},
+				{"s2", "bar", "loo", 2, 5},
+				{"s3", "qux", "bar", 11, 20},
+				{"s4", "bar", "loo", 12, 15},
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": "", "s4": "s3"},
+		},
+		{
+			name: "recursion",
+			// foo -> bar -> bar -> loo
+			spans: []preSpan{
+				{"s1", "foo", "bar", 1, 20},
+				{"s2", "bar", "bar", 2, 15},
+				{"s3", "bar", "loo", 3, 10},
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": "s2"},
+		},
+		{
+			name: "not contained",
+			// <bar, loo> 晚于 <foo, bar> 结束，不是其 child
+			spans: []preSpan{
+				{"s1", "foo", "bar", 1, 10},
+				{"s2", "bar", "loo", 11, 12},
+			},
+			want: map[string]string{"s1": "", "s2": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := mockNewTracer()
+			for _, s := range tt.spans {
+				a.bufPreSpan = append(a.bufPreSpan, mockPreSpan(s.id, s.src, s.dest, time.Unix(s.start, 0), time.Unix(s.end, 0)))
+			}
+			r.NoError(t, a.Assemble(kAssemble_CausalAssemble, context.Background()))
+			r.Equal(t, tt.want, a.debMapParentID)
+		})
+	}
+}
+
+func TestTracer_CausalAssemble_ClockSkew(t *testing.T) {
+	config.Debug = true
+	defer func(skew time.Duration) { config.ClockSkew = skew }(config.ClockSkew)
+	ms := func(n int64) time.Time { return time.UnixMilli(n) }
+
+	tests := []struct {
+		name  string
+		skew  time.Duration
+		spans []*PreSpan
+		want  map[string]string
+	}{
+		{
+			name: "child starts before parent",
+			// <bar, loo> 由 bar 所在节点观测，时钟比 foo 所在节点快 5ms
+			skew: 10 * time.Millisecond,
+			spans: []*PreSpan{
+				mockPreSpan("s1", "foo", "bar", ms(1000), ms(2000)),
+				mockPreSpan("s2", "bar", "loo", ms(995), ms(1500)),
+			},
+			want: map[string]string{"s1": "", "s2": "s1"},
+		},
+		{
+			name: "child ends after parent",
+			skew: 10 * time.Millisecond,
+			spans: []*PreSpan{
+				mockPreSpan("s1", "foo", "bar", ms(1000), ms(2000)),
+				mockPreSpan("s2", "bar", "loo", ms(1500), ms(2005)),
+			},
+			want: map[string]string{"s1": "", "s2": "s1"},
+		},
+		{
+			name: "no tolerance",
+			spans: []*PreSpan{
+				mockPreSpan("s1", "foo", "bar", ms(1000), ms(2000)),
+				mockPreSpan("s2", "bar", "loo", ms(995), ms(1500)),
+			},
+			want: map[string]string{"s1": "", "s2": ""},
+		},
+		{
+			name: "beyond tolerance",
+			skew: 10 * time.Millisecond,
+			spans: []*PreSpan{
+				mockPreSpan("s1", "foo", "bar", ms(1000), ms(2000)),
+				mockPreSpan("s2", "bar", "loo", ms(980), ms(1500)),
+			},
+			want: map[string]string{"s1": "", "s2": ""},
+		},
+		{
+			name: "recursion within tolerance",
+			// foo -> bar -> bar，两次调用的窗口互相包含，先开始的是 parent
+			skew: 10 * time.Millisecond,
+			spans: []*PreSpan{
+				mockPreSpan("s1", "foo", "bar", ms(1000), ms(2000)),
+				mockPreSpan("s2", "bar", "bar", ms(1002), ms(2003)),
+				mockPreSpan("s3", "bar", "bar", ms(1004), ms(2001)),
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": "s2"},
+		},
+		{
+			name: "enclosing call before skewed sibling",
+			// bar 先后收到 foo、baz 的调用，<baz, bar> 在 <bar, loo> 之后 2ms 开始，只在偏差内包含它
+			skew: 10 * time.Millisecond,
+			spans: []*PreSpan{
+				mockPreSpan("s1", "foo", "bar", ms(1000), ms(2000)),
+				mockPreSpan("s2", "bar", "loo", ms(1100), ms(1200)),
+				mockPreSpan("s3", "baz", "bar", ms(1102), ms(1500)),
+			},
+			want: map[string]string{"s1": "", "s2": "s1", "s3": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ClockSkew = tt.skew
+			a := mockNewTracer()
+			a.bufPreSpan = append(a.bufPreSpan, tt.spans...)
+			r.NoError(t, a.Assemble(kAssemble_CausalAssemble, context.Background()))
+			r.Equal(t, tt.want, a.debMapParentID)
+		})
+	}
+}
+
+func TestParseAssembleStrategy(t *testing.T) {
+	kind, err := parseAssembleStrategy("Causal")
+	r.NoError(t, err)
+	r.Equal(t, kAssemble_CausalAssemble, kind)
+	kind, err = parseAssembleStrategy("basic")
+	r.NoError(t, err)
+	r.Equal(t, kAssemble_Default, kind)
+	_, err = parseAssembleStrategy("magic")
+	r.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package tracer
 
 import (
+	"github.com/stleox/seeflow/pkg/config"
 	tr "go.opentelemetry.io/otel/trace"
 )
 
@@ -18,13 +19,19 @@ type Tracer struct {
 	// 被 Assemble 单独访问
 	bufPreSpan []*PreSpan
 
+	// 之前已导出的 span，由 restoreAssigns 从 OLAP 恢复，作为 parent 候选但不再导出
+	exported []*PostSpan
+	// 本次聚合分配的 SpanID，聚合后写入 OLAP
+	assigns []*SpanAssign
+
+	// 时间窗口内的 L34、Sock 流量，由 loadEvidence 从 OLAP 拉取，用于丰富 span
+	l34Evidence  []*L34FlowEntity
+	sockEvidence []*SockFlowEntity
+
 	// Pod DAG: dest_identity -> preSpan
 	// 被 Assemble 单线程访问
 	mapService map[uint32]*PostSpan
 
-	// tracer
-	tracer tr.Tracer
-
 	// for debug
 	// spanName -> traceID
 	debMapTraceID map[string]string
@@ -32,4 +39,15 @@ type Tracer struct {
 	debMapSpanID map[string]string
 	// spanName -> parentId
 	debMapParent map[string]string
+	// preSpan ID -> parent preSpan ID，仅 CausalAssemble 记录，根为空
+	debMapParentID map[string]string
+}
+
+// 所有 span 共用的 instrumentation scope，TracerProvider 按名称缓存 tr.Tracer
+const kInstrumentationScope = "github.com/stleox/seeflow"
+
+// tracerOf 返回 span 所属服务的 tr.Tracer，span 归属于被调方（dest）
+func (t *Tracer) tracerOf(span *PreSpan) tr.Tracer {
+	provider := t.manager.providerOf(span.Namespace, span.DestSvc, span.DestPod)
+	return provider.Tracer(kInstrumentationScope, tr.WithInstrumentationVersion(config.Version))
 }
@@ -2,94 +2,154 @@ package tracer
 
 import (
 	"context"
-	"fmt"
 	observerpb "github.com/cilium/cilium/api/v1/observer"
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stleox/seeflow/pkg/config"
+	"go.opentelemetry.io/otel/sdk/resource"
 	sdktr "go.opentelemetry.io/otel/sdk/trace"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type TracerManager struct {
 	numTracer atomic.Int32
 
-	// cache: TraceID -> Tracer
-	tracers *lru.Cache[string, *Tracer]
+	// 按 TraceID 分片的活跃时间、进行中的 L7 消费
+	traces *traceRegistry
 
-	// set of active TraceIDs
-	setActiveTraceID map[string]bool
-	muActiveTraceID  sync.Mutex
+	// 待配对的请求、响应: SpanID -> flow
+	bufFlow *pendingStore
+	// 已接收、尚未提交的 flow，检查点不越过其中最早的一个
+	uncommitted *flowTracker
 
-	// cache: SpanID -> flow
-	bufFlow *lru.Cache[string, *observerpb.Flow]
+	ShutdownCtx context.Context
 
-	// 每一个 TraceID 上有一个 WG 做同步，保证写数据库的操作完成。
-	// todo map 改成 lru
-	// map: TraceID -> WG
-	mapWgL7Consume map[string]sync.WaitGroup
+	// 所有 TracerProvider 共用的 SpanProcessor，由 Init*Exporter 设置
+	spanProcessor sdktr.SpanProcessor
+	// 基础 Resource：集群名、SeeFlow 版本
+	baseResource *resource.Resource
+	// cache: namespace/svc/pod -> TracerProvider
+	providers   *lru.Cache[string, *providerEntry]
+	muProviders sync.Mutex
 
-	ShutdownCtx context.Context
+	// 存储后端，为空则不存储流量，也不离线聚合
+	store Store
+
+	// 活跃 namespace 列表，通过 Hubble 更新
+	activeNamespaces   []string
+	muActiveNamespaces sync.Mutex
+
+	// 记录到 span 上的请求头
+	headerAllowList []string
+	// 从请求头析取链路上下文
+	propagator Propagator
+
+	// 离线聚合的策略，默认 kAssemble_Default
+	assembleKind int
 
-	tracerProvider *sdktr.TracerProvider
+	// 在线聚合，为空则由后台任务从 OLAP 拉取 span 离线聚合
+	online *onlineAssembler
 
-	olap *Olap
+	// L34、Sock 流量各一个 worker pool，消费 Check、Build、Insert
+	pools map[observerpb.FlowType]*workerPool
+	// L7 流量按 x-request-id 分片，同一请求的请求、响应串行配对
+	l7Pool *shardedPool
 }
 
 func NewTracerManager(vp *viper.Viper) *TracerManager {
 	var tm TracerManager
 	tm.ShutdownCtx = context.Background()
-	tm.tracers, _ = lru.New[string, *Tracer](config.MaxNumTracer)
-	tm.setActiveTraceID = make(map[string]bool, 0)
-	tm.bufFlow, _ = lru.New[string, *observerpb.Flow](config.MaxNumFlow)
-	tm.mapWgL7Consume = make(map[string]sync.WaitGroup, 0)
+	tm.traces = newTraceRegistry()
+	tm.bufFlow = newPendingStore(config.RequestTimeout, config.MaxNumFlow)
+	tm.uncommitted = newFlowTracker()
+	tm.providers = newProviderCache()
+	tm.headerAllowList = config.HeaderAllowList
+	tm.propagator, _ = NewPropagatorChain(config.Propagators)
+	tm.assembleKind = kAssemble_Default
+	tm.pools = make(map[observerpb.FlowType]*workerPool, 0)
+	for _, flowType := range []observerpb.FlowType{observerpb.FlowType_L3_L4, observerpb.FlowType_SOCK} {
+		tm.pools[flowType] = newWorkerPool(config.ConsumeWorkers, config.ConsumeQueueSize, config.EnqueueTimeout)
+	}
+	tm.l7Pool = newShardedPool(config.ConsumeWorkers, config.ConsumeQueueSize, config.EnqueueTimeout)
 
 	if vp == nil {
-		tm.olap = nil // under testing
+		tm.store = newMemStore() // under testing
+		tm.baseResource = newBaseResource("")
 	} else {
-		tm.olap = NewOlap(vp)
+		tm.store = NewStore(vp)
+		tm.baseResource = newBaseResource(vp.GetString("SEEFLOW_CLUSTER_NAME"))
+		if vp.GetBool("SEEFLOW_ONLINE_ASSEMBLE") {
+			tm.online = newOnlineAssembler(&tm)
+		}
+		if vp.IsSet("SEEFLOW_HEADER_ALLOWLIST") {
+			tm.headerAllowList = vp.GetStringSlice("SEEFLOW_HEADER_ALLOWLIST")
+		}
+		if name := vp.GetString("SEEFLOW_ASSEMBLE_STRATEGY"); name != "" {
+			kind, err := parseAssembleStrategy(name)
+			if err != nil {
+				logrus.WithError(err).Warn("SeeFlow ignored SEEFLOW_ASSEMBLE_STRATEGY")
+			} else {
+				tm.assembleKind = kind
+			}
+		}
+		if vp.IsSet("SEEFLOW_PROPAGATORS") {
+			chain, err := NewPropagatorChain(vp.GetStringSlice("SEEFLOW_PROPAGATORS"))
+			if err != nil {
+				logrus.WithError(err).Warn("SeeFlow ignored SEEFLOW_PROPAGATORS")
+			} else {
+				tm.propagator = chain
+			}
+		}
 	}
 
 	return &tm
 }
 
-func (tm *TracerManager) Olap() *Olap {
-	if tm.olap == nil {
-		logrus.Error("SeeFlow couldn't use nil olap")
+func (tm *TracerManager) Store() Store {
+	if tm.store == nil {
+		logrus.Error("SeeFlow couldn't use nil store")
 		return nil
 	}
-	return tm.olap
+	return tm.store
 }
 
-func (tm *TracerManager) newTracer(traceID string) *Tracer {
+func (tm *TracerManager) SetActiveNamespaces(namespaces []string) {
+	tm.muActiveNamespaces.Lock()
+	defer tm.muActiveNamespaces.Unlock()
+	tm.activeNamespaces = namespaces
+}
+
+func (tm *TracerManager) ActiveNamespaces() []string {
+	tm.muActiveNamespaces.Lock()
+	defer tm.muActiveNamespaces.Unlock()
+	return tm.activeNamespaces
+}
+
+// makeTracer 只构造 Tracer，不计数
+func (tm *TracerManager) makeTracer(traceID string) *Tracer {
 	var a Tracer
 	a.manager = tm
-	tm.numTracer.Add(1)
 	a.traceID = traceID
 	a.bufPreSpan = make([]*PreSpan, 0)
 	a.mapService = make(map[uint32]*PostSpan, 0)
 
-	a.tracer = tm.tracerProvider.Tracer(fmt.Sprintf("tracer#%d", a.traceID))
-
 	a.debMapTraceID = make(map[string]string, 0)
 	a.debMapSpanID = make(map[string]string, 0)
 	a.debMapParent = make(map[string]string, 0)
-
-	tm.tracers.Add(traceID, &a)
-	// 淘汰之前肯定是要聚合的
-	if tm.tracers.Len() == config.MaxNumTracer {
-		_, evict, _ := tm.tracers.RemoveOldest()
-		err := evict.Assemble(kAssemble_BasicAssemble, tm.ShutdownCtx)
-		if err != nil {
-			logrus.Warn(err)
-		}
-	}
-
+	a.debMapParentID = make(map[string]string, 0)
 	return &a
 }
 
+func (tm *TracerManager) newTracer(traceID string) *Tracer {
+	a := tm.makeTracer(traceID)
+	tm.numTracer.Add(1)
+	// Tracer 聚合后即丢弃，已分配的 SpanID 保存在 t_SpanAssign 中，晚到的 span 据此关联。
+	return a
+}
+
 // ConsumeFlow
 // 消耗一条 Flow 数据，针对不同的 flow 类型进行分发
 func (tm *TracerManager) ConsumeFlow(flow *observerpb.Flow) {
@@ -98,6 +158,8 @@ func (tm *TracerManager) ConsumeFlow(flow *observerpb.Flow) {
 		config.Log4RawL7.Debug(flow)
 	}
 
+	metricFlowsReceived.WithLabelValues(flow.Type.String()).Inc()
+
 	// 分发处理流量
 	switch flow.Type {
 	case observerpb.FlowType_L3_L4:
@@ -114,59 +176,175 @@ func (tm *TracerManager) ConsumeFlow(flow *observerpb.Flow) {
 	}
 }
 
+// StopConsume 不再接受流量，并等待已接受的流量消费完成
+func (tm *TracerManager) StopConsume() {
+	for _, pool := range tm.pools {
+		pool.Close()
+	}
+	tm.l7Pool.Close()
+}
+
+// ConsumeStats 返回各种流量的 worker pool 统计，键为流量类型，比如 "L7"
+func (tm *TracerManager) ConsumeStats() map[string]PoolStats {
+	stats := make(map[string]PoolStats, len(tm.pools)+1)
+	for flowType, pool := range tm.pools {
+		stats[flowType.String()] = pool.Stats()
+	}
+	stats[observerpb.FlowType_L7.String()] = tm.l7Pool.Stats()
+	return stats
+}
+
+// markActiveTraceID 记录 TraceID 的最近活跃时间，需在 span 写入之后调用
+func (tm *TracerManager) markActiveTraceID(traceID string) {
+	tm.traces.markActive(traceID, time.Now())
+}
+
+// popActiveTraceIDs 取出静默超过 quiescence 的 TraceID，quiescence 为 0 则全部取出
+func (tm *TracerManager) popActiveTraceIDs(quiescence time.Duration) []string {
+	return tm.traces.popQuiescent(quiescence)
+}
+
 // These hooked on defer-point of observe cmd:
 
 func (tm *TracerManager) AssembleAll() {
-	for at := range tm.setActiveTraceID {
+	// 先等待全部进行中的消费完成，包括尚未构建出 span 的响应
+	tm.traces.waitAll()
+	if tm.online != nil {
+		tm.AssembleQuiescent(0)
+		return
+	}
+	for _, at := range tm.popActiveTraceIDs(0) {
 		tm.Assemble(at)
 	}
-	// tm.setActiveTraceID.clear()
+}
+
+// AssembleQuiescent
+// 被 serve 的后台任务周期调用：聚合静默超过 quiescence 的 Trace，返回聚合的 Trace 数量。
+// 静默期内没有新的 span，才认为该 Trace 已经完整。
+func (tm *TracerManager) AssembleQuiescent(quiescence time.Duration) int {
+	traceIDs := tm.popActiveTraceIDs(quiescence)
+	if tm.online != nil {
+		// 在线聚合已经导出了 span，这里只回收静默的 Trace
+		for _, traceID := range traceIDs {
+			tm.waitL7Consume(traceID)
+			tm.traces.drop(traceID)
+		}
+		return tm.online.Sweep(quiescence)
+	}
+	if len(traceIDs) == 0 || tm.store == nil {
+		return 0
+	}
+
+	// 先等待消费完成，再统一刷入数据库，最后拉取 span 聚合
+	for _, traceID := range traceIDs {
+		tm.waitL7Consume(traceID)
+	}
+	tm.store.Flush()
 
+	for _, traceID := range traceIDs {
+		tm.Assemble(traceID)
+	}
+	return len(traceIDs)
+}
+
+// 等待 TraceID 下的 L7 消费完成
+func (tm *TracerManager) waitL7Consume(traceID string) {
+	tm.traces.wait(traceID)
 }
 
 // 状态机控制在更加上层
 func (tm *TracerManager) Assemble(traceID string) {
 	// 不接受无效（空）TraceID。
-	if !convertTraceID(traceID).IsValid() {
+	if _, ok := parseTraceID(traceID); !ok {
+		return
+	}
+	if tm.store == nil {
 		return
 	}
 
-	wg, hit := tm.mapWgL7Consume[traceID]
-	if !hit {
-		// 不存在这个 WG，说明该 TraceID 下没消费过 Span。
+	tm.waitL7Consume(traceID)
+	// 聚合之后回收，后续到达的 span 会重新登记
+	tm.traces.drop(traceID)
+
+	// 没有新的 span 则无需聚合
+	if !tm.CheckSpansCount(traceID) {
 		return
 	}
-	wg.Wait()
 
 	t := tm.newTracer(traceID)
 	// 直接从数据库拉取 span 到 t.bufPreSpan
 	// 已按 StartTime 字段升序排序
-	tm.olap.SelectL7Spans(&t.bufPreSpan, t.traceID)
-	err := t.Assemble(kAssemble_BasicAssemble, tm.ShutdownCtx)
+	spans, err := tm.store.SelectL7Spans(t.traceID)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_L7")
+	}
+	t.bufPreSpan = append(t.bufPreSpan, spans...)
+	// 只聚合增量，已导出的 span 作为 parent 候选
+	assigns, err := tm.store.SelectSpanAssigns(traceID)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_SpanAssign")
+		return
+	}
+	t.restoreAssigns(tm.ShutdownCtx, assigns)
+	if len(t.bufPreSpan) == 0 {
+		return
+	}
+	t.loadEvidence(tm.store)
+
+	err = t.Assemble(tm.assembleKind, tm.ShutdownCtx)
 	if err != nil {
 		logrus.Warn(err)
+	} else {
+		metricTracesAssembled.Inc()
+	}
+	t.numSpan = len(assigns) + len(t.assigns)
+	if err := tm.store.SaveSpanAssigns(t.assigns); err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't insert into t_SpanAssign")
 	}
 }
 
 func (tm *TracerManager) Flush() {
-	tm.olap.l34Inserter.Flush()
-	tm.olap.l7Inserter.Flush()
-	tm.olap.sockInserter.Flush()
+	if tm.store == nil {
+		return
+	}
+	tm.store.Flush()
+}
+
+// Drain 停止接受流量，等待已接受的流量消费完成并刷入数据库，然后聚合剩余的 Trace
+func (tm *TracerManager) Drain() {
+	tm.StopConsume()
+	tm.Flush()
+	tm.AssembleAll()
 }
 
 func (tm *TracerManager) Summary() {
+	// 日志丢弃的流量
+	for flowType, stats := range tm.ConsumeStats() {
+		if stats.Dropped != 0 {
+			logrus.Warnf("SeeFlow dropped %d %s flows because the queue was full", stats.Dropped, flowType)
+		}
+	}
+	if pending := tm.PendingStats(); pending.Pending != 0 {
+		logrus.Warnf("SeeFlow left %d unmatched flows", pending.Pending)
+	}
+	if tm.store == nil {
+		return
+	}
 	// 日志异常流量
-	tm.olap.SummaryExFlows()
+	tm.store.SummaryExFlows()
 	// 日志插入数量（todo）
 }
 
+// CheckSpansCount 检查 Trace 下是否有尚未导出的 span
+// true 代表有
 func (tm *TracerManager) CheckSpansCount(trace_id string) bool {
-	current := tm.olap.countL7Spans("trace_id", trace_id)
-
-	history := 0
-	tracer, hit := tm.tracers.Get(trace_id)
-	if hit {
-		history = tracer.numSpan
+	current, err := tm.store.CountL7Spans(trace_id)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_L7")
+	}
+	history, err := tm.store.CountSpanAssigns(trace_id)
+	if err != nil {
+		logrus.WithError(err).Warn("SeeFlow couldn't select t_SpanAssign")
 	}
-	return current != history
+	return current > history
 }
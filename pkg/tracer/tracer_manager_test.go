@@ -1 +1,221 @@
 package tracer
+
+import (
+	"fmt"
+	observerpb "github.com/cilium/cilium/api/v1/observer"
+	"github.com/stleox/seeflow/pkg/config"
+	r "github.com/stretchr/testify/require"
+	sdktr "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracerManager_popActiveTraceIDs(t *testing.T) {
+	tm := NewTracerManager(nil)
+	tm.traces.markActive("old", time.Now().Add(-time.Minute))
+	tm.markActiveTraceID("new")
+
+	// 只取出静默超过窗口的
+	r.Equal(t, []string{"old"}, tm.popActiveTraceIDs(time.Second))
+	r.Empty(t, tm.popActiveTraceIDs(time.Second))
+
+	// 窗口为 0 则全部取出
+	tm.markActiveTraceID("old")
+	got := tm.popActiveTraceIDs(0)
+	sort.Strings(got)
+	r.Equal(t, []string{"new", "old"}, got)
+	r.Empty(t, tm.popActiveTraceIDs(0))
+
+	// 聚合后回收
+	tm.traces.drop("new")
+	tm.traces.drop("old")
+	r.Zero(t, tm.traces.Len())
+}
+
+func TestTracerManager_waitL7Consume(t *testing.T) {
+	tm := NewTracerManager(nil)
+	tm.waitL7Consume(uuid1)
+
+	done := tm.traces.begin(uuid1)
+	finished := false
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+		done()
+	}()
+	tm.waitL7Consume(uuid1)
+	r.True(t, finished)
+	// 没有构建出 span，完成后即回收
+	r.Zero(t, tm.traces.Len())
+
+	// 响应不知道所属 Trace，等待任一 Trace 时都等待此前到达的响应
+	done = tm.traces.beginUntraced()
+	finished = false
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+		done()
+	}()
+	tm.waitL7Consume(uuid2)
+	r.True(t, finished)
+}
+
+// 并发消费大量流量：用 -race 运行，检查 TracerManager 的状态没有数据竞争，且每一对请求、响应都构建出了 span
+func TestTracerManager_ConcurrentConsume(t *testing.T) {
+	const (
+		numTrace   = 200
+		numHop     = 5
+		numWorker  = 16
+		headerName = "X-B3-Traceid"
+	)
+	defer resetMockIdentities()
+	defer func(n int) { config.MaxNumFlow = n }(config.MaxNumFlow)
+	config.MaxNumFlow = 2 * numTrace * numHop
+
+	tm := mockNewTracerManager()
+	tm.online = newOnlineAssembler(tm)
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+	// 预先构造流量，mock 的 identity 分配不是并发安全的
+	flows := make([]*observerpb.Flow, 0, 2*numTrace*numHop)
+	for i := 0; i < numTrace; i++ {
+		traceID := fmt.Sprintf("%032x", i+1)
+		for j := 0; j < numHop; j++ {
+			xreqID := fmt.Sprintf("%s-%d", traceID, j)
+			src, dest := fmt.Sprintf("svc%d", j), fmt.Sprintf("svc%d", j+1)
+			req := mockFlow(xreqID, time.Unix(int64(j+1), 0), false, src, dest)
+			resp := mockFlow(xreqID, time.Unix(int64(2*numHop-j), 0), true, dest, src)
+			for _, flow := range []*observerpb.Flow{req, resp} {
+				flow.Type = observerpb.FlowType_L7
+				for _, h := range flow.L7.GetHttp().Headers {
+					if h.Key == headerName {
+						h.Value = traceID
+					}
+				}
+				flows = append(flows, flow)
+			}
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(flows), func(i, j int) {
+		flows[i], flows[j] = flows[j], flows[i]
+	})
+
+	var wg sync.WaitGroup
+	ch := make(chan *observerpb.Flow)
+	for w := 0; w < numWorker; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for flow := range ch {
+				tm.ConsumeFlow(flow)
+			}
+		}()
+	}
+	for _, flow := range flows {
+		ch <- flow
+	}
+	close(ch)
+	wg.Wait()
+
+	tm.AssembleAll()
+	r.Len(t, exporter.GetSpans(), numTrace*numHop)
+	stats := tm.PendingStats()
+	r.Equal(t, int64(numTrace*numHop), stats.Matched)
+	r.Zero(t, stats.Pending)
+	r.Zero(t, tm.traces.Len())
+	r.Empty(t, tm.online.traces)
+}
+
+// 按固定顺序重放交错的请求、响应，其中一半响应先于请求到达：
+// 同一请求的两条流量被分到同一分片串行配对，每一轮的结果都相同
+func TestTracerManager_InterleavedReplay(t *testing.T) {
+	const (
+		numPair   = 200
+		numReplay = 3
+	)
+	defer resetMockIdentities()
+	defer func(n int, d time.Duration) {
+		config.MaxNumFlow, config.RequestTimeout = n, d
+	}(config.MaxNumFlow, config.RequestTimeout)
+	config.MaxNumFlow = 2 * numPair
+	config.RequestTimeout = time.Hour
+
+	flows := make([]*observerpb.Flow, 0, 2*numPair)
+	want := make(map[int64]int64, numPair)
+	for i := 0; i < numPair; i++ {
+		xreqID := fmt.Sprintf("xreq-%d", i)
+		req := mockFlow(xreqID, time.Unix(int64(i+1), 0), false, "foo", "bar")
+		resp := mockFlow(xreqID, time.Unix(int64(i+2), 0), true, "bar", "foo")
+		req.Type, resp.Type = observerpb.FlowType_L7, observerpb.FlowType_L7
+		if i%2 == 0 {
+			flows = append(flows, req, resp)
+		} else {
+			flows = append(flows, resp, req)
+		}
+		want[int64(i+1)] = int64(i + 2)
+	}
+
+	for n := 0; n < numReplay; n++ {
+		tm := mockNewTracerManager()
+		tm.online = newOnlineAssembler(tm)
+		exporter := tracetest.NewInMemoryExporter()
+		tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+		for _, flow := range flows {
+			tm.ConsumeFlow(flow)
+		}
+		tm.StopConsume()
+		tm.AssembleAll()
+
+		got := make(map[int64]int64, numPair)
+		for _, span := range exporter.GetSpans() {
+			got[span.StartTime.Unix()] = span.EndTime.Unix()
+		}
+		r.Equal(t, want, got)
+		r.Equal(t, PendingStats{Matched: numPair}, tm.PendingStats())
+	}
+}
+
+// 不开启在线聚合：span 写入内存存储，Drain 时从存储拉取并聚合，与 Doris 后端走同一条路径
+func TestTracerManager_StoreAssemble(t *testing.T) {
+	const headerName = "X-B3-Traceid"
+	defer resetMockIdentities()
+
+	tm := mockNewTracerManager()
+	exporter := tracetest.NewInMemoryExporter()
+	tm.spanProcessor = sdktr.NewSimpleSpanProcessor(exporter)
+
+	traceID := fmt.Sprintf("%032x", 1)
+	for j, hop := range [][2]string{{"foo", "bar"}, {"bar", "baz"}} {
+		xreqID := fmt.Sprintf("%s-%d", traceID, j)
+		req := mockFlow(xreqID, time.Unix(int64(j+1), 0), false, hop[0], hop[1])
+		resp := mockFlow(xreqID, time.Unix(int64(4-j), 0), true, hop[1], hop[0])
+		for _, flow := range []*observerpb.Flow{req, resp} {
+			flow.Type = observerpb.FlowType_L7
+			for _, h := range flow.L7.GetHttp().Headers {
+				if h.Key == headerName {
+					h.Value = traceID
+				}
+			}
+			tm.ConsumeFlow(flow)
+		}
+	}
+	tm.Drain()
+
+	spans := exporter.GetSpans()
+	r.Len(t, spans, 2)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].StartTime.Before(spans[j].StartTime) })
+	r.Equal(t, traceID, spans[0].SpanContext.TraceID().String())
+	r.Equal(t, spans[0].SpanContext.SpanID(), spans[1].Parent.SpanID())
+
+	count, err := tm.store.CountSpanAssigns(traceID)
+	r.NoError(t, err)
+	r.Equal(t, 2, count)
+	// 已导出的 span 不再聚合
+	r.False(t, tm.CheckSpansCount(traceID))
+}
@@ -0,0 +1,151 @@
+package tracer
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workerPool 固定数量的 worker 消费有界队列中的任务，替代每条流量一个 goroutine。
+// 队列满时 Submit 阻塞，反压到接收 Hubble 流量的循环；阻塞超过 timeout 则丢弃任务并计数，timeout 为 0 时一直阻塞。
+type workerPool struct {
+	queue   chan func()
+	timeout time.Duration
+	wg      sync.WaitGroup
+
+	// 关闭后不再接受任务
+	closed   bool
+	muClosed sync.RWMutex
+
+	numDone    atomic.Int64
+	numDropped atomic.Int64
+}
+
+// PoolStats 单个 worker pool 的统计
+type PoolStats struct {
+	Queued  int   // 当前排队的任务数量
+	Done    int64 // 完成的任务数量
+	Dropped int64 // 因队列满或已关闭而丢弃的任务数量
+}
+
+func newWorkerPool(numWorker int, queueSize int, timeout time.Duration) *workerPool {
+	p := &workerPool{
+		queue:   make(chan func(), queueSize),
+		timeout: timeout,
+	}
+	for i := 0; i < numWorker; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for task := range p.queue {
+		task()
+		p.numDone.Add(1)
+	}
+}
+
+// Submit 提交任务，返回是否被接受；未被接受的任务不会执行
+func (p *workerPool) Submit(task func()) bool {
+	p.muClosed.RLock()
+	defer p.muClosed.RUnlock()
+	if p.closed {
+		p.numDropped.Add(1)
+		return false
+	}
+
+	// 队列未满则直接入队，避免创建定时器
+	select {
+	case p.queue <- task:
+		return true
+	default:
+	}
+
+	if p.timeout <= 0 {
+		p.queue <- task
+		return true
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.queue <- task:
+		return true
+	case <-timer.C:
+		p.numDropped.Add(1)
+		return false
+	}
+}
+
+// Close 不再接受任务，并等待已入队的任务完成
+func (p *workerPool) Close() {
+	p.muClosed.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.muClosed.Unlock()
+	p.wg.Wait()
+}
+
+func (p *workerPool) Stats() PoolStats {
+	return PoolStats{
+		Queued:  len(p.queue),
+		Done:    p.numDone.Load(),
+		Dropped: p.numDropped.Load(),
+	}
+}
+
+// shardedPool 按键把任务路由到固定的分片，每个分片只有一个 worker，
+// 所以同一个键的任务按提交顺序串行执行，不同键之间并行且无需全局锁。
+type shardedPool struct {
+	shards []*workerPool
+}
+
+// newShardedPool 总的排队上限为 queueSize，平均分给各个分片
+func newShardedPool(numShard int, queueSize int, timeout time.Duration) *shardedPool {
+	if numShard < 1 {
+		numShard = 1
+	}
+	shardQueueSize := queueSize / numShard
+	if shardQueueSize < 1 {
+		shardQueueSize = 1
+	}
+	p := &shardedPool{shards: make([]*workerPool, 0, numShard)}
+	for i := 0; i < numShard; i++ {
+		p.shards = append(p.shards, newWorkerPool(1, shardQueueSize, timeout))
+	}
+	return p
+}
+
+func (p *shardedPool) shardOf(key string) *workerPool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// Submit 提交任务到 key 所在的分片，返回是否被接受
+func (p *shardedPool) Submit(key string, task func()) bool {
+	return p.shardOf(key).Submit(task)
+}
+
+func (p *shardedPool) Close() {
+	for _, shard := range p.shards {
+		shard.Close()
+	}
+}
+
+// Stats 各分片统计之和
+func (p *shardedPool) Stats() PoolStats {
+	var stats PoolStats
+	for _, shard := range p.shards {
+		s := shard.Stats()
+		stats.Queued += s.Queued
+		stats.Done += s.Done
+		stats.Dropped += s.Dropped
+	}
+	return stats
+}
@@ -0,0 +1,105 @@
+package tracer
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func TestWorkerPool_Backpressure(t *testing.T) {
+	p := newWorkerPool(1, 1, 20*time.Millisecond)
+
+	// 唯一的 worker 阻塞，队列中再放一个，之后的提交阻塞直到超时
+	release := make(chan struct{})
+	started := make(chan struct{})
+	r.True(t, p.Submit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	r.True(t, p.Submit(func() {}))
+
+	begin := time.Now()
+	r.False(t, p.Submit(func() {}))
+	r.GreaterOrEqual(t, time.Since(begin), 20*time.Millisecond)
+	r.Equal(t, PoolStats{Queued: 1, Dropped: 1}, p.Stats())
+
+	// worker 恢复后，阻塞的提交被接受
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(release)
+	}()
+	r.True(t, p.Submit(func() {}))
+
+	p.Close()
+	r.Equal(t, PoolStats{Done: 3, Dropped: 1}, p.Stats())
+}
+
+func TestWorkerPool_BlockForever(t *testing.T) {
+	p := newWorkerPool(1, 1, 0)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	r.True(t, p.Submit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	r.True(t, p.Submit(func() {}))
+
+	// timeout 为 0 时不丢弃，阻塞到 worker 恢复
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	begin := time.Now()
+	r.True(t, p.Submit(func() {}))
+	r.GreaterOrEqual(t, time.Since(begin), 50*time.Millisecond)
+
+	p.Close()
+	r.Equal(t, PoolStats{Done: 3}, p.Stats())
+}
+
+func TestWorkerPool_Close(t *testing.T) {
+	p := newWorkerPool(4, 64, time.Second)
+
+	var done atomic.Int32
+	for i := 0; i < 64; i++ {
+		r.True(t, p.Submit(func() {
+			time.Sleep(time.Millisecond)
+			done.Add(1)
+		}))
+	}
+	// 关闭时等待已入队的任务完成，之后的提交被丢弃
+	p.Close()
+	r.Equal(t, int32(64), done.Load())
+	r.False(t, p.Submit(func() {}))
+	r.Equal(t, int64(1), p.Stats().Dropped)
+}
+
+func TestShardedPool_Order(t *testing.T) {
+	p := newShardedPool(4, 64, time.Second)
+
+	// 同一个键的任务按提交顺序执行
+	const numKey, numTask = 16, 100
+	var seqs [numKey][]int
+	for i := 0; i < numTask; i++ {
+		for k := 0; k < numKey; k++ {
+			k, i := k, i
+			r.True(t, p.Submit(fmt.Sprintf("key%d", k), func() {
+				seqs[k] = append(seqs[k], i)
+			}))
+		}
+	}
+	p.Close()
+
+	for k := 0; k < numKey; k++ {
+		r.Len(t, seqs[k], numTask)
+		r.True(t, sort.IntsAreSorted(seqs[k]))
+	}
+	r.Equal(t, int64(numKey*numTask), p.Stats().Done)
+}